@@ -0,0 +1,421 @@
+package backlite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+)
+
+// defaultBatchSize is the maximum number of tasks in a batch if the queue does not provide one.
+const defaultBatchSize = 100
+
+type (
+	// Batch is the policy for how tasks in a batch queue are grouped.
+	Batch struct {
+		// MaxSize is the maximum number of tasks in a batch. If omitted, 100 is used.
+		MaxSize int
+
+		// Linger is the maximum duration a ready task waits for the batch to fill before the tasks that are ready are
+		// executed. If omitted, the tasks that are ready are executed immediately.
+		Linger time.Duration
+	}
+
+	// BatchProcessor is a generic processor callback for a given batch queue to process many Tasks at once.
+	// If only some tasks fail, a *BatchError should be returned to indicate which, otherwise every task in the batch
+	// is considered to have failed.
+	BatchProcessor[T Task] func(context.Context, []T) error
+
+	// BatchError reports the tasks within a batch which failed, so only they are retried.
+	BatchError struct {
+		// Errors contains the error of each task which failed, keyed by the index of the task in the batch.
+		Errors map[int]error
+	}
+
+	// batchQueue provides a type-safe implementation of Queue which processes tasks in batches.
+	batchQueue[T Task] struct {
+		config    *QueueConfig
+		processor BatchProcessor[T]
+	}
+
+	// batcher is implemented by queues which process tasks in batches.
+	batcher interface {
+		processBatch(ctx context.Context, items []batchItem) error
+	}
+
+	// batchItem is a task payload within a batch.
+	batchItem struct {
+		// codec is the codec the payload was encoded with.
+		codec Codec
+
+		// payload is the encoded payload.
+		payload []byte
+
+		// err is the error which prevented the payload from being loaded, in which case the task fails without being
+		// processed.
+		err error
+	}
+)
+
+// NewBatchQueue creates a new type-safe Queue of a given Task type which passes the tasks to the processor in
+// batches, according to the Batch in the configuration of the queue.
+func NewBatchQueue[T Task](processor BatchProcessor[T]) Queue {
+	var task T
+	cfg := task.Config()
+
+	return &batchQueue[T]{
+		config:    &cfg,
+		processor: processor,
+	}
+}
+
+func (q *batchQueue[T]) Config() *QueueConfig {
+	return q.config
+}
+
+// Process processes a single task as a batch.
+func (q *batchQueue[T]) Process(ctx context.Context, payload []byte) error {
+	err := q.processBatch(ctx, []batchItem{{codec: codecFromContext(ctx), payload: payload}})
+
+	var berr *BatchError
+	if errors.As(err, &berr) {
+		return berr.Errors[0]
+	}
+
+	return err
+}
+
+// processBatch decodes the items and passes them to the processor. A *BatchError is returned, keyed by the index of the
+// items, if any of them failed.
+func (q *batchQueue[T]) processBatch(ctx context.Context, items []batchItem) error {
+	errs := &BatchError{}
+	objs := make([]T, 0, len(items))
+	indexes := make([]int, 0, len(items))
+
+	for i, item := range items {
+		if item.err != nil {
+			errs.Fail(i, item.err)
+			continue
+		}
+
+		var obj T
+		if err := item.codec.Decode(bytes.NewReader(item.payload), &obj); err != nil {
+			errs.Fail(i, err)
+			continue
+		}
+
+		objs = append(objs, obj)
+		indexes = append(indexes, i)
+	}
+
+	if len(objs) == 0 {
+		return errs.Err()
+	}
+
+	// Map the errors of the processed tasks back to the index of their item.
+	var berr *BatchError
+	switch err := q.processor(ctx, objs); {
+	case err == nil:
+	case errors.As(err, &berr):
+		for i, err := range berr.Errors {
+			if i >= 0 && i < len(indexes) && err != nil {
+				errs.Fail(indexes[i], err)
+			}
+		}
+	default:
+		for _, i := range indexes {
+			errs.Fail(i, err)
+		}
+	}
+
+	return errs.Err()
+}
+
+// batch returns the maximum size and linger duration of batches.
+func (c *QueueConfig) batch() (int, time.Duration) {
+	if c.Batch == nil {
+		return defaultBatchSize, 0
+	}
+
+	size := c.Batch.MaxSize
+	if size < 1 {
+		size = defaultBatchSize
+	}
+
+	return size, c.Batch.Linger
+}
+
+// Fail records that the task at the given index in the batch failed.
+func (e *BatchError) Fail(index int, err error) {
+	if e.Errors == nil {
+		e.Errors = make(map[int]error)
+	}
+	e.Errors[index] = err
+}
+
+// Err returns the BatchError if any tasks failed, otherwise nil.
+func (e *BatchError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d tasks in the batch failed", len(e.Errors))
+}
+
+// Unwrap returns the errors of the failed tasks in order of their index.
+func (e *BatchError) Unwrap() []error {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	slices.Sort(indexes)
+
+	errs := make([]error, 0, len(indexes))
+	for _, i := range indexes {
+		errs = append(errs, e.Errors[i])
+	}
+
+	return errs
+}
+
+// fetchBatches fetches tasks from each batch queue, which is not excluded, and sends the tasks that are ready to a
+// worker as a single batch, using at most one worker per queue. The number of workers used is returned along with the
+// earliest time a batch queue needs to be fetched again.
+//
+// So that batch queues which always have tasks ready cannot starve the other queues, if there are any, a worker is
+// left for them, and with a single worker available, batch queues only use it on every other fetch. The batch queue
+// which is fetched first is rotated so each gets a turn when there are fewer workers than batch queues.
+func (d *dispatcher) fetchBatches(
+	deadline time.Time,
+	workers int,
+	exclude task.Exclusions,
+	conc *concurrency) (int, time.Time, error) {
+	var used int
+	var refill time.Time
+
+	queues := d.client.queues.batched()
+	if len(queues) == 0 {
+		return used, refill, nil
+	}
+
+	limit := workers
+	if d.client.queues.count() > len(queues) {
+		limit = workers - 1
+		if limit == 0 && d.batchTurn%2 == 0 {
+			limit = 1
+		}
+	}
+
+	start := d.batchTurn % len(queues)
+	queues = append(queues[start:], queues[:start]...)
+	d.batchTurn++
+
+	for _, q := range queues {
+		cfg := q.Config()
+		if slices.Contains(exclude.Queues, cfg.Name) {
+			continue
+		}
+
+		// Fetch again once the other queues have had a turn.
+		if used >= limit {
+			refill = now()
+			break
+		}
+
+		size, linger := cfg.batch()
+
+		// Fetch one more task than the batch size to know if there are more tasks ready.
+		tasks, err := task.GetScheduledQueueTasks(d.ctx, d.client.db, deadline, cfg.Name, size+1, exclude.Keys)
+		if err != nil {
+			return used, refill, err
+		}
+
+		var ready task.Tasks
+		for _, t := range tasks {
+			if t.WaitUntil != nil && t.WaitUntil.After(now()) {
+				refill = earliest(refill, *t.WaitUntil)
+				break
+			}
+
+			if len(ready) == size {
+				refill = now()
+				break
+			}
+
+			ready = append(ready, t)
+		}
+
+		if len(ready) == 0 {
+			continue
+		}
+
+		// Wait for the batch to fill until the oldest ready task has lingered long enough.
+		if len(ready) < size && linger > 0 {
+			var oldest time.Time
+			for _, t := range ready {
+				at := t.CreatedAt
+				if t.WaitUntil != nil {
+					at = *t.WaitUntil
+				}
+				if oldest.IsZero() || at.Before(oldest) {
+					oldest = at
+				}
+			}
+
+			if at := oldest.Add(linger); at.After(now()) {
+				refill = earliest(refill, at)
+				continue
+			}
+		}
+
+		// Skip the tasks whose throttle key, or queue, is at its concurrency cap, whose circuit does not allow them or
+		// has exhausted its rate limit, and fetch again shortly. The circuit is checked before the rate limits so a
+		// task which cannot execute uses no tokens.
+		batch := make(task.Tasks, 0, len(ready))
+		for _, t := range ready {
+			if conc.full(t) || !d.admit(t) {
+				refill = earliest(refill, now().Add(limitPollInterval))
+				continue
+			}
+
+			if !d.allow(t) {
+				d.cancelProbe(t)
+				refill = earliest(refill, now().Add(limitPollInterval))
+				continue
+			}
+
+			conc.add(t)
+			batch = append(batch, t)
+		}
+
+		claimed, err := d.claim(batch, deadline, conc.caps)
+		if err != nil {
+			return used, refill, err
+		}
+
+		if len(claimed) < len(batch) {
+			refill = earliest(refill, now().Add(limitPollInterval))
+		}
+
+		if len(claimed) == 0 {
+			continue
+		}
+
+		<-d.availableWorkers
+		d.batches <- claimed
+		used++
+	}
+
+	return used, refill, nil
+}
+
+// processBatch attempts to execute a given batch of tasks, which are all in the same queue. Tasks which fail are
+// handled individually, so only they are retried. Middleware is not applied to batches and the timeout of the queue
+// applies to the entire batch.
+func (d *dispatcher) processBatch(tasks task.Tasks) {
+	var err error
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	q := d.client.queues.get(tasks[0].Queue)
+	cfg := q.Config()
+
+	// Discard the tasks rather than executing them if the deadline to start has passed, unless they are being retried.
+	batch := make(task.Tasks, 0, len(tasks))
+	for _, t := range tasks {
+		if t.Attempts == 1 && t.Deadline != nil && now().After(*t.Deadline) {
+			d.cancelProbe(t)
+			d.taskExpired(q, t)
+			continue
+		}
+		batch = append(batch, t)
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithDeadline(d.ctx, now().Add(cfg.Timeout))
+		defer cancel()
+	} else {
+		ctx = d.ctx
+	}
+
+	// Store the client in the context so the processor can use it.
+	ctx = context.WithValue(ctx, ctxKeyClient{}, d.client)
+
+	for _, t := range batch {
+		d.client.hooks.emit(ctx, Event{
+			Type:    EventStarted,
+			TaskID:  t.ID,
+			Queue:   t.Queue,
+			Attempt: t.Attempts,
+		})
+	}
+
+	start := now()
+
+	// Restore the encoded payloads, upgraded to the current version of the queue.
+	items := make([]batchItem, len(batch))
+
+	defer func() {
+		// Recover from panics from within the batch processor, which fails the entire batch.
+		if rec := recover(); rec != nil {
+			d.log.Error("panic processing batch",
+				"queue", cfg.Name,
+				"size", len(batch),
+				"error", rec,
+			)
+
+			err = fmt.Errorf("%v", rec)
+		}
+
+		var berr *BatchError
+		errors.As(err, &berr)
+
+		for i, t := range batch {
+			taskErr := err
+			if berr != nil {
+				taskErr = berr.Errors[i]
+			}
+
+			switch {
+			case taskErr == nil:
+				d.recordOutcome(t, nil)
+				d.taskSuccess(q, t, start, time.Since(start), nil)
+			case d.ctx.Err() != nil:
+				d.taskCancelled(ctx, t, time.Since(start), taskErr)
+			default:
+				// Tasks whose payload could not be loaded were not processed, so they are not recorded in the
+				// circuit of the queue.
+				if items[i].err == nil {
+					d.recordOutcome(t, taskErr)
+				} else {
+					d.cancelProbe(t)
+				}
+				d.taskFailure(q, t, start, time.Since(start), taskErr)
+			}
+		}
+	}()
+
+	for i, t := range batch {
+		if items[i].codec = d.client.codecs.get(t.Codec); items[i].codec == nil {
+			items[i].err = fmt.Errorf("codec '%s' not registered", t.Codec)
+			continue
+		}
+
+		if items[i].payload, items[i].err = d.client.unpack(ctx, t); items[i].err == nil {
+			items[i].payload, items[i].err = cfg.upgrade(t.Version, items[i].payload)
+		}
+	}
+
+	err = q.(batcher).processBatch(ctx, items)
+}
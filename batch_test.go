@@ -0,0 +1,311 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestBatchError(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+
+	e := &BatchError{}
+	if e.Err() != nil {
+		t.Error("expected no error")
+	}
+
+	e.Fail(2, errB)
+	e.Fail(0, errA)
+	testutil.Equal(t, "message", "2 tasks in the batch failed", e.Err().Error())
+
+	unwrapped := e.Unwrap()
+	testutil.Length(t, unwrapped, 2)
+	testutil.Equal(t, "first", errA, unwrapped[0])
+	testutil.Equal(t, "second", errB, unwrapped[1])
+
+	if !errors.Is(e, errB) {
+		t.Error("expected batch error to wrap task errors")
+	}
+}
+
+func TestQueueConfig_Batch(t *testing.T) {
+	cfg := testTaskBatch{}.Config()
+	size, linger := cfg.batch()
+	testutil.Equal(t, "size", 3, size)
+	testutil.Equal(t, "linger", time.Minute, linger)
+
+	size, linger = (&QueueConfig{}).batch()
+	testutil.Equal(t, "default size", defaultBatchSize, size)
+	testutil.Equal(t, "default linger", time.Duration(0), linger)
+}
+
+func TestBatchQueue_ProcessBatch(t *testing.T) {
+	var processed []string
+	errFailed := errors.New("failed")
+
+	q := NewBatchQueue[testTaskBatch](func(ctx context.Context, tasks []testTaskBatch) error {
+		processed = processed[:0]
+		for _, tk := range tasks {
+			processed = append(processed, tk.Val)
+		}
+
+		errs := &BatchError{}
+		for i, tk := range tasks {
+			if tk.Val == "fail" {
+				errs.Fail(i, errFailed)
+			}
+		}
+		return errs.Err()
+	})
+
+	codec := JSONCodec{}
+	errLoad := errors.New("load")
+	items := []batchItem{
+		{err: errLoad},
+		{codec: codec, payload: testutil.Encode(t, testTaskBatch{Val: "a"})},
+		{codec: codec, payload: []byte("{")},
+		{codec: codec, payload: testutil.Encode(t, testTaskBatch{Val: "fail"})},
+		{codec: codec, payload: testutil.Encode(t, testTaskBatch{Val: "b"})},
+	}
+
+	err := q.(batcher).processBatch(context.Background(), items)
+	testutil.Equal(t, "processed", "a,fail,b", strings.Join(processed, ","))
+
+	var berr *BatchError
+	if !errors.As(err, &berr) {
+		t.Fatalf("expected batch error, got %v", err)
+	}
+
+	testutil.Equal(t, "failures", 3, len(berr.Errors))
+	testutil.Equal(t, "load", errLoad, berr.Errors[0])
+	testutil.Equal(t, "decode", true, berr.Errors[2] != nil)
+	testutil.Equal(t, "processor", errFailed, berr.Errors[3])
+
+	// Any other error fails every processed task.
+	q = NewBatchQueue[testTaskBatch](func(ctx context.Context, tasks []testTaskBatch) error {
+		return errFailed
+	})
+
+	err = q.(batcher).processBatch(context.Background(), items[1:2])
+	if !errors.As(err, &berr) {
+		t.Fatalf("expected batch error, got %v", err)
+	}
+	testutil.Equal(t, "all failed", errFailed, berr.Errors[0])
+}
+
+func TestDispatcher_Fetch__Batch(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ticker = time.NewTicker(time.Hour)
+	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.batches = make(chan task.Tasks, d.numWorkers)
+	d.ready = make(chan struct{}, 1)
+	d.availableWorkers = make(chan struct{}, d.numWorkers)
+	for range d.numWorkers {
+		d.availableWorkers <- struct{}{}
+	}
+
+	d.client.dispatcher = &mockDispatcher{}
+	d.client.Register(NewBatchQueue[testTaskBatch](func(ctx context.Context, _ []testTaskBatch) error {
+		return nil
+	}))
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		return nil
+	}))
+
+	fetched := func() ([]task.Tasks, task.Tasks) {
+		var batches []task.Tasks
+		var tasks task.Tasks
+		for len(d.batches) > 0 {
+			batches = append(batches, <-d.batches)
+			d.availableWorkers <- struct{}{}
+		}
+		for len(d.tasks) > 0 {
+			tasks = append(tasks, <-d.tasks)
+			d.availableWorkers <- struct{}{}
+		}
+		for len(d.ready) > 0 {
+			<-d.ready
+		}
+		return batches, tasks
+	}
+
+	if err := d.client.Add(testTaskBatch{Val: "1"}, testTaskBatch{Val: "2"}, testTask{Val: "3"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch waits for more tasks while the ready tasks linger, without affecting other queues.
+	d.fetch()
+	batches, tasks := fetched()
+	testutil.Length(t, batches, 0)
+	testutil.Length(t, tasks, 1)
+
+	// Once the batch is full, it is sent to a single worker and the remaining tasks are fetched again.
+	for _, val := range []string{"4", "5"} {
+		if err := d.client.Add(testTaskBatch{Val: val}).Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.fetch()
+	testutil.WaitForChan(t, d.ready)
+	batches, tasks = fetched()
+	testutil.Length(t, batches, 1)
+	testutil.Length(t, batches[0], 3)
+	testutil.Length(t, tasks, 0)
+
+	for _, tk := range batches[0] {
+		testutil.Equal(t, "attempts", 1, tk.Attempts)
+	}
+
+	// Once the remaining task has lingered, it is sent alone.
+	testutil.InsertTask(t, d.client.db, &task.Task{
+		Queue:     "test-batch",
+		Task:      testutil.Encode(t, testTaskBatch{Val: "6"}),
+		CreatedAt: now().Add(-2 * time.Minute),
+	})
+
+	d.fetch()
+	batches, _ = fetched()
+	testutil.Length(t, batches, 1)
+	testutil.Length(t, batches[0], 2)
+}
+
+func TestDispatcher_FetchBatches__Turns(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.batches = make(chan task.Tasks, 10)
+	d.availableWorkers = make(chan struct{}, 10)
+
+	d.client.Register(NewBatchQueue[testTaskBatch](func(ctx context.Context, _ []testTaskBatch) error {
+		return nil
+	}))
+
+	fetch := func(workers int) (int, time.Time) {
+		for range workers {
+			d.availableWorkers <- struct{}{}
+		}
+
+		testutil.InsertTask(t, d.client.db, &task.Task{
+			Queue:     "test-batch",
+			Task:      testutil.Encode(t, testTaskBatch{Val: "1"}),
+			CreatedAt: now().Add(-2 * time.Minute),
+		})
+
+		deadline := now().Add(-d.releaseAfter)
+		conc, err := d.concurrency(deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		used, refill, err := d.fetchBatches(deadline, workers, task.Exclusions{}, conc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for len(d.batches) > 0 {
+			<-d.batches
+		}
+		for len(d.availableWorkers) > 0 {
+			<-d.availableWorkers
+		}
+		return used, refill
+	}
+
+	// Without other queues, batch queues can use every worker.
+	for range 2 {
+		used, _ := fetch(1)
+		testutil.Equal(t, "used", 1, used)
+	}
+
+	// With other queues, a worker is left for them.
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		return nil
+	}))
+
+	used, _ := fetch(2)
+	testutil.Equal(t, "used", 1, used)
+
+	// With a single worker, batch queues use it on every other fetch, and fetch again once the other queues have
+	// had a turn.
+	d.batchTurn = 0
+	used, _ = fetch(1)
+	testutil.Equal(t, "used", 1, used)
+
+	used, refill := fetch(1)
+	testutil.Equal(t, "used", 0, used)
+	testutil.Equal(t, "refill", now(), refill)
+
+	used, _ = fetch(1)
+	testutil.Equal(t, "used", 1, used)
+}
+
+func TestTaskAddOp_Save__BatchTimeout(t *testing.T) {
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	c.Register(NewBatchQueue[testTaskBatch](func(ctx context.Context, _ []testTaskBatch) error {
+		return nil
+	}))
+
+	err := c.Add(testTask{Val: "1"}, testTaskBatch{Val: "2"}).Timeout(time.Second).Save()
+	if !errors.Is(err, ErrBatchTimeout) {
+		t.Errorf("expected batch timeout error, got %v", err)
+	}
+	testutil.Length(t, testutil.GetTasks(t, c.db), 0)
+
+	if err = c.Add(testTask{Val: "1"}).Timeout(time.Second).Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatcher_ProcessBatch(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 10)
+	d.ctx = context.Background()
+
+	var events []Event
+	d.client.Subscribe(func(_ context.Context, e Event) {
+		events = append(events, e)
+	})
+
+	errFailed := errors.New("failed")
+	d.client.Register(NewBatchQueue[testTaskBatch](func(ctx context.Context, tasks []testTaskBatch) error {
+		errs := &BatchError{}
+		for i, tk := range tasks {
+			if tk.Val == "fail" {
+				errs.Fail(i, errFailed)
+			}
+		}
+		return errs.Err()
+	}))
+
+	op := d.client.Add(testTaskBatch{Val: "a"}, testTaskBatch{Val: "fail"}, testTaskBatch{Val: "b"})
+	if err := op.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := testutil.GetTasks(t, d.client.db)
+	for _, tk := range batch {
+		tk.Attempts++
+	}
+	d.processBatch(batch)
+
+	// Only the failed task is retried.
+	got := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "id", op.IDs()[1], got[0].ID)
+	testutil.Equal(t, "wait until", now().Add(time.Minute), *got[0].WaitUntil)
+
+	counts := make(map[EventType]int)
+	for _, e := range events {
+		counts[e.Type]++
+	}
+	testutil.Equal(t, "started", 3, counts[EventStarted])
+	testutil.Equal(t, "succeeded", 2, counts[EventSucceeded])
+	testutil.Equal(t, "retrying", 1, counts[EventRetrying])
+}
@@ -0,0 +1,100 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type (
+	// BlobStore stores task payloads externally from the database.
+	BlobStore interface {
+		// Put stores data with a given key.
+		Put(ctx context.Context, key string, data []byte) error
+
+		// Get loads the data stored with a given key.
+		Get(ctx context.Context, key string) ([]byte, error)
+
+		// Delete deletes the data stored with a given key. Deleting a key that does not exist must not fail.
+		Delete(ctx context.Context, key string) error
+	}
+
+	// Offload is the policy for storing large task payloads in a BlobStore rather than the database.
+	Offload struct {
+		// Store is the BlobStore payloads are written to.
+		Store BlobStore
+
+		// Threshold is the minimum size, in bytes, of a task payload, after any compression or encryption, before
+		// it will be offloaded.
+		Threshold int
+	}
+
+	// FileBlobStore is a BlobStore which stores each blob as a file within a local directory.
+	FileBlobStore struct {
+		// Dir is the directory to store the files in, which will be created if it does not exist.
+		Dir string
+	}
+)
+
+func (f FileBlobStore) Put(_ context.Context, key string, data []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(f.Dir, 0o700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o600)
+}
+
+func (f FileBlobStore) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+func (f FileBlobStore) Delete(_ context.Context, key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// path returns the path of the file for a given key.
+func (f FileBlobStore) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid blob key: %s", key)
+	}
+
+	return filepath.Join(f.Dir, key), nil
+}
+
+// deleteBlobs deletes blobs from the offload BlobStore, logging any failures since they only result in orphaned blobs.
+func (c *Client) deleteBlobs(ctx context.Context, keys ...string) {
+	if c.offload == nil {
+		return
+	}
+
+	for _, key := range keys {
+		if err := c.offload.Store.Delete(ctx, key); err != nil {
+			c.log.Error("failed to delete blob",
+				"key", key,
+				"error", err,
+			)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package backlite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	ctx := context.Background()
+	s := FileBlobStore{Dir: t.TempDir() + "/blobs"}
+	data := []byte("data")
+
+	if err := s.Put(ctx, "a", data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, got) {
+		t.Error("data does not match")
+	}
+
+	if err = s.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Get(ctx, "a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+
+	if err = s.Delete(ctx, "a"); err != nil {
+		t.Errorf("deleting a missing blob should not fail: %v", err)
+	}
+
+	for _, key := range []string{"", ".", "..", "../a", "a/b"} {
+		if err = s.Put(ctx, key, data); err == nil {
+			t.Errorf("expected error for key '%s'", key)
+		}
+	}
+}
+
+func TestOffload(t *testing.T) {
+	ctx := context.Background()
+	store := FileBlobStore{Dir: t.TempDir()}
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	c.offload = &Offload{Store: store, Threshold: 50}
+	defer c.db.Close()
+
+	large := testTask{Val: strings.Repeat("a", 100)}
+	if err := c.Add(testTask{Val: "a"}, large).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Add(testTaskNoRention{Val: large.Val}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 3)
+	testutil.Equal(t, "small", false, got[0].Offloaded)
+	testutil.Equal(t, "large", true, got[1].Offloaded)
+	testutil.Equal(t, "large no retention", true, got[2].Offloaded)
+
+	for _, tk := range got[1:] {
+		if _, err := store.Get(ctx, string(tk.Task)); err != nil {
+			t.Fatalf("blob not stored: %v", err)
+		}
+	}
+
+	var processed []string
+	c.Register(NewQueue[testTask](func(ctx context.Context, tk testTask) error {
+		processed = append(processed, tk.Val)
+		return nil
+	}))
+	c.Register(NewQueue[testTaskNoRention](func(ctx context.Context, tk testTaskNoRention) error {
+		processed = append(processed, tk.Val)
+		return nil
+	}))
+
+	d := newDispatcher(t)
+	d.client = c
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+
+	for _, tk := range got {
+		tk.Attempts++
+		d.processTask(tk)
+	}
+
+	testutil.Length(t, processed, 3)
+	testutil.Equal(t, "small", "a", processed[0])
+	testutil.Equal(t, "large", large.Val, processed[1])
+	testutil.Equal(t, "large no retention", large.Val, processed[2])
+
+	// The blob of the retained task data should remain.
+	ct := testutil.GetCompletedTasks(t, c.db)
+	testutil.Length(t, ct, 2)
+	testutil.Equal(t, "retained offloaded", true, ct[1].Offloaded)
+	testutil.Equal(t, "retained key", string(got[1].Task), string(ct[1].Task))
+
+	if _, err := store.Get(ctx, string(got[1].Task)); err != nil {
+		t.Errorf("retained blob deleted: %v", err)
+	}
+
+	// The blob of the task without retention should be deleted.
+	if _, err := store.Get(ctx, string(got[2].Task)); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("blob not deleted")
+	}
+
+	// Missing blob store.
+	c.offload = nil
+	got[1].Attempts++
+	if _, err := c.unpack(ctx, got[1]); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestOffload__Tx(t *testing.T) {
+	ctx := context.Background()
+	store := FileBlobStore{Dir: t.TempDir()}
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	c.offload = &Offload{Store: store, Threshold: 50}
+	defer c.db.Close()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := c.Add(testTask{Val: "a"}, testTask{Val: strings.Repeat("a", 100)}).Tx(tx)
+	if err = op.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blob cannot be deleted by the client, so its key must be returned.
+	testutil.Length(t, testutil.GetTasks(t, c.db), 0)
+	testutil.Length(t, op.Blobs(), 1)
+
+	if _, err = store.Get(ctx, op.Blobs()[0]); err != nil {
+		t.Fatalf("blob not stored: %v", err)
+	}
+}
+
+func TestDeleteExpiredCompleted__Blobs(t *testing.T) {
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	tc := task.Completed{
+		Queue:          "test",
+		Attempts:       1,
+		CreatedAt:      time.Now(),
+		LastExecutedAt: time.Now(),
+		ExpiresAt:      testutil.Pointer(time.Now()),
+	}
+
+	tc.ID, tc.Task, tc.Offloaded = "1", []byte("blob-1"), true
+	testutil.InsertCompleted(t, db, tc)
+	tc.ID, tc.Task, tc.Offloaded = "2", []byte("inline"), false
+	testutil.InsertCompleted(t, db, tc)
+	tc.ID, tc.Task, tc.Offloaded, tc.ExpiresAt = "3", []byte("blob-3"), true, nil
+	testutil.InsertCompleted(t, db, tc)
+
+	keys, err := task.DeleteExpiredCompleted(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Length(t, keys, 1)
+	testutil.Equal(t, "key", "blob-1", keys[0])
+	testutil.CompleteTaskIDsExist(t, db, []string{"3"})
+}
@@ -0,0 +1,164 @@
+package backlite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/drajk/backlite/internal/circuit"
+	"github.com/drajk/backlite/internal/task"
+)
+
+// CircuitBreaker is the policy for pausing a queue while its tasks are failing, such as when a downstream service is
+// unavailable, rather than having every task exhaust its attempts.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failed executions after which the circuit opens and tasks in the queue
+	// are no longer claimed.
+	Failures int
+
+	// Window is the duration within which the consecutive failures must occur. If omitted, the failures are counted
+	// regardless of the time between them.
+	Window time.Duration
+
+	// Cooldown is how long the circuit stays open before it half-opens and a single task is executed as a probe. If
+	// the probe succeeds, the circuit closes, otherwise it opens again.
+	Cooldown time.Duration
+}
+
+// processName names this process in the stored states of its circuits, since each process keeps its own breakers.
+var processName = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// validate returns an error if the circuit breaker cannot be enforced.
+func (c *CircuitBreaker) validate() error {
+	if c.Failures < 1 {
+		return errors.New("failures must be greater than zero")
+	}
+	return nil
+}
+
+// breaker returns the circuit breaker for a queue, or nil if the queue does not have one. The breakers lock must be
+// held.
+func (d *dispatcher) breaker(queue string) *circuit.Breaker {
+	if b, ok := d.breakers[queue]; ok {
+		return b
+	}
+
+	q := d.client.queues.get(queue)
+	if q == nil || q.Config().CircuitBreaker == nil {
+		return nil
+	}
+
+	if d.breakers == nil {
+		d.breakers = make(map[string]*circuit.Breaker)
+	}
+
+	cfg := q.Config().CircuitBreaker
+	b := circuit.New(cfg.Failures, cfg.Window, cfg.Cooldown)
+	d.breakers[queue] = b
+	return b
+}
+
+// tripped returns the queues whose circuit is open, or half-open with a probe executing, and the earliest time one of
+// the open circuits will half-open.
+func (d *dispatcher) tripped() ([]string, time.Time) {
+	d.breakersMu.Lock()
+	defer d.breakersMu.Unlock()
+
+	var queues []string
+	var until time.Time
+
+	for queue, b := range d.breakers {
+		if !b.Blocked(now()) {
+			continue
+		}
+
+		queues = append(queues, queue)
+		if b.State == circuit.Open {
+			until = earliest(until, b.Until())
+		}
+	}
+
+	return queues, until
+}
+
+// admit returns true if the circuit of the queue of a task allows it to be executed, which, if the circuit is
+// half-open, makes the task the probe.
+func (d *dispatcher) admit(t *task.Task) bool {
+	return d.circuit(t.Queue, func(b *circuit.Breaker) bool {
+		return b.Allow(t.ID, now())
+	})
+}
+
+// cancelProbe releases a task which did not execute from being the probe of the circuit of its queue.
+func (d *dispatcher) cancelProbe(t *task.Task) {
+	d.circuit(t.Queue, func(b *circuit.Breaker) bool {
+		b.Cancel(t.ID)
+		return true
+	})
+}
+
+// recordOutcome records the outcome of the execution of a task in the circuit of its queue.
+func (d *dispatcher) recordOutcome(t *task.Task, taskErr error) {
+	d.circuit(t.Queue, func(b *circuit.Breaker) bool {
+		if taskErr == nil {
+			b.Success(t.ID)
+		} else {
+			b.Failure(t.ID, now())
+		}
+		return true
+	})
+}
+
+// circuit applies a function to the circuit breaker of a queue, if it has one, and returns the result of the function,
+// or true if the queue does not have one. If the state of the circuit changes, the change is logged and stored in the
+// database, so it can be displayed, and the dispatcher fetches again so the queue is excluded or included accordingly.
+func (d *dispatcher) circuit(queue string, fn func(b *circuit.Breaker) bool) bool {
+	d.breakersMu.Lock()
+	b := d.breaker(queue)
+	if b == nil {
+		d.breakersMu.Unlock()
+		return true
+	}
+
+	from := b.State
+	ok := fn(b)
+	state := *b
+	d.breakersMu.Unlock()
+
+	if state.State == from {
+		return ok
+	}
+
+	log := d.log.Info
+	if state.State == circuit.Open {
+		log = d.log.Error
+	}
+
+	log("circuit state changed",
+		"queue", queue,
+		"from", from,
+		"to", state.State,
+		"failures", state.Failures,
+	)
+
+	if err := state.Save(d.ctx, d.client.db, queue, processName, now()); err != nil {
+		d.log.Error("failed to store circuit state",
+			"queue", queue,
+			"error", err,
+		)
+	}
+
+	// Transitions to half-open happen while fetching, which accounts for them.
+	if state.State != circuit.HalfOpen {
+		d.Notify()
+	}
+
+	return ok
+}
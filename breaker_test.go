@@ -0,0 +1,149 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/circuit"
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestDispatcher_CircuitBreaker(t *testing.T) {
+	log := &testLogger{}
+	d := newDispatcher(t)
+	d.numWorkers = 2
+	d.log = log
+	d.ctx = context.Background()
+	d.ticker = time.NewTicker(time.Hour)
+	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.ready = make(chan struct{}, 1)
+	d.availableWorkers = make(chan struct{}, d.numWorkers)
+	for range d.numWorkers {
+		d.availableWorkers <- struct{}{}
+	}
+
+	fail := true
+	d.client.dispatcher = &mockDispatcher{}
+	d.client.Register(NewQueue[testTaskBreaker](func(ctx context.Context, _ testTaskBreaker) error {
+		if fail {
+			return errors.New("unavailable")
+		}
+		return nil
+	}))
+
+	for _, val := range []string{"1", "2", "3", "4", "5"} {
+		if err := d.client.Add(testTaskBreaker{Val: val}).Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetched := func() task.Tasks {
+		var tasks task.Tasks
+		for len(d.tasks) > 0 {
+			tasks = append(tasks, <-d.tasks)
+			d.availableWorkers <- struct{}{}
+		}
+		for len(d.ready) > 0 {
+			<-d.ready
+		}
+		return tasks
+	}
+
+	state := func() circuit.State {
+		states, err := circuit.GetStates(context.Background(), d.client.db, `
+			SELECT queue, state, failures, opened_at, updated_at, process FROM backlite_circuits
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.Length(t, states, 1)
+		return states[0]
+	}
+
+	// The circuit opens after consecutive failures.
+	d.fetch()
+	tasks := fetched()
+	testutil.Length(t, tasks, 2)
+	for _, tk := range tasks {
+		d.processTask(tk)
+	}
+
+	testutil.Equal(t, "state", circuit.Open, d.breakers["test-breaker"].State)
+	testutil.Equal(t, "stored state", circuit.Open, state().State)
+	testutil.Equal(t, "stored failures", 2, state().Failures)
+	testutil.Equal(t, "stored process", processName, state().Process)
+	testutil.Equal(t, "logged", true, slices.Contains(log.errors, "circuit state changed"))
+
+	// The queue is not claimed while the circuit is open.
+	d.fetch()
+	testutil.Length(t, fetched(), 0)
+
+	queues, until := d.tripped()
+	testutil.Length(t, queues, 1)
+	testutil.Equal(t, "until", now().Add(5*time.Minute), until)
+
+	// Once the cooldown passes, a single probe task is claimed.
+	d.breakers["test-breaker"].OpenedAt = now().Add(-time.Hour)
+	d.fetch()
+	tasks = fetched()
+	testutil.Length(t, tasks, 1)
+	testutil.Equal(t, "half-open", circuit.HalfOpen, state().State)
+
+	d.fetch()
+	testutil.Length(t, fetched(), 0)
+
+	// The circuit closes once the probe succeeds.
+	fail = false
+	d.processTask(tasks[0])
+	testutil.Equal(t, "closed", circuit.Closed, state().State)
+	testutil.Equal(t, "logged", true, slices.Contains(log.infos, "circuit state changed"))
+
+	d.fetch()
+	testutil.Length(t, fetched(), 2)
+}
+
+func TestDispatcher_CircuitBreaker__Unprocessed(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+
+	d.client.Register(NewQueue[testTaskBreaker](func(ctx context.Context, _ testTaskBreaker) error {
+		return nil
+	}))
+
+	// Tasks whose payload cannot be loaded fail without being processed, so the circuit should remain closed.
+	for _, id := range []string{"1", "2", "3"} {
+		tk := &task.Task{
+			ID:        id,
+			Queue:     "test-breaker",
+			Task:      testutil.Encode(t, testTaskBreaker{Val: id}),
+			Codec:     "missing",
+			Attempts:  1,
+			CreatedAt: now(),
+		}
+		testutil.InsertTask(t, d.client.db, tk)
+		d.processTask(tk)
+	}
+
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+	testutil.Equal(t, "state", circuit.Closed, d.breakers["test-breaker"].State)
+	testutil.Equal(t, "failures", 0, d.breakers["test-breaker"].Failures)
+}
+
+func TestClient_Register__CircuitBreaker(t *testing.T) {
+	c := mustNewClient(t)
+	q := NewQueue[testTaskBreaker](func(ctx context.Context, _ testTaskBreaker) error {
+		return nil
+	})
+	q.Config().CircuitBreaker = &CircuitBreaker{Cooldown: time.Minute}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	c.Register(q)
+}
@@ -5,13 +5,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strings"
 
-	"encoding/json"
 	"errors"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/drajk/backlite/internal/query"
 	"github.com/drajk/backlite/internal/task"
 )
@@ -31,11 +31,36 @@ type (
 		// queues stores the registered queues which tasks can be added to.
 		queues queues
 
+		// hooks stores the registered hooks which receive task lifecycle events.
+		hooks hooks
+
+		// waiters stores the channels waiting for tasks to complete.
+		waiters waiters
+
 		// buffers is a pool of byte buffers for more efficient encoding.
 		buffers sync.Pool
 
 		// dispatcher is used to fetch and dispatch queued tasks to the workers for execution.
 		dispatcher Dispatcher
+
+		// propagator is used to propagate metadata from the context used to add tasks to the context used to
+		// execute them.
+		propagator Propagator
+
+		// codec is the default codec used to encode tasks.
+		codec Codec
+
+		// codecs stores the codecs which tasks can be decoded with.
+		codecs codecs
+
+		// compression is the policy for compressing task payloads.
+		compression *Compression
+
+		// keys provides the keys used to encrypt task payloads.
+		keys KeyProvider
+
+		// offload is the policy for storing large task payloads in a BlobStore.
+		offload *Offload
 	}
 
 	// ClientConfig contains configuration for the Client.
@@ -55,8 +80,33 @@ type (
 		ReleaseAfter time.Duration
 
 		// CleanupInterval is how often to run cleanup operations on the database in order to remove expired completed
-		// tasks. If omitted, no cleanup operations will be performed and the task retention duration will be ignored.
+		// tasks, and the shared rate limits of throttle keys which are full. If omitted, no cleanup operations will be
+		// performed and the task retention duration will be ignored.
 		CleanupInterval time.Duration
+
+		// Middleware is applied around the processing of tasks in every queue. The first middleware is the outermost,
+		// and all of these wrap any middleware provided in the configuration of the queue.
+		Middleware []Middleware
+
+		// Propagator is used to capture metadata, such as trace context, from the context provided when adding tasks
+		// and restore it in to the context provided to the queue processor. If omitted, nothing is propagated.
+		Propagator Propagator
+
+		// Codec is the default codec used to encode tasks, which can be overridden per queue.
+		// If omitted, JSONCodec will be used.
+		Codec Codec
+
+		// Compression provides options for compressing large task payloads.
+		// If nil, task payloads will not be compressed.
+		Compression *Compression
+
+		// Encryption provides the keys used to encrypt task payloads, including those retained in completed tasks.
+		// If nil, task payloads will not be encrypted.
+		Encryption KeyProvider
+
+		// Offload provides options for storing large task payloads in a BlobStore rather than the database.
+		// If nil, all task payloads will be stored in the database.
+		Offload *Offload
 	}
 
 	// ctxKeyClient is used to store a Client in a context.
@@ -83,16 +133,30 @@ func NewClient(cfg ClientConfig) (*Client, error) {
 
 	case cfg.ReleaseAfter <= 0:
 		return nil, errors.New("release duration must be greater than zero")
+
+	case cfg.Offload != nil && cfg.Offload.Store == nil:
+		return nil, errors.New("missing offload blob store")
 	}
 
 	if cfg.Logger == nil {
 		cfg.Logger = &noLogger{}
 	}
 
+	if cfg.Codec == nil {
+		cfg.Codec = JSONCodec{}
+	}
+
 	c := &Client{
-		db:     cfg.DB,
-		log:    cfg.Logger,
-		queues: queues{registry: make(map[string]Queue)},
+		db:          cfg.DB,
+		log:         cfg.Logger,
+		queues:      queues{registry: make(map[string]Queue)},
+		propagator:  cfg.Propagator,
+		codec:       cfg.Codec,
+		codecs:      codecs{registry: make(map[string]Codec)},
+		waiters:     waiters{registry: make(map[string][]chan Event)},
+		compression: cfg.Compression,
+		keys:        cfg.Encryption,
+		offload:     cfg.Offload,
 		buffers: sync.Pool{
 			New: func() any {
 				return bytes.NewBuffer(nil)
@@ -106,8 +170,17 @@ func NewClient(cfg ClientConfig) (*Client, error) {
 		numWorkers:      cfg.NumWorkers,
 		releaseAfter:    cfg.ReleaseAfter,
 		cleanupInterval: cfg.CleanupInterval,
+		middleware:      cfg.Middleware,
 	}
 
+	c.codecs.add(JSONCodec{})
+	c.codecs.add(GobCodec{})
+	c.codecs.add(cfg.Codec)
+
+	// Notify Await() when tasks executed by this client complete.
+	c.hooks.log = cfg.Logger
+	c.hooks.add(c.waiters.notify)
+
 	return c, nil
 }
 
@@ -115,6 +188,15 @@ func NewClient(cfg ClientConfig) (*Client, error) {
 // This will panic if the name of the queue provided has already been registered.
 func (c *Client) Register(queue Queue) {
 	c.queues.add(queue)
+
+	if codec := queue.Config().Codec; codec != nil {
+		c.codecs.add(codec)
+	}
+}
+
+// Subscribe registers a Hook which will be called for every task lifecycle event.
+func (c *Client) Subscribe(hook Hook) {
+	c.hooks.add(hook)
 }
 
 // Add starts an operation to add one or many tasks.
@@ -137,17 +219,10 @@ func (c *Client) Stop(ctx context.Context) bool {
 	return c.dispatcher.Stop(ctx)
 }
 
-// Install installs the provided schema in the database.
-// TODO provide migrations
+// Install installs the provided schema in the database and applies any migrations which have not yet been applied,
+// so it must also be called after upgrading in order to update the schema of an existing database.
 func (c *Client) Install() error {
-	statements := strings.Split(query.Schema, ";")
-
-	for _, stmt := range statements {
-		stmt = strings.TrimSpace(stmt)
-		if stmt == "" {
-			continue // Skip empty statements
-		}
-
+	for _, stmt := range query.Statements(query.Schema) {
 		// Execute the statement
 		_, err := c.db.Exec(stmt)
 		if err != nil {
@@ -155,7 +230,7 @@ func (c *Client) Install() error {
 		}
 	}
 
-	return nil
+	return query.Migrate(c.db)
 }
 
 // Notify notifies the dispatcher that a new task has been added.
@@ -165,24 +240,130 @@ func (c *Client) Notify() {
 	c.dispatcher.Notify()
 }
 
-// save saves a task add operation.
-func (c *Client) save(op *TaskAddOp) error {
-	var commit bool
-	var err error
+// Reschedule changes the time a queued task should not be executed until. ErrTaskNotPending is returned if the task
+// does not exist or has been claimed for execution.
+func (c *Client) Reschedule(ctx context.Context, id string, at time.Time) error {
+	ok, err := task.Reschedule(ctx, c.db, id, at)
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return ErrTaskNotPending
+	}
 
-	// Get a buffer for the encoding.
-	buf := c.buffers.Get().(*bytes.Buffer)
+	// Tell the dispatcher so it can reschedule if this task is now the next up.
+	c.Notify()
+	return nil
+}
+
+// UpdatePayload replaces the payload of a queued task with a given task, which must belong to the same queue.
+// ErrTaskNotPending is returned if the task does not exist in that queue or has been claimed for execution.
+func (c *Client) UpdatePayload(ctx context.Context, id string, t Task) error {
+	if v, ok := t.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return &ValidationError{Index: 0, Err: err}
+		}
+	}
+
+	m := task.Task{ID: id}
+	if err := c.encode(ctx, t, &m); err != nil {
+		return err
+	}
+
+	prev, err := c.updatePayload(ctx, &m)
+	if err != nil {
+		if m.Offloaded {
+			c.deleteBlobs(ctx, string(m.Task))
+		}
+		return err
+	}
+
+	if prev.Offloaded {
+		c.deleteBlobs(ctx, string(prev.Task))
+	}
+
+	// Tell the dispatcher in case the task was waiting to be fetched.
+	c.Notify()
+	return nil
+}
+
+// updatePayload replaces the payload of a task that has not been claimed and returns the previous payload.
+func (c *Client) updatePayload(ctx context.Context, m *task.Task) (*task.Task, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	// Put the buffer back in the pool for re-use.
 	defer func() {
-		buf.Reset()
-		c.buffers.Put(buf)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				c.log.Error("failed to rollback task update transaction",
+					"error", err,
+				)
+			}
+		}
 	}()
 
+	prev, err := task.GetPendingPayloadTx(ctx, tx, m.ID, m.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev == nil {
+		err = ErrTaskNotPending
+		return nil, err
+	}
+
+	ok, err := m.UpdatePayloadTx(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		err = ErrTaskNotPending
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return prev, nil
+}
+
+// save saves a task add operation.
+func (c *Client) save(op *TaskAddOp) error {
+	var commit bool
+	var err error
+
 	if op.ctx == nil {
 		op.ctx = context.Background()
 	}
 
+	// Validate all of the tasks before anything is saved.
+	for i, t := range op.tasks {
+		if v, ok := t.(Validator); ok {
+			if err = v.Validate(); err != nil {
+				return &ValidationError{Index: i, Err: err}
+			}
+		}
+	}
+
+	// The timeout of a batch queue applies to the entire batch, so the tasks cannot override it.
+	if op.timeout != nil {
+		for _, t := range op.tasks {
+			if _, ok := c.queues.get(t.Config().Name).(batcher); ok {
+				return fmt.Errorf("%w: %s", ErrBatchTimeout, t.Config().Name)
+			}
+		}
+	}
+
+	if v, ok := op.callback.(Validator); ok {
+		if err = v.Validate(); err != nil {
+			return fmt.Errorf("invalid group callback: %w", err)
+		}
+	}
+
 	// Start a transaction if one isn't provided.
 	if op.tx == nil {
 		op.tx, err = c.db.BeginTx(op.ctx, nil)
@@ -201,27 +382,161 @@ func (c *Client) save(op *TaskAddOp) error {
 					"error", err,
 				)
 			}
+
+			// Remove any blobs that were stored for the tasks which will not exist.
+			c.deleteBlobs(op.ctx, op.blobs...)
 		}()
 	}
 
-	// Insert the tasks.
-	for _, t := range op.tasks {
-		buf.Reset()
+	// Tasks cannot be held for parents which have already failed unless they run regardless.
+	if len(op.after) > 0 && op.onFailure == CancelOnParentFailure {
+		var failed string
+		if failed, err = task.GetFailedParentTx(op.ctx, op.tx, op.after); err != nil {
+			return err
+		}
+
+		if failed != "" {
+			err = fmt.Errorf("%w: %s", ErrParentFailed, failed)
+			return err
+		}
+	}
 
-		if err = json.NewEncoder(buf).Encode(t); err != nil {
+	// Only the last task in each queue is added when debouncing, since it would replace the others.
+	tasks := op.tasks
+	if op.debounce != "" {
+		tasks = lastPerQueue(op.tasks)
+	}
+
+	// Create the group, or add to it, so it cannot complete before the tasks are added.
+	if op.grouped {
+		if op.group == "" {
+			var id uuid.UUID
+			if id, err = uuid.NewV7(); err != nil {
+				err = fmt.Errorf("unable to generate group ID: %w", err)
+				return err
+			}
+			op.group = id.String()
+		}
+
+		var ok bool
+		if ok, err = task.AddToGroupTx(op.ctx, op.tx, op.group, len(tasks), now()); err != nil {
 			return err
 		}
 
+		if !ok {
+			err = ErrGroupCompleted
+			return err
+		}
+	}
+
+	// Capture the propagation metadata from the context.
+	var metadata map[string]string
+	if c.propagator != nil {
+		metadata = make(map[string]string)
+		c.propagator.Inject(op.ctx, metadata)
+	}
+
+	// Insert the tasks.
+	added := make([]task.Task, 0, len(tasks))
+	for _, t := range tasks {
+		cfg := t.Config()
+
 		m := task.Task{
-			Queue:     t.Config().Name,
-			Task:      buf.Bytes(),
 			WaitUntil: op.wait,
 			CreatedAt: now(),
+			Metadata:  metadata,
+			Tags:      op.tags,
+
+			MaxAttempts:  op.maxAttempts,
+			Timeout:      op.timeout,
+			Backoff:      op.backoff,
+			Deadline:     op.deadline,
+			DebounceKey:  op.debounce,
+			PartitionKey: op.partition,
+			ThrottleKey:  op.throttle,
+			GroupID:      op.group,
+
+			Parents:            op.after,
+			RunOnParentFailure: op.onFailure == RunOnParentFailure,
+		}
+
+		// Fall back to the TTL of the queue for the deadline, unless the tasks are held until they are needed, which
+		// may be later than that.
+		if m.Deadline == nil && cfg.TTL > 0 && !op.held {
+			deadline := m.CreatedAt.Add(cfg.TTL)
+			m.Deadline = &deadline
+		}
+
+		if err = c.encode(op.ctx, t, &m); err != nil {
+			return err
+		}
+
+		if m.Offloaded {
+			op.blobs = append(op.blobs, string(m.Task))
+		}
+
+		if err = m.InsertTx(op.ctx, op.tx); err != nil {
+			return err
+		}
+
+		// Replace the pending tasks with the same debounce key.
+		if m.DebounceKey != "" {
+			var tasks task.Tasks
+			if tasks, err = m.ReplaceDebouncedTx(op.ctx, op.tx); err != nil {
+				return err
+			}
+
+			for _, r := range tasks {
+				if r.Offloaded {
+					op.replaced = append(op.replaced, string(r.Task))
+				}
+
+				// The replaced task will never complete, so its group must no longer wait for it.
+				if r.GroupID != "" {
+					if _, err = task.RemoveFromGroupTx(op.ctx, op.tx, r.GroupID, now()); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		added = append(added, m)
+		op.ids = append(op.ids, m.ID)
+	}
+
+	// Hold the callback until every task in the group has completed. The TTL of its queue is not applied, since the
+	// group may take longer than that to complete.
+	if op.callback != nil {
+		m := task.Task{
+			CreatedAt: now(),
+			Metadata:  metadata,
+		}
+
+		if err = c.encode(op.ctx, op.callback, &m); err != nil {
+			return err
+		}
+
+		if m.Offloaded {
+			op.blobs = append(op.blobs, string(m.Task))
 		}
 
 		if err = m.InsertTx(op.ctx, op.tx); err != nil {
 			return err
 		}
+
+		if err = task.HoldTx(op.ctx, op.tx, m.ID, op.group, true); err != nil {
+			return err
+		}
+
+		added = append(added, m)
+	}
+
+	// A group without any tasks would never complete, since that happens when its last task completes, so it completes
+	// now, releasing the callback.
+	if op.grouped && len(tasks) == 0 {
+		if _, err = task.CompleteGroupTx(op.ctx, op.tx, op.group, now()); err != nil {
+			return err
+		}
 	}
 
 	// If we created the transaction we'll commit it now.
@@ -230,9 +545,69 @@ func (c *Client) save(op *TaskAddOp) error {
 			return err
 		}
 
+		// The blobs of replaced tasks can only be deleted once it's known that the tasks no longer exist.
+		c.deleteBlobs(op.ctx, op.replaced...)
+
 		// Tell the dispatcher that a new task has been added.
 		c.Notify()
 	}
 
+	// When a transaction was provided, there is no way to know if it will be committed, so the events are emitted
+	// once the tasks have been inserted.
+	for _, m := range added {
+		c.hooks.emit(op.ctx, Event{
+			Type:   EventAdded,
+			TaskID: m.ID,
+			Queue:  m.Queue,
+		})
+	}
+
 	return nil
 }
+
+// lastPerQueue returns the last of the given tasks in each queue, in the order they were provided.
+func lastPerQueue(tasks []Task) []Task {
+	last := make(map[string]int, len(tasks))
+	for i, t := range tasks {
+		last[t.Config().Name] = i
+	}
+
+	kept := make([]Task, 0, len(last))
+	for i, t := range tasks {
+		if last[t.Config().Name] == i {
+			kept = append(kept, t)
+		}
+	}
+
+	return kept
+}
+
+// encode encodes a task with the codec of its queue and sets the payload on the given task, along with the name of the
+// queue and the codec, and the version of the payload.
+func (c *Client) encode(ctx context.Context, t Task, m *task.Task) error {
+	// Get a buffer for the encoding.
+	buf := c.buffers.Get().(*bytes.Buffer)
+
+	// Put the buffer back in the pool for re-use.
+	defer func() {
+		buf.Reset()
+		c.buffers.Put(buf)
+	}()
+
+	cfg := t.Config()
+
+	codec := c.codec
+	if cfg.Codec != nil {
+		codec = cfg.Codec
+	}
+
+	if err := codec.Encode(buf, t); err != nil {
+		return err
+	}
+
+	m.Queue = cfg.Name
+	m.Codec = codec.Name()
+	m.Version = cfg.version()
+
+	return c.pack(ctx, m, buf.Bytes())
+}
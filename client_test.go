@@ -2,11 +2,20 @@ package backlite
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/drajk/backlite/internal/query"
+	"github.com/drajk/backlite/internal/task"
 	"github.com/drajk/backlite/internal/testutil"
 )
 
@@ -49,6 +58,7 @@ func TestNewClient(t *testing.T) {
 		NumWorkers:      2,
 		ReleaseAfter:    time.Second,
 		CleanupInterval: time.Hour,
+		Middleware:      []Middleware{CapturePanics()},
 	})
 
 	if err != nil {
@@ -74,6 +84,7 @@ func TestNewClient(t *testing.T) {
 	testutil.Equal(t, "workers", 2, d.numWorkers)
 	testutil.Equal(t, "release after", time.Second, d.releaseAfter)
 	testutil.Equal(t, "cleanup interval", time.Hour, d.cleanupInterval)
+	testutil.Length(t, d.middleware, 1)
 }
 
 func TestNewClient__DefaultLogger(t *testing.T) {
@@ -180,6 +191,50 @@ func TestClient_Install(t *testing.T) {
 	}
 }
 
+func TestClient_Install__Migrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:/%s?vfs=memdb&_timeout=1000", uuid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Create a database using the schema before any migrations, containing a task.
+	if _, err = db.Exec(query.Schema); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO backlite_tasks (id, created_at, queue, task) VALUES (?, ?, ?, ?)",
+		"1", time.Now().UnixMilli(), "test", []byte("a"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(ClientConfig{DB: db, NumWorkers: 1, ReleaseAfter: time.Hour, CleanupInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Installing again must not apply the migrations twice.
+	for range 2 {
+		if err = c.Install(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var version int
+	if err = db.QueryRow("SELECT MAX(version) FROM backlite_migrations").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "version", len(query.Migrations()), version)
+
+	got := testutil.GetTasks(t, db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "version", 1, got[0].Version)
+	testutil.Equal(t, "offloaded", false, got[0].Offloaded)
+}
+
 func TestClient_Add(t *testing.T) {
 	c := mustNewClient(t)
 
@@ -233,6 +288,107 @@ func TestClient_Notify(t *testing.T) {
 	testutil.Equal(t, "notified", true, m.notified)
 }
 
+func TestClient_Reschedule(t *testing.T) {
+	ctx := context.Background()
+	c := mustNewClient(t)
+	m := &mockDispatcher{}
+	c.dispatcher = m
+
+	op := c.Add(testTask{Val: "a"}, testTask{Val: "b"}).Wait(time.Hour)
+	if err := op.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ids := op.IDs()
+	testutil.Length(t, ids, 2)
+
+	m.notified = false
+	if err := c.Reschedule(ctx, ids[0], now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "notified", true, m.notified)
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Equal(t, "wait until", now().Add(time.Minute), *got[0].WaitUntil)
+	testutil.Equal(t, "other wait until", now().Add(time.Hour), *got[1].WaitUntil)
+
+	// Claimed.
+	if _, err := got[1:].Claim(ctx, c.db, now(), task.Caps{}); err != nil {
+		t.Fatal(err)
+	}
+
+	m.notified = false
+	if err := c.Reschedule(ctx, ids[1], now()); !errors.Is(err, ErrTaskNotPending) {
+		t.Errorf("expected not pending error, got %v", err)
+	}
+	testutil.Equal(t, "notified", false, m.notified)
+
+	// Missing.
+	if err := c.Reschedule(ctx, "missing", now()); !errors.Is(err, ErrTaskNotPending) {
+		t.Errorf("expected not pending error, got %v", err)
+	}
+}
+
+func TestClient_UpdatePayload(t *testing.T) {
+	ctx := context.Background()
+	store := FileBlobStore{Dir: t.TempDir()}
+	c := mustNewClient(t)
+	c.offload = &Offload{Store: store, Threshold: 50}
+	m := &mockDispatcher{}
+	c.dispatcher = m
+
+	large := strings.Repeat("a", 100)
+	op := c.Add(testTask{Val: large}, testTask{Val: "b"})
+	if err := op.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ids := op.IDs()
+	prev := testutil.GetTasks(t, c.db)[0]
+
+	m.notified = false
+	if err := c.UpdatePayload(ctx, ids[0], testTask{Val: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "notified", true, m.notified)
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Equal(t, "offloaded", false, got[0].Offloaded)
+	testutil.Equal(t, "task", string(testutil.Encode(t, testTask{Val: "c"})), string(got[0].Task))
+
+	// The blob of the previous payload should be deleted.
+	if _, err := store.Get(ctx, string(prev.Task)); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("previous blob not deleted")
+	}
+
+	// Different queue.
+	if err := c.UpdatePayload(ctx, ids[0], testTaskNoRention{Val: "d"}); !errors.Is(err, ErrTaskNotPending) {
+		t.Errorf("expected not pending error, got %v", err)
+	}
+
+	// Invalid.
+	var verr *ValidationError
+	if err := c.UpdatePayload(ctx, ids[0], testTaskValidated{}); !errors.As(err, &verr) {
+		t.Errorf("expected validation error, got %v", err)
+	}
+
+	// Claimed, which should not leave an orphaned blob behind.
+	if _, err := got[1:].Claim(ctx, c.db, now(), task.Caps{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.UpdatePayload(ctx, ids[1], testTask{Val: large}); !errors.Is(err, ErrTaskNotPending) {
+		t.Errorf("expected not pending error, got %v", err)
+	}
+
+	entries, err := os.ReadDir(store.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, entries, 0)
+
+	got = testutil.GetTasks(t, c.db)
+	testutil.Equal(t, "task", string(testutil.Encode(t, testTask{Val: "b"})), string(got[1].Task))
+}
+
 func TestClient_FromContext(t *testing.T) {
 	got := FromContext(context.Background())
 	testutil.Equal(t, "client", got, nil)
@@ -0,0 +1,90 @@
+package backlite
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+type (
+	// Codec encodes tasks in to payloads which are stored in the database and decodes them when they are processed.
+	Codec interface {
+		// Name returns the unique name of the codec, which is stored with each task so the task can be decoded
+		// with the same codec, even if the codec used by the queue changes.
+		Name() string
+
+		// Encode writes the encoding of v to w.
+		Encode(w io.Writer, v any) error
+
+		// Decode reads the encoded value from r and stores it in the value pointed to by v.
+		Decode(r io.Reader, v any) error
+	}
+
+	// JSONCodec is a Codec which uses encoding/json and is the default codec.
+	JSONCodec struct{}
+
+	// GobCodec is a Codec which uses encoding/gob.
+	GobCodec struct{}
+
+	// codecs stores a registry of codecs.
+	codecs struct {
+		registry map[string]Codec
+		sync.RWMutex
+	}
+
+	// ctxKeyCodec is used to store the Codec a task was encoded with in a context.
+	ctxKeyCodec struct{}
+)
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (JSONCodec) Decode(r io.Reader, v any) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Encode(w io.Writer, v any) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (GobCodec) Decode(r io.Reader, v any) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// add adds a codec to the registry, replacing any codec with the same name.
+func (c *codecs) add(codec Codec) {
+	c.Lock()
+	defer c.Unlock()
+	c.registry[codec.Name()] = codec
+}
+
+// get loads a codec from the registry by name. If the name is empty, the JSONCodec is returned since tasks created
+// before codecs were introduced were encoded with JSON.
+func (c *codecs) get(name string) Codec {
+	if name == "" {
+		return JSONCodec{}
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	return c.registry[name]
+}
+
+// codecFromContext returns the Codec stored in the context, or the JSONCodec if one is not set.
+func codecFromContext(ctx context.Context) Codec {
+	if c, ok := ctx.Value(ctxKeyCodec{}).(Codec); ok {
+		return c
+	}
+	return JSONCodec{}
+}
@@ -0,0 +1,137 @@
+package backlite
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+type testTaskGob struct {
+	Val      string
+	Duration time.Duration
+}
+
+func (t testTaskGob) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-gob",
+		MaxAttempts: 1,
+		Codec:       GobCodec{},
+		Retention: &Retention{
+			Data: &RetainData{},
+		},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}} {
+		buf := bytes.NewBuffer(nil)
+		if err := codec.Encode(buf, testTaskGob{Val: "a", Duration: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+
+		var got testTaskGob
+		if err := codec.Decode(buf, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		testutil.Equal(t, codec.Name(), testTaskGob{Val: "a", Duration: time.Hour}, got)
+	}
+
+	var c codecs
+	c.registry = make(map[string]Codec)
+	c.add(GobCodec{})
+	testutil.Equal(t, "gob", Codec(GobCodec{}), c.get("gob"))
+	testutil.Equal(t, "empty", Codec(JSONCodec{}), c.get(""))
+	testutil.Equal(t, "missing", nil, c.get("missing"))
+}
+
+func TestCodecFromContext(t *testing.T) {
+	testutil.Equal(t, "default", Codec(JSONCodec{}), codecFromContext(context.Background()))
+
+	ctx := context.WithValue(context.Background(), ctxKeyCodec{}, GobCodec{})
+	testutil.Equal(t, "gob", Codec(GobCodec{}), codecFromContext(ctx))
+}
+
+func TestTaskAddOp_Save__Codec(t *testing.T) {
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	if err := c.Add(testTask{Val: "a"}, testTaskGob{Val: "b"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 2)
+	testutil.Equal(t, "json codec", "json", got[0].Codec)
+	testutil.Equal(t, "gob codec", "gob", got[1].Codec)
+
+	var decoded testTaskGob
+	if err := (GobCodec{}).Decode(bytes.NewReader(got[1].Task), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "val", "b", decoded.Val)
+
+	// Change the default codec of the client.
+	testutil.DeleteTasks(t, c.db)
+	c.codec = GobCodec{}
+	if err := c.Add(testTask{Val: "a"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got = testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "gob codec", "gob", got[0].Codec)
+}
+
+func TestDispatcher_ProcessTask__Codec(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	var called int
+
+	d.client.Register(NewQueue[testTaskGob](func(ctx context.Context, tk testTaskGob) error {
+		called++
+		testutil.Equal(t, "val", "1", tk.Val)
+		testutil.Equal(t, "duration", time.Minute, tk.Duration)
+		return nil
+	}))
+
+	buf := bytes.NewBuffer(nil)
+	if err := (GobCodec{}).Encode(buf, testTaskGob{Val: "1", Duration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := &task.Task{
+		ID:        "1",
+		Queue:     "test-gob",
+		Task:      buf.Bytes(),
+		Codec:     "gob",
+		Attempts:  1,
+		CreatedAt: now(),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+	d.processTask(tk)
+	testutil.Equal(t, "called", 1, called)
+
+	ct := testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 1)
+	testutil.Equal(t, "succeeded", true, ct[0].Succeeded)
+	testutil.Equal(t, "codec", "gob", ct[0].Codec)
+
+	// Unknown codecs should fail.
+	tk.ID = "2"
+	tk.Codec = "missing"
+	testutil.InsertTask(t, d.client.db, tk)
+	d.processTask(tk)
+	testutil.Equal(t, "called", 1, called)
+
+	ct = testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 2)
+	testutil.Equal(t, "succeeded", false, ct[1].Succeeded)
+	testutil.Equal(t, "error", "codec 'missing' not registered", *ct[1].Error)
+}
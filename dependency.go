@@ -0,0 +1,90 @@
+package backlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/drajk/backlite/internal/task"
+)
+
+// abandonedTask is a task which was discarded rather than executed because a task it depends on failed.
+type abandonedTask struct {
+	task *task.Task
+	err  error
+}
+
+// abandonDependents resolves the dependencies on a task which failed, as part of the transaction which completes it.
+// The tasks which do not run when a parent fails are abandoned, along with the tasks which depend on them in turn,
+// and are returned. The number of tasks released to run despite the failure is also returned.
+func (d *dispatcher) abandonDependents(tx *sql.Tx, id string) ([]abandonedTask, int64, error) {
+	var abandoned []abandonedTask
+	var released int64
+
+	failed := []string{id}
+	for len(failed) > 0 {
+		parent := failed[0]
+		failed = failed[1:]
+
+		tasks, n, err := task.AbandonDependentsTx(d.ctx, tx, parent)
+		if err != nil {
+			return nil, 0, err
+		}
+		released += n
+
+		for _, t := range tasks {
+			taskErr := fmt.Errorf("%w: %s", ErrParentFailed, parent)
+
+			// The run has already failed, and the compensations of the steps which are abandoned were skipped when it did.
+			if _, _, err = d.stepCompleted(tx, t, taskErr); err != nil {
+				return nil, 0, err
+			}
+
+			if n, err = d.groupProgress(tx, t, taskErr); err != nil {
+				return nil, 0, err
+			}
+			released += n
+
+			// Tasks can only be retained if their queue is registered with this client.
+			if q := d.client.queues.get(t.Queue); q != nil {
+				if err = d.taskComplete(tx, q, t, now(), 0, nil, taskErr); err != nil {
+					return nil, 0, err
+				}
+			}
+
+			abandoned = append(abandoned, abandonedTask{task: t, err: taskErr})
+			failed = append(failed, t.ID)
+		}
+	}
+
+	return abandoned, released, nil
+}
+
+// tasksAbandoned handles the tasks which were abandoned once the transaction which removed them has been committed, and
+// notifies the dispatcher if any tasks were released to run despite the failure of their parent.
+func (d *dispatcher) tasksAbandoned(abandoned []abandonedTask, released int64) {
+	for _, a := range abandoned {
+		d.log.Info("task abandoned",
+			"id", a.task.ID,
+			"queue", a.task.Queue,
+			"error", a.err,
+		)
+
+		if q := d.client.queues.get(a.task.Queue); q != nil {
+			d.taskReleaseBlob(q, a.task, a.err)
+		} else if a.task.Offloaded {
+			d.client.deleteBlobs(d.ctx, string(a.task.Task))
+		}
+
+		d.client.hooks.emit(d.ctx, Event{
+			Type:    EventAbandoned,
+			TaskID:  a.task.ID,
+			Queue:   a.task.Queue,
+			Attempt: a.task.Attempts,
+			Error:   a.err,
+		})
+	}
+
+	if released > 0 {
+		d.Notify()
+	}
+}
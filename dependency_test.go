@@ -0,0 +1,211 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+// getDependencies returns the parents of each task with unresolved dependencies.
+func getDependencies(t *testing.T, c *Client) map[string][]string {
+	rows, err := c.db.Query("SELECT task_id, parent_id FROM backlite_task_dependencies ORDER BY task_id, parent_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	deps := make(map[string][]string)
+	for rows.Next() {
+		var id, parent string
+		if err = rows.Scan(&id, &parent); err != nil {
+			t.Fatal(err)
+		}
+		deps[id] = append(deps[id], parent)
+	}
+
+	return deps
+}
+
+func TestTaskAddOp_After(t *testing.T) {
+	c := mustNewClient(t)
+	c.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return nil
+	}))
+
+	parent := c.Add(testTask{Val: "parent"})
+	if err := parent.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Parents which no longer exist are not waited for.
+	child := c.Add(testTask{Val: "child"}).After(parent.IDs()[0], "missing")
+	if err := child.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	deps := getDependencies(t, c)
+	testutil.Length(t, deps[child.IDs()[0]], 1)
+	testutil.Equal(t, "parent", parent.IDs()[0], deps[child.IDs()[0]][0])
+
+	// Only the parent can be executed.
+	got, err := task.GetScheduledTasks(context.Background(), c.db, now().Add(-time.Hour), 10, task.Exclusions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "scheduled", parent.IDs()[0], got[0].ID)
+
+	// Tasks cannot depend on a parent which already failed, unless they run regardless.
+	errStr := "failure error"
+	testutil.InsertCompleted(t, c.db, task.Completed{
+		ID:    "failed",
+		Queue: "test",
+		Error: &errStr,
+	})
+
+	err = c.Add(testTask{Val: "child"}).After("failed").Save()
+	if !errors.Is(err, ErrParentFailed) {
+		t.Errorf("expected parent failed error, got %v", err)
+	}
+
+	err = c.Add(testTask{Val: "child"}).After("failed").OnParentFailure(RunOnParentFailure).Save()
+	testutil.Equal(t, "run on parent failure", nil, err)
+	testutil.Length(t, testutil.GetTasks(t, c.db), 3)
+}
+
+func TestDispatcher_ProcessTask__DependencySuccess(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ready = make(chan struct{}, 1)
+	d.running.Store(true)
+
+	d.client.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return nil
+	}))
+
+	parents := d.client.Add(testTask{Val: "1"}, testTask{Val: "2"})
+	if err := parents.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := d.client.Add(testTask{Val: "child"}).After(parents.IDs()...)
+	if err := child.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks := testutil.GetTasks(t, d.client.db)
+
+	// The child is held until every parent succeeds.
+	d.processTask(tasks[0])
+	testutil.WaitForChan(t, d.ready)
+	testutil.Length(t, getDependencies(t, d.client)[child.IDs()[0]], 1)
+
+	d.processTask(tasks[1])
+	testutil.WaitForChan(t, d.ready)
+	testutil.Length(t, getDependencies(t, d.client)[child.IDs()[0]], 0)
+
+	got := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "child", child.IDs()[0], got[0].ID)
+}
+
+func TestDispatcher_ProcessTask__DependencyFailure(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ready = make(chan struct{}, 1)
+
+	d.client.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return errors.New("failure error")
+	}))
+
+	var abandoned []string
+	d.client.Subscribe(func(_ context.Context, e Event) {
+		if e.Type == EventAbandoned {
+			abandoned = append(abandoned, e.TaskID)
+			if !errors.Is(e.Error, ErrParentFailed) {
+				t.Errorf("expected parent failed error, got %v", e.Error)
+			}
+		}
+	})
+
+	parent := d.client.Add(testTask{Val: "parent"})
+	if err := parent.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := d.client.Add(testTask{Val: "child"}).After(parent.IDs()[0])
+	if err := child.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	grandchild := d.client.Add(testTask{Val: "grandchild"}).After(child.IDs()[0])
+	if err := grandchild.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup := d.client.Add(testTask{Val: "cleanup"}).
+		After(parent.IDs()[0]).
+		OnParentFailure(RunOnParentFailure)
+	if err := cleanup.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := testutil.GetTasks(t, d.client.db)[0]
+	tk.Attempts = 2
+	d.processTask(tk)
+
+	// The child and grandchild are abandoned while the cleanup is released.
+	got := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "cleanup", cleanup.IDs()[0], got[0].ID)
+	testutil.Equal(t, "dependencies", 0, len(getDependencies(t, d.client)))
+
+	testutil.Length(t, abandoned, 2)
+	testutil.Equal(t, "abandoned child", child.IDs()[0], abandoned[0])
+	testutil.Equal(t, "abandoned grandchild", grandchild.IDs()[0], abandoned[1])
+
+	ct := testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 3)
+
+	for _, c := range ct[1:] {
+		testutil.Equal(t, "succeeded", false, c.Succeeded)
+		testutil.Equal(t, "attempts", 0, c.Attempts)
+	}
+	testutil.Equal(t, "child error", "parent task failed: "+parent.IDs()[0], *ct[1].Error)
+	testutil.Equal(t, "grandchild error", "parent task failed: "+child.IDs()[0], *ct[2].Error)
+}
+
+func TestTaskAddOp_After__Debounce(t *testing.T) {
+	c := mustNewClient(t)
+	c.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return nil
+	}))
+
+	save := func(op *TaskAddOp) string {
+		if err := op.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return op.IDs()[0]
+	}
+
+	parent := save(c.Add(testTask{Val: "parent"}).Debounce("parent", time.Minute))
+	child := save(c.Add(testTask{Val: "child"}).After(parent))
+	other := save(c.Add(testTask{Val: "other"}))
+	dependant := save(c.Add(testTask{Val: "dependant"}).After(other).Debounce("dependant", time.Minute))
+
+	// The children of a replaced task depend on its replacement instead.
+	replacement := save(c.Add(testTask{Val: "replacement"}).Debounce("parent", time.Minute))
+	deps := getDependencies(t, c)
+	testutil.Length(t, deps[child], 1)
+	testutil.Equal(t, "child parent", replacement, deps[child][0])
+
+	// The dependencies of a replaced task are removed along with it.
+	save(c.Add(testTask{Val: "dependant"}).Debounce("dependant", time.Minute))
+	deps = getDependencies(t, c)
+	testutil.Equal(t, "dependencies", 1, len(deps))
+	testutil.Length(t, deps[dependant], 0)
+}
@@ -3,10 +3,13 @@ package backlite
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/drajk/backlite/internal/circuit"
 	"github.com/drajk/backlite/internal/task"
 )
 
@@ -50,6 +53,19 @@ type (
 		// tasks.
 		cleanupInterval time.Duration
 
+		// middleware is applied around the processing of tasks in every queue.
+		middleware []Middleware
+
+		// limiters contains the rate limiters of queues, and throttle keys within queues, and is only accessed by
+		// the fetcher.
+		limiters map[task.Throttled]*limiter
+
+		// breakers contains the circuit breakers of queues, keyed by queue name.
+		breakers map[string]*circuit.Breaker
+
+		// breakersMu protects breakers, which are accessed by the fetcher and the workers.
+		breakersMu sync.Mutex
+
 		// running indicates if the dispatching is currently running.
 		running atomic.Bool
 
@@ -59,6 +75,13 @@ type (
 		// tasks transmits tasks to the workers.
 		tasks chan *task.Task
 
+		// batches transmits batches of tasks, from batch queues, to the workers.
+		batches chan task.Tasks
+
+		// batchTurn counts the fetches of batch queues, in order to rotate which batch queue is fetched first. This is
+		// only accessed by the fetcher.
+		batchTurn int
+
 		// availableWorkers tracks the amount of workers available to receive a task to execute.
 		availableWorkers chan struct{}
 
@@ -74,6 +97,22 @@ type (
 		// current state of the queues.
 		triggered atomic.Bool
 	}
+
+	// execution records what the processor of a task did during a single execution. The processor may run in another
+	// goroutine which outlives the handler chain, such as when EnforceTimeout stops waiting for it, so this is sealed
+	// once the chain returns, after which nothing else is recorded and only the worker executing the task accesses it.
+	execution struct {
+		// processed indicates if the processor was called, so the outcome is that of the processor.
+		processed bool
+
+		// result is the encoded result of the processor, for queues which return results.
+		result []byte
+
+		// sealed indicates that the handler chain returned.
+		sealed bool
+
+		mu sync.Mutex
+	}
 )
 
 // Start starts the dispatcher.
@@ -87,6 +126,7 @@ func (d *dispatcher) Start(ctx context.Context) {
 	d.ctx = ctx
 	d.shutdownCtx, d.shutdown = context.WithCancel(context.Background())
 	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.batches = make(chan task.Tasks, d.numWorkers)
 	d.ticker = time.NewTicker(time.Second)
 	d.ticker.Stop()                     // No need to tick yet
 	d.ready = make(chan struct{}, 1000) // Prevent blocking task creation
@@ -166,6 +206,7 @@ func (d *dispatcher) fetcher() {
 		d.running.Store(false)
 		d.ticker.Stop()
 		close(d.tasks)
+		close(d.batches)
 		d.log.Info("shutting down dispatcher")
 	}()
 
@@ -198,6 +239,13 @@ func (d *dispatcher) worker() {
 			d.processTask(row)
 			d.availableWorkers <- struct{}{}
 
+		case batch := <-d.batches:
+			if batch == nil {
+				break
+			}
+			d.processBatch(batch)
+			d.availableWorkers <- struct{}{}
+
 		case <-d.shutdownCtx.Done():
 			return
 
@@ -207,19 +255,24 @@ func (d *dispatcher) worker() {
 	}
 }
 
-// cleaner periodically deletes expired completed tasks from the database.
+// cleaner periodically deletes expired completed tasks, and the shared rate limits of throttle keys which have
+// refilled, from the database.
 func (d *dispatcher) cleaner() {
 	ticker := time.NewTicker(d.cleanupInterval)
 
 	for {
 		select {
 		case <-ticker.C:
-			if err := task.DeleteExpiredCompleted(d.ctx, d.client.db); err != nil {
+			blobs, err := task.DeleteExpiredCompleted(d.ctx, d.client.db)
+			if err != nil {
 				d.log.Error("failed to delete expired completed tasks",
 					"error", err,
 				)
 			}
 
+			d.client.deleteBlobs(d.ctx, blobs...)
+			d.deleteFullKeys()
+
 		case <-d.shutdownCtx.Done():
 			return
 
@@ -261,13 +314,55 @@ func (d *dispatcher) fetch() {
 	// Determine how many workers are available, so we only fetch that many tasks.
 	workers := d.waitForWorkers()
 
+	// Tasks claimed after the deadline are considered to be running.
+	deadline := now().Add(-d.releaseAfter)
+
+	// Exclude the queues, and throttle keys, which have exhausted their rate limit.
+	exclude, refill := d.limited()
+
+	// Exclude the queues, and throttle keys, which are at their concurrency cap, and fetch again shortly since the
+	// running tasks may be in other processes.
+	conc, err := d.concurrency(deadline)
+	if err != nil {
+		d.log.Error("count running tasks query failed",
+			"error", err,
+		)
+		return
+	}
+
+	if conc.exclude(&exclude) {
+		refill = earliest(refill, now().Add(limitPollInterval))
+	}
+
+	// Exclude the queues whose circuit is open, until it half-opens, or half-open with a probe executing.
+	tripped, until := d.tripped()
+	exclude.Queues = append(exclude.Queues, tripped...)
+	refill = earliest(refill, until)
+
+	// Fetch and send batches to the workers first, since each batch queue uses at most one worker per fetch.
+	used, at, err := d.fetchBatches(deadline, workers, exclude, conc)
+	if err != nil {
+		d.log.Error("fetch batches failed",
+			"error", err,
+		)
+		return
+	}
+	workers -= used
+	refill = earliest(refill, at)
+
+	// Batch queues are only fetched as batches.
+	for _, q := range d.client.queues.batched() {
+		exclude.Queues = append(exclude.Queues, q.Config().Name)
+	}
+
 	// Fetch tasks for each available worker plus the next upcoming task so the scheduler knows when to
 	// query the database again without having to continually poll.
 	tasks, err := task.GetScheduledTasks(
 		d.ctx,
 		d.client.db,
-		now().Add(-d.releaseAfter),
+		deadline,
 		int(workers)+1,
+		exclude,
 	)
 
 	if err != nil {
@@ -278,64 +373,152 @@ func (d *dispatcher) fetch() {
 	}
 
 	var next *task.Task
-	nextUp := func(i int) {
-		next = tasks[i]
-		tasks = tasks[:i]
-	}
+	ready := make(task.Tasks, 0, len(tasks))
 
-	for i := range tasks {
+	for _, t := range tasks {
 		// Check if the workers are full.
-		if (i + 1) > workers {
-			nextUp(i)
+		if len(ready) == workers {
+			next = t
 			break
 		}
 
-		// Check if this task is not ready yet.
-		if tasks[i].WaitUntil != nil {
-			if tasks[i].WaitUntil.After(now()) {
-				nextUp(i)
-				break
-			}
+		// Check if this task is not ready yet, in which case neither are the tasks after it.
+		if t.WaitUntil != nil && t.WaitUntil.After(now()) {
+			next = t
+			break
+		}
+
+		// Skip the task if its queue, or throttle key, is at its concurrency cap, and fetch again shortly, which
+		// excludes the queue or key. Not every key can be excluded, so the tasks after it may still be ready.
+		if conc.full(t) {
+			refill = earliest(refill, now().Add(limitPollInterval))
+			continue
+		}
+
+		// Skip the task if the circuit of its queue does not allow it, which only allows a single probe task once the
+		// circuit half-opens. This is checked before the rate limits so a task which cannot execute uses no tokens.
+		if !d.admit(t) {
+			continue
+		}
+
+		// Skip the task if its queue, or throttle key, has exhausted its rate limit, in the same way.
+		if !d.allow(t) {
+			d.cancelProbe(t)
+			refill = earliest(refill, now().Add(limitPollInterval))
+			continue
 		}
+
+		conc.add(t)
+		ready = append(ready, t)
 	}
+	tasks = ready
 
-	// Claim the tasks that are ready to be processed.
-	if err = tasks.Claim(d.ctx, d.client.db); err != nil {
+	// Claim the tasks that are ready to be processed, skipping any that another dispatcher sharing the database
+	// claimed first.
+	claimed, err := d.claim(tasks, deadline, conc.caps)
+	if err != nil {
 		d.log.Error("failed to claim tasks",
 			"error", err,
 		)
 		return
 	}
 
+	// Tasks which could not be claimed were either claimed by another dispatcher or their queue, or throttle key,
+	// reached its concurrency cap, so fetch again shortly.
+	if len(claimed) < len(tasks) {
+		refill = earliest(refill, now().Add(limitPollInterval))
+	}
+
 	// Send the ready tasks to the workers.
-	for i := range tasks {
-		tasks[i].Attempts++
+	for _, t := range claimed {
 		<-d.availableWorkers
-		d.tasks <- tasks[i]
+		d.tasks <- t
+	}
+
+	// Adjust the schedule based on the next up task and when the rate limited queues refill.
+	d.schedule(next, refill)
+}
+
+// claim claims tasks to be executed and returns the tasks which were claimed, with their attempts incremented. Tasks
+// that were not claimed are released from being the probe of their circuit and their rate limit tokens are returned.
+func (d *dispatcher) claim(tasks task.Tasks, deadline time.Time, caps task.Caps) (task.Tasks, error) {
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+
+	claimed, err := tasks.Claim(d.ctx, d.client.db, deadline, caps)
+	if err != nil {
+		return nil, err
 	}
 
-	// Adjust the schedule based on the next up task.
-	d.schedule(next)
+	if len(claimed) < len(tasks) {
+		ids := make(map[string]struct{}, len(claimed))
+		for _, t := range claimed {
+			ids[t.ID] = struct{}{}
+		}
+
+		for _, t := range tasks {
+			if _, ok := ids[t.ID]; !ok {
+				d.cancelProbe(t)
+				d.disallow(t)
+			}
+		}
+	}
+
+	for _, t := range claimed {
+		// Tasks that were previously claimed were never completed and have now been released.
+		if t.ClaimedAt != nil {
+			d.client.hooks.emit(d.ctx, Event{
+				Type:    EventReleased,
+				TaskID:  t.ID,
+				Queue:   t.Queue,
+				Attempt: t.Attempts,
+			})
+		}
+
+		d.client.hooks.emit(d.ctx, Event{
+			Type:    EventClaimed,
+			TaskID:  t.ID,
+			Queue:   t.Queue,
+			Attempt: t.Attempts + 1,
+		})
+
+		t.Attempts++
+	}
+
+	return claimed, nil
 }
 
-// schedule handles scheduling the dispatcher based on the next up task provided by the fetcher.
-func (d *dispatcher) schedule(t *task.Task) {
+// schedule handles scheduling the dispatcher based on the next up task provided by the fetcher and, if not zero, the
+// time that a rate limited queue is able to execute tasks again.
+func (d *dispatcher) schedule(t *task.Task, refill time.Time) {
 	d.ticker.Stop()
 
+	var at time.Time
+
 	if t != nil {
 		if t.WaitUntil == nil {
 			d.ready <- struct{}{}
 			return
 		}
+		at = *t.WaitUntil
+	}
 
-		dur := t.WaitUntil.Sub(now())
-		if dur < 0 {
-			d.ready <- struct{}{}
-			return
-		}
+	if !refill.IsZero() && (at.IsZero() || refill.Before(at)) {
+		at = refill
+	}
 
-		d.ticker.Reset(dur)
+	if at.IsZero() {
+		return
+	}
+
+	dur := at.Sub(now())
+	if dur <= 0 {
+		d.ready <- struct{}{}
+		return
 	}
+
+	d.ticker.Reset(dur)
 }
 
 // processTask attempts to execute a given task.
@@ -347,9 +530,22 @@ func (d *dispatcher) processTask(t *task.Task) {
 	q := d.client.queues.get(t.Queue)
 	cfg := q.Config()
 
-	// Set a context timeout, if desired.
-	if cfg.Timeout > 0 {
-		ctx, cancel = context.WithDeadline(d.ctx, now().Add(cfg.Timeout))
+	// Discard the task rather than executing it if the deadline to start has passed. Retries are not discarded since
+	// the task has already started.
+	if t.Attempts == 1 && t.Deadline != nil && now().After(*t.Deadline) {
+		d.cancelProbe(t)
+		d.taskExpired(q, t)
+		return
+	}
+
+	// Set a context timeout, if desired, preferring the timeout of the task over the queue.
+	timeout := cfg.Timeout
+	if t.Timeout != nil {
+		timeout = *t.Timeout
+	}
+
+	if timeout > 0 {
+		ctx, cancel = context.WithDeadline(d.ctx, now().Add(timeout))
 		defer cancel()
 	} else {
 		ctx = d.ctx
@@ -359,8 +555,24 @@ func (d *dispatcher) processTask(t *task.Task) {
 	// TODO include the attempt number
 	ctx = context.WithValue(ctx, ctxKeyClient{}, d.client)
 
+	// Restore the metadata that was propagated from the context used to add the task.
+	if d.client.propagator != nil {
+		ctx = d.client.propagator.Extract(ctx, t.Metadata)
+	}
+
+	d.client.hooks.emit(ctx, Event{
+		Type:    EventStarted,
+		TaskID:  t.ID,
+		Queue:   t.Queue,
+		Attempt: t.Attempts,
+	})
+
 	start := now()
 
+	// Record if the outcome is that of the processor, rather than of loading the payload or storing the result, and
+	// the result of the processor.
+	exec := &execution{}
+
 	defer func() {
 		// Recover from panics from within the task processor.
 		if rec := recover(); rec != nil {
@@ -373,21 +585,134 @@ func (d *dispatcher) processTask(t *task.Task) {
 			err = fmt.Errorf("%v", rec)
 		}
 
+		if err == nil {
+			return
+		}
+
+		if d.ctx.Err() != nil {
+			d.taskCancelled(ctx, t, time.Since(start), err)
+			return
+		}
+
+		// Only failures of the processor reflect the health of the queue, so other failures are not recorded in the
+		// circuit of the queue.
+		if processed, _ := exec.seal(); processed {
+			d.recordOutcome(t, err)
+		} else {
+			d.cancelProbe(t)
+		}
+
 		// If panic or error, handle the task as a failure.
+		d.taskFailure(q, t, start, time.Since(start), err)
+	}()
+
+	// Wrap the queue processor with the queue middleware followed by the dispatcher middleware.
+	h := chain(func(ctx context.Context, _ TaskInfo, payload []byte) error {
+		// Provide the codec the task was encoded with so the queue can decode it.
+		codec := d.client.codecs.get(t.Codec)
+		if codec == nil {
+			return fmt.Errorf("codec '%s' not registered", t.Codec)
+		}
+
+		// Upgrade the payload from the version it was added with to the current version of the queue.
+		payload, err := cfg.upgrade(t.Version, payload)
 		if err != nil {
-			d.taskFailure(q, t, start, time.Since(start), err)
+			return err
 		}
-	}()
 
-	// Process the task.
-	if err = q.Process(ctx, t.Task); err == nil {
-		d.taskSuccess(q, t, start, time.Since(start))
+		// Provide the execution for queues which return results to store the encoded result in.
+		ctx = context.WithValue(ctx, ctxKeyCodec{}, codec)
+		ctx = context.WithValue(ctx, ctxKeyResult{}, exec)
+		if !exec.process() {
+			return context.DeadlineExceeded
+		}
+
+		return q.Process(ctx, payload)
+	}, cfg.Middleware...)
+	h = chain(h, d.middleware...)
+
+	info := TaskInfo{
+		ID:        t.ID,
+		Queue:     t.Queue,
+		Attempt:   t.Attempts,
+		CreatedAt: t.CreatedAt,
+	}
+
+	// Restore the encoded payload and process the task.
+	var payload []byte
+	if payload, err = d.client.unpack(ctx, t); err == nil {
+		err = h(ctx, info, payload)
+	}
+
+	// Protect the result in the same way as the payload before it is stored.
+	_, result := exec.seal()
+	if err == nil && result != nil {
+		if result, err = d.client.packResult(t, result); err != nil {
+			exec.processed = false
+		}
+	}
+
+	if err == nil {
+		d.recordOutcome(t, nil)
+		d.taskSuccess(q, t, start, time.Since(start), result)
 	}
 }
 
+// process records that the processor is about to be called and returns false if the execution was already sealed,
+// in which case the processor must not be called.
+func (e *execution) process() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.sealed {
+		return false
+	}
+	e.processed = true
+	return true
+}
+
+// store stores the encoded result of the processor, unless the execution was already sealed.
+func (e *execution) store(result []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.sealed {
+		e.result = result
+	}
+}
+
+// seal stops anything more from being recorded and returns whether the processor was called and its result.
+func (e *execution) seal() (bool, []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sealed = true
+	return e.processed, e.result
+}
+
+// taskCancelled handles a task whose processing was cancelled because the dispatcher was hard-stopped, in which case
+// the outcome cannot be persisted, so the task will be released back to the queue once the release duration elapses.
+func (d *dispatcher) taskCancelled(ctx context.Context, t *task.Task, dur time.Duration, taskErr error) {
+	d.log.Error("task processing cancelled",
+		"id", t.ID,
+		"queue", t.Queue,
+		"attempt", t.Attempts,
+	)
+
+	d.client.hooks.emit(ctx, Event{
+		Type:     EventCancelled,
+		TaskID:   t.ID,
+		Queue:    t.Queue,
+		Attempt:  t.Attempts,
+		Duration: dur,
+		Error:    taskErr,
+	})
+}
+
 // taskSuccess handles post successful execution of a given task by removing it from the task table and optionally
-// retaining it in the completed tasks table if the queue settings have retention enabled.
-func (d *dispatcher) taskSuccess(q Queue, t *task.Task, started time.Time, dur time.Duration) {
+// retaining it, along with the encoded result of the processor, if any, in the completed tasks table if the queue
+// settings have retention enabled.
+func (d *dispatcher) taskSuccess(q Queue, t *task.Task, started time.Time, dur time.Duration, result []byte) {
 	var tx *sql.Tx
 	var err error
 
@@ -428,18 +753,64 @@ func (d *dispatcher) taskSuccess(q Queue, t *task.Task, started time.Time, dur t
 		return
 	}
 
-	if err = d.taskComplete(tx, q, t, started, dur, nil); err != nil {
+	if err = d.taskComplete(tx, q, t, started, dur, result, nil); err != nil {
+		return
+	}
+
+	// Release the tasks which depend on this task.
+	var released int64
+	if released, err = task.ResolveDependenciesTx(d.ctx, tx, t.ID); err != nil {
+		return
+	}
+
+	var skipped task.Tasks
+	var n int64
+	if skipped, n, err = d.stepCompleted(tx, t, nil); err != nil {
 		return
 	}
+	released += n
+
+	if n, err = d.groupProgress(tx, t, nil); err != nil {
+		return
+	}
+	released += n
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	d.taskReleaseBlob(q, t, nil)
+	d.compensationsSkipped(skipped)
 
-	err = tx.Commit()
+	d.client.hooks.emit(d.ctx, Event{
+		Type:     EventSucceeded,
+		TaskID:   t.ID,
+		Queue:    t.Queue,
+		Attempt:  t.Attempts,
+		Duration: dur,
+	})
+
+	if released > 0 {
+		d.Notify()
+	}
 }
 
 // taskFailure handles post failed execution of a given task by either releasing it back to the queue, if the maximum
 // amount of attempts haven't been reached, or by deleting it from the task table and optionally moving to the completed
 // task table if the queue has retention enabled.
 func (d *dispatcher) taskFailure(q Queue, t *task.Task, started time.Time, dur time.Duration, taskErr error) {
-	remaining := q.Config().MaxAttempts - t.Attempts
+	cfg := q.Config()
+
+	// Prefer the settings of the task over the queue.
+	maxAttempts, backoff := cfg.MaxAttempts, cfg.Backoff
+	if t.MaxAttempts != nil {
+		maxAttempts = *t.MaxAttempts
+	}
+	if t.Backoff != nil {
+		backoff = *t.Backoff
+	}
+
+	remaining := maxAttempts - t.Attempts
 
 	d.log.Error("task processing failed",
 		"id", t.ID,
@@ -483,18 +854,52 @@ func (d *dispatcher) taskFailure(q Queue, t *task.Task, started time.Time, dur t
 			return
 		}
 
-		if err = d.taskComplete(tx, q, t, started, dur, taskErr); err != nil {
+		if err = d.taskComplete(tx, q, t, started, dur, nil, taskErr); err != nil {
+			return
+		}
+
+		var skipped task.Tasks
+		var compensations int64
+		if skipped, compensations, err = d.stepCompleted(tx, t, taskErr); err != nil {
+			return
+		}
+
+		var abandoned []abandonedTask
+		var released, n int64
+		if abandoned, released, err = d.abandonDependents(tx, t.ID); err != nil {
+			return
+		}
+		released += compensations
+
+		if n, err = d.groupProgress(tx, t, taskErr); err != nil {
 			return
 		}
+		released += n
+
+		if err = tx.Commit(); err != nil {
+			return
+		}
+
+		d.taskReleaseBlob(q, t, taskErr)
+		d.compensationsSkipped(skipped)
+
+		d.client.hooks.emit(d.ctx, Event{
+			Type:     EventExhausted,
+			TaskID:   t.ID,
+			Queue:    t.Queue,
+			Attempt:  t.Attempts,
+			Duration: dur,
+			Error:    taskErr,
+		})
 
-		err = tx.Commit()
+		d.tasksAbandoned(abandoned, released)
 	} else {
 		t.LastExecutedAt = &started
 
 		err := t.Fail(
 			d.ctx,
 			d.client.db,
-			now().Add(q.Config().Backoff),
+			now().Add(backoff),
 		)
 
 		if err != nil {
@@ -503,12 +908,103 @@ func (d *dispatcher) taskFailure(q Queue, t *task.Task, started time.Time, dur t
 				"queue", t.Queue,
 				"error", err,
 			)
+		} else {
+			d.client.hooks.emit(d.ctx, Event{
+				Type:     EventRetrying,
+				TaskID:   t.ID,
+				Queue:    t.Queue,
+				Attempt:  t.Attempts,
+				Duration: dur,
+				Error:    taskErr,
+			})
 		}
 
 		d.ready <- struct{}{}
 	}
 }
 
+// taskExpired handles a task which expired before it was executed by removing it from the task table and optionally
+// retaining it in the completed tasks table, as a failure, if the queue settings have retention enabled.
+func (d *dispatcher) taskExpired(q Queue, t *task.Task) {
+	var tx *sql.Tx
+	var err error
+
+	defer func() {
+		if err != nil {
+			d.log.Error("failed to update task expiration",
+				"id", t.ID,
+				"queue", t.Queue,
+				"error", err,
+			)
+
+			if tx != nil {
+				if err := tx.Rollback(); err != nil {
+					d.log.Error("failed to rollback task expiration",
+						"id", t.ID,
+						"queue", t.Queue,
+						"error", err,
+					)
+				}
+			}
+		}
+	}()
+
+	d.log.Info("task expired",
+		"id", t.ID,
+		"queue", t.Queue,
+		"deadline", *t.Deadline,
+	)
+
+	tx, err = d.client.db.Begin()
+	if err != nil {
+		return
+	}
+
+	err = t.DeleteTx(d.ctx, tx)
+	if err != nil {
+		return
+	}
+
+	if err = d.taskComplete(tx, q, t, now(), 0, nil, ErrExpired); err != nil {
+		return
+	}
+
+	var skipped task.Tasks
+	var compensations int64
+	if skipped, compensations, err = d.stepCompleted(tx, t, ErrExpired); err != nil {
+		return
+	}
+
+	var abandoned []abandonedTask
+	var released, n int64
+	if abandoned, released, err = d.abandonDependents(tx, t.ID); err != nil {
+		return
+	}
+	released += compensations
+
+	if n, err = d.groupProgress(tx, t, ErrExpired); err != nil {
+		return
+	}
+	released += n
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	d.taskReleaseBlob(q, t, ErrExpired)
+	d.compensationsSkipped(skipped)
+
+	d.client.hooks.emit(d.ctx, Event{
+		Type:    EventExpired,
+		TaskID:  t.ID,
+		Queue:   t.Queue,
+		Attempt: t.Attempts,
+		Error:   ErrExpired,
+	})
+
+	d.tasksAbandoned(abandoned, released)
+}
+
 // taskComplete creates a completed task from a given task.
 func (d *dispatcher) taskComplete(
 	tx *sql.Tx,
@@ -516,6 +1012,7 @@ func (d *dispatcher) taskComplete(
 	t *task.Task,
 	started time.Time,
 	dur time.Duration,
+	result []byte,
 	taskErr error) error {
 	ret := q.Config().Retention
 	if ret == nil {
@@ -534,6 +1031,13 @@ func (d *dispatcher) taskComplete(
 		LastDuration:   dur,
 		CreatedAt:      t.CreatedAt,
 		LastExecutedAt: started,
+		Tags:           t.Tags,
+		Codec:          t.Codec,
+		Compression:    t.Compression,
+		KeyID:          t.KeyID,
+		Version:        t.Version,
+		Expired:        errors.Is(taskErr, ErrExpired),
+		Result:         result,
 	}
 
 	if taskErr != nil {
@@ -546,15 +1050,36 @@ func (d *dispatcher) taskComplete(
 		c.ExpiresAt = &v
 	}
 
-	if ret.Data != nil {
-		if !ret.Data.OnlyFailed || taskErr != nil {
-			c.Task = t.Task
-		}
+	if retainsData(ret, taskErr) {
+		c.Task = t.Task
+		c.Offloaded = t.Offloaded
 	}
 
 	return c.InsertTx(d.ctx, tx)
 }
 
+// taskReleaseBlob deletes the offloaded data of a task that has been removed from the task table, unless the data was
+// retained in the completed task, in which case it is deleted when the completed task expires.
+func (d *dispatcher) taskReleaseBlob(q Queue, t *task.Task, taskErr error) {
+	if !t.Offloaded || retainsData(q.Config().Retention, taskErr) {
+		return
+	}
+
+	d.client.deleteBlobs(d.ctx, string(t.Task))
+}
+
+// retainsData determines if the data of a completed task should be retained based on the retention policy.
+func retainsData(ret *Retention, taskErr error) bool {
+	switch {
+	case ret == nil, ret.Data == nil:
+		return false
+	case taskErr == nil && ret.OnlyFailed:
+		return false
+	default:
+		return !ret.Data.OnlyFailed || taskErr != nil
+	}
+}
+
 // Notify is used by the client to notify the dispatcher that a new task was added.
 func (d *dispatcher) Notify() {
 	if d.running.Load() {
@@ -3,9 +3,11 @@ package backlite
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -276,6 +278,7 @@ func TestDispatcher_ProcessTask__Success(t *testing.T) {
 		Task:      testutil.Encode(t, &testTask{Val: "1"}),
 		Attempts:  1,
 		CreatedAt: now(),
+		Tags:      map[string]string{"customer": "42"},
 	}
 	testutil.InsertTask(t, d.client.db, tk)
 
@@ -297,6 +300,7 @@ func TestDispatcher_ProcessTask__Success(t *testing.T) {
 	testutil.Equal(t, "last executed at", now(), ct[0].LastExecutedAt)
 	testutil.Equal(t, "expires at", now().Add(time.Hour), *ct[0].ExpiresAt)
 	testutil.Equal(t, "error", nil, ct[0].Error)
+	testutil.Equal(t, "tags", "42", ct[0].Tags["customer"])
 
 	if !bytes.Equal(ct[0].Task, tk.Task) {
 		t.Error("task does not match")
@@ -568,6 +572,105 @@ func TestDispatcher_ProcessTask__Failure(t *testing.T) {
 	}
 }
 
+func TestDispatcher_ProcessTask__Overrides(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	var deadline time.Time
+
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		deadline, _ = ctx.Deadline()
+		return errors.New("failure error")
+	}))
+
+	tk := &task.Task{
+		ID:          "1",
+		Queue:       "test",
+		Task:        testutil.Encode(t, &testTask{Val: "1"}),
+		Attempts:    2,
+		CreatedAt:   now(),
+		MaxAttempts: testutil.Pointer(3),
+		Timeout:     testutil.Pointer(time.Minute),
+		Backoff:     testutil.Pointer(time.Hour),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+
+	// The queue allows 2 attempts but the task allows 3, so it should be retried.
+	d.processTask(tk)
+	testutil.WaitForChan(t, d.ready)
+	testutil.Equal(t, "deadline", now().Add(time.Minute), deadline)
+
+	got := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "wait until", now().Add(time.Hour), *got[0].WaitUntil)
+
+	// Final attempt.
+	tk.Attempts++
+	d.processTask(tk)
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+	testutil.Length(t, testutil.GetCompletedTasks(t, d.client.db), 1)
+}
+
+func TestDispatcher_ProcessTask__Expired(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	var called bool
+	rec := &eventRecorder{}
+	d.client.Subscribe(rec.hook)
+
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		called = true
+		return nil
+	}))
+
+	tk := &task.Task{
+		ID:        "1",
+		Queue:     "test",
+		Task:      testutil.Encode(t, &testTask{Val: "1"}),
+		Attempts:  1,
+		CreatedAt: now().Add(-time.Hour),
+		Deadline:  testutil.Pointer(now().Add(-time.Millisecond)),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+
+	d.processTask(tk)
+	testutil.Equal(t, "called", false, called)
+	rec.assertTypes(t, EventExpired)
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+
+	ct := testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 1)
+	testutil.Equal(t, "succeeded", false, ct[0].Succeeded)
+	testutil.Equal(t, "expired", true, ct[0].Expired)
+	testutil.Equal(t, "error", ErrExpired.Error(), *ct[0].Error)
+
+	// Not yet expired.
+	tk.ID = "2"
+	tk.Deadline = testutil.Pointer(now())
+	testutil.InsertTask(t, d.client.db, tk)
+	d.processTask(tk)
+	testutil.Equal(t, "called", true, called)
+
+	ct = testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 2)
+	testutil.Equal(t, "succeeded", true, ct[1].Succeeded)
+	testutil.Equal(t, "expired", false, ct[1].Expired)
+
+	// Retries are executed after the deadline since the task has already started.
+	called = false
+	tk.ID = "3"
+	tk.Attempts = 2
+	tk.Deadline = testutil.Pointer(now().Add(-time.Millisecond))
+	testutil.InsertTask(t, d.client.db, tk)
+	d.processTask(tk)
+	testutil.Equal(t, "called", true, called)
+
+	ct = testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 3)
+	testutil.Equal(t, "expired", false, ct[2].Expired)
+}
+
 func TestDispatcher_Fetcher(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -677,6 +780,150 @@ func TestDispatcher_Fetcher(t *testing.T) {
 	}
 }
 
+func TestDispatcher_Fetch__Partitions(t *testing.T) {
+	// Two dispatchers share the database as if they were in separate processes.
+	newFetcher := func(c *Client) *dispatcher {
+		d := newDispatcher(t)
+		d.client = c
+		d.ctx = context.Background()
+		d.ticker = time.NewTicker(time.Hour)
+		d.tasks = make(chan *task.Task, d.numWorkers)
+		d.ready = make(chan struct{}, 1)
+		d.availableWorkers = make(chan struct{}, d.numWorkers)
+		for range d.numWorkers {
+			d.availableWorkers <- struct{}{}
+		}
+		return d
+	}
+
+	fetched := func(d *dispatcher) []string {
+		var vals []string
+		for len(d.tasks) > 0 {
+			var tk testTask
+			if err := json.Unmarshal((<-d.tasks).Task, &tk); err != nil {
+				t.Fatal(err)
+			}
+			vals = append(vals, tk.Val)
+			d.availableWorkers <- struct{}{}
+		}
+		return vals
+	}
+
+	d1 := newFetcher(mustNewClient(t))
+	d2 := newFetcher(d1.client)
+	d1.client.dispatcher = &mockDispatcher{}
+	d1.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		return nil
+	}))
+	d1.client.Register(NewQueue[testTaskNoRention](func(ctx context.Context, _ testTaskNoRention) error {
+		return nil
+	}))
+
+	add := func(val, partition string) {
+		op := d1.client.Add(testTask{Val: val})
+		if partition != "" {
+			op.Partition(partition)
+		}
+		if err := op.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a1", "a")
+	add("b1", "b")
+	add("a2", "a")
+	add("c1", "")
+	add("a3", "a")
+
+	// Only the oldest task of each partition can be claimed.
+	d1.fetch()
+	testutil.Equal(t, "d1", "a1,b1,c1", strings.Join(fetched(d1), ","))
+
+	// Partitions are scoped to their queue.
+	if err := d1.client.Add(testTaskNoRention{Val: "x1"}).Partition("a").Save(); err != nil {
+		t.Fatal(err)
+	}
+	d1.fetch()
+	testutil.Equal(t, "other queue", "x1", strings.Join(fetched(d1), ","))
+
+	// The next task in each partition cannot be claimed while the previous task is running.
+	d2.fetch()
+	testutil.Length(t, fetched(d2), 0)
+
+	got := testutil.GetTasks(t, d1.client.db)
+	testutil.Equal(t, "partition", "a", got[0].PartitionKey)
+	got[0].Attempts++
+	d1.processTask(got[0])
+
+	d2.fetch()
+	testutil.Equal(t, "d2", "a2", strings.Join(fetched(d2), ","))
+}
+
+func TestTasks_Claim(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	for _, id := range []string{"1", "2"} {
+		testutil.InsertTask(t, db, &task.Task{ID: id, Queue: "test", Task: []byte("{}"), CreatedAt: now()})
+	}
+
+	tasks := testutil.GetTasks(t, db)
+	claimed, err := tasks.Claim(ctx, db, now().Add(-time.Hour), task.Caps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, claimed, 2)
+
+	// Another processor which loaded the same tasks cannot claim them.
+	claimed, err = tasks.Claim(ctx, db, now().Add(-time.Hour), task.Caps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, claimed, 0)
+
+	// Unless the previous claims are older than the deadline.
+	claimed, err = tasks.Claim(ctx, db, time.Now().Add(time.Second), task.Caps{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, claimed, 2)
+
+	for _, tk := range testutil.GetTasks(t, db) {
+		testutil.Equal(t, "attempts", 2, tk.Attempts)
+	}
+}
+
+func TestTasks_Claim__Caps(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	for i, key := range []string{"a", "a", "b", "", ""} {
+		testutil.InsertTask(t, db, &task.Task{
+			ID:          fmt.Sprint(i),
+			Queue:       "test",
+			Task:        []byte("{}"),
+			CreatedAt:   now(),
+			ThrottleKey: key,
+		})
+	}
+
+	// One task per throttle key and three tasks in the queue can run at once.
+	claimed, err := testutil.GetTasks(t, db).Claim(ctx, db, now().Add(-time.Hour), task.Caps{
+		Queues: map[string]int{"test": 3},
+		Keys:   map[string]int{"test": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, 0, len(claimed))
+	for _, tk := range claimed {
+		ids = append(ids, tk.ID)
+	}
+	testutil.Equal(t, "claimed", "0,2,3", strings.Join(ids, ","))
+}
+
 func newDispatcher(t *testing.T) *dispatcher {
 	return &dispatcher{
 		numWorkers: 3,
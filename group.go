@@ -0,0 +1,81 @@
+package backlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+)
+
+// GroupStatus is the progress of a group of tasks.
+type GroupStatus struct {
+	// ID is the ID of the group.
+	ID string
+
+	// Total is the number of tasks which have been added to the group.
+	Total int
+
+	// Succeeded is the number of tasks in the group which succeeded.
+	Succeeded int
+
+	// Failed is the number of tasks in the group which completed without succeeding, because they failed all of their
+	// attempts, expired or were abandoned.
+	Failed int
+
+	// Pending is the number of tasks in the group which have not completed.
+	Pending int
+
+	// CreatedAt is when the group was created.
+	CreatedAt time.Time
+
+	// CompletedAt is when every task in the group completed, if they have.
+	CompletedAt *time.Time
+}
+
+// Done returns true if every task in the group has completed.
+func (g *GroupStatus) Done() bool {
+	return g.CompletedAt != nil
+}
+
+// GroupStatus loads the progress of a group of tasks with a given ID. ErrGroupNotFound is returned if no such group
+// exists.
+func (c *Client) GroupStatus(ctx context.Context, id string) (*GroupStatus, error) {
+	g, err := task.GetGroup(ctx, c.db, id)
+	switch {
+	case err != nil:
+		return nil, err
+	case g == nil:
+		return nil, ErrGroupNotFound
+	}
+
+	return &GroupStatus{
+		ID:          g.ID,
+		Total:       g.Total,
+		Succeeded:   g.Succeeded,
+		Failed:      g.Failed,
+		Pending:     g.Total - g.Succeeded - g.Failed,
+		CreatedAt:   g.CreatedAt,
+		CompletedAt: g.CompletedAt,
+	}, nil
+}
+
+// groupProgress records the outcome of a task in the group it belongs to, if any, as part of the transaction which
+// completes it. If that was the last task in the group to complete, the callback of the group is released, and 1 is
+// returned so the dispatcher can be notified.
+func (d *dispatcher) groupProgress(tx *sql.Tx, t *task.Task, taskErr error) (int64, error) {
+	if t.GroupID == "" {
+		return 0, nil
+	}
+
+	completed, err := task.CompleteGroupTaskTx(d.ctx, tx, t.GroupID, taskErr == nil, now())
+	if err != nil || !completed {
+		return 0, err
+	}
+
+	d.log.Info("group completed",
+		"group", t.GroupID,
+	)
+
+	return 1, nil
+}
@@ -0,0 +1,205 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestTaskAddOp_Group(t *testing.T) {
+	c := mustNewClient(t)
+	c.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return nil
+	}))
+
+	_, err := c.GroupStatus(context.Background(), "missing")
+	if !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("expected group not found error, got %v", err)
+	}
+
+	// A group ID is generated when one is not provided.
+	op := c.Add(testTask{Val: "1"}, testTask{Val: "2"}).Group("")
+	if err = op.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if op.GroupID() == "" {
+		t.Error("expected a group ID to be generated")
+	}
+
+	// Tasks can be added to an existing group.
+	if err = c.Add(testTask{Val: "3"}).Group(op.GroupID()).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tk := range testutil.GetTasks(t, c.db) {
+		testutil.Equal(t, "task group", op.GroupID(), tk.GroupID)
+	}
+
+	g, err := c.GroupStatus(context.Background(), op.GroupID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "total", 3, g.Total)
+	testutil.Equal(t, "pending", 3, g.Pending)
+	testutil.Equal(t, "done", false, g.Done())
+
+	// The callback is held until the group completes.
+	cb := c.Add(testTask{Val: "4"}).Group("campaign").OnGroupComplete(testTask{Val: "callback"})
+	if err = cb.Save(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "group ID", "campaign", cb.GroupID())
+
+	deps := getDependencies(t, c)
+	testutil.Equal(t, "dependencies", 1, len(deps))
+	for _, parents := range deps {
+		testutil.Length(t, parents, 1)
+		testutil.Equal(t, "parent", "campaign", parents[0])
+	}
+}
+
+func TestDispatcher_ProcessTask__Group(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ready = make(chan struct{}, 1)
+	d.running.Store(true)
+
+	d.client.Register(NewQueue[testTask](func(_ context.Context, tk testTask) error {
+		if tk.Val == "fail" {
+			return errors.New("failure error")
+		}
+		return nil
+	}))
+
+	op := d.client.Add(testTask{Val: "ok"}, testTask{Val: "fail"}).
+		Group("campaign").
+		OnGroupComplete(testTask{Val: "callback"})
+	if err := op.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, tasks, 3)
+
+	d.processTask(tasks[0])
+	g, err := d.client.GroupStatus(context.Background(), "campaign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "succeeded", 1, g.Succeeded)
+	testutil.Equal(t, "pending", 1, g.Pending)
+	testutil.Equal(t, "dependencies", 1, len(getDependencies(t, d.client)))
+
+	// The callback is released once the last task completes, even though it failed.
+	tasks[1].Attempts = 2
+	d.processTask(tasks[1])
+	testutil.WaitForChan(t, d.ready)
+
+	g, err = d.client.GroupStatus(context.Background(), "campaign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "failed", 1, g.Failed)
+	testutil.Equal(t, "pending", 0, g.Pending)
+	testutil.Equal(t, "done", true, g.Done())
+	testutil.Equal(t, "dependencies", 0, len(getDependencies(t, d.client)))
+
+	got := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "callback", tasks[2].ID, got[0].ID)
+	testutil.Equal(t, "callback group", "", got[0].GroupID)
+
+	// Nothing more can be added to a completed group.
+	err = d.client.Add(testTask{Val: "late"}).Group("campaign").Save()
+	if !errors.Is(err, ErrGroupCompleted) {
+		t.Errorf("expected group completed error, got %v", err)
+	}
+}
+
+func TestTaskAddOp_Group__Debounce(t *testing.T) {
+	c := mustNewClient(t)
+	c.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return nil
+	}))
+
+	// A replaced task is no longer waited for by its group.
+	first := c.Add(testTask{Val: "1"}).
+		Group("campaign").
+		Debounce("key", time.Minute).
+		OnGroupComplete(testTask{Val: "callback"})
+	if err := first.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Add(testTask{Val: "2"}).Group("campaign").Debounce("key", time.Minute).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := c.GroupStatus(context.Background(), "campaign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "total", 1, g.Total)
+	testutil.Equal(t, "pending", 1, g.Pending)
+
+	// The group completes if every other task in it has completed.
+	err = c.Add(testTask{Val: "3"}).Debounce("key", time.Minute).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err = c.GroupStatus(context.Background(), "campaign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "total", 0, g.Total)
+	testutil.Equal(t, "done", true, g.Done())
+	testutil.Equal(t, "dependencies", 0, len(getDependencies(t, c)))
+}
+
+func TestTaskAddOp_Group__Empty(t *testing.T) {
+	c := mustNewClient(t)
+	c.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return nil
+	}))
+
+	// A group without tasks completes immediately, releasing the callback.
+	op := c.Add().Group("empty").OnGroupComplete(testTask{Val: "callback"})
+	if err := op.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := c.GroupStatus(context.Background(), "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "total", 0, g.Total)
+	testutil.Equal(t, "done", true, g.Done())
+	testutil.Equal(t, "dependencies", 0, len(getDependencies(t, c)))
+	testutil.Length(t, testutil.GetTasks(t, c.db), 1)
+}
+
+func TestTaskAddOp_Group__CallbackTTL(t *testing.T) {
+	c := mustNewClient(t)
+	c.Register(NewQueue[testTask](func(_ context.Context, _ testTask) error {
+		return nil
+	}))
+	c.Register(NewQueue[testTaskExpiring](func(_ context.Context, _ testTaskExpiring) error {
+		return nil
+	}))
+
+	// The callback is held until the group completes, which may be after the TTL of its queue.
+	err := c.Add(testTask{Val: "1"}).Group("campaign").OnGroupComplete(testTaskExpiring{Val: "callback"}).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 2)
+	testutil.Equal(t, "queue", "test-expiring", got[1].Queue)
+	testutil.Equal(t, "deadline", true, got[1].Deadline == nil)
+}
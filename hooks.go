@@ -0,0 +1,112 @@
+package backlite
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// EventAdded is emitted when a task has been added to a queue.
+	EventAdded EventType = "added"
+
+	// EventClaimed is emitted when a task has been claimed by the dispatcher for execution.
+	EventClaimed EventType = "claimed"
+
+	// EventStarted is emitted when a task processor is about to be executed.
+	EventStarted EventType = "started"
+
+	// EventSucceeded is emitted when a task has been processed successfully.
+	EventSucceeded EventType = "succeeded"
+
+	// EventRetrying is emitted when a task failed but has remaining attempts and will be retried.
+	EventRetrying EventType = "retrying"
+
+	// EventExhausted is emitted when a task failed and has no remaining attempts.
+	EventExhausted EventType = "exhausted"
+
+	// EventCancelled is emitted when the execution of a task was cancelled because the dispatcher was hard-stopped.
+	// The task will be released back to the queue once the ReleaseAfter duration elapses.
+	EventCancelled EventType = "cancelled"
+
+	// EventExpired is emitted when a task was discarded rather than executed because its deadline passed.
+	EventExpired EventType = "expired"
+
+	// EventAbandoned is emitted when a task was discarded rather than executed because a task it depends on failed.
+	EventAbandoned EventType = "abandoned"
+
+	// EventReleased is emitted when a task that was claimed but never completed is released and claimed again.
+	EventReleased EventType = "released"
+)
+
+type (
+	// EventType is the type of task lifecycle event.
+	EventType string
+
+	// Event contains information about a task lifecycle event.
+	Event struct {
+		// Type is the type of event.
+		Type EventType
+
+		// TaskID is the ID of the task.
+		TaskID string
+
+		// Queue is the name of the queue the task belongs to.
+		Queue string
+
+		// Attempt is the execution attempt number, or zero if the task has not yet been executed.
+		Attempt int
+
+		// Duration is the execution duration, if the task has been executed.
+		Duration time.Duration
+
+		// Error is the error returned by the queue processor, if the task failed.
+		Error error
+	}
+
+	// Hook is a callback that receives task lifecycle events.
+	// Hooks are called synchronously, so they should return quickly and never block. Panics are recovered and logged.
+	Hook func(context.Context, Event)
+
+	// hooks stores a registry of hooks.
+	hooks struct {
+		registry []Hook
+		log      Logger
+		sync.RWMutex
+	}
+)
+
+// add adds a hook to the registry.
+func (h *hooks) add(hook Hook) {
+	h.Lock()
+	defer h.Unlock()
+	h.registry = append(h.registry, hook)
+}
+
+// emit sends an event to all registered hooks. The hooks are called without holding the lock, so they can register
+// other hooks, and a hook which panics does not prevent the others from being called.
+func (h *hooks) emit(ctx context.Context, e Event) {
+	h.RLock()
+	registry := h.registry
+	h.RUnlock()
+
+	for _, hook := range registry {
+		h.call(ctx, hook, e)
+	}
+}
+
+// call calls a hook, recovering from any panic so a faulty hook cannot crash the caller, such as a worker.
+func (h *hooks) call(ctx context.Context, hook Hook, e Event) {
+	defer func() {
+		if rec := recover(); rec != nil && h.log != nil {
+			h.log.Error("panic in hook",
+				"type", e.Type,
+				"id", e.TaskID,
+				"queue", e.Queue,
+				"error", rec,
+			)
+		}
+	}()
+
+	hook(ctx, e)
+}
@@ -0,0 +1,224 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+type eventRecorder struct {
+	events []Event
+	sync.Mutex
+}
+
+func (r *eventRecorder) hook(_ context.Context, e Event) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.Lock()
+	defer r.Unlock()
+
+	types := make([]EventType, 0, len(r.events))
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func (r *eventRecorder) assertTypes(t *testing.T, expected ...EventType) {
+	got := r.types()
+	testutil.Length(t, got, len(expected))
+	for i := range got {
+		if i < len(expected) {
+			testutil.Equal(t, "event type", expected[i], got[i])
+		}
+	}
+}
+
+func TestHooks_Emit(t *testing.T) {
+	var h hooks
+	var calls []int
+
+	h.add(func(_ context.Context, e Event) {
+		calls = append(calls, 1)
+		testutil.Equal(t, "type", EventAdded, e.Type)
+	})
+	h.add(func(_ context.Context, e Event) {
+		calls = append(calls, 2)
+	})
+
+	h.emit(context.Background(), Event{Type: EventAdded})
+	testutil.Length(t, calls, 2)
+	testutil.Equal(t, "first", 1, calls[0])
+	testutil.Equal(t, "second", 2, calls[1])
+}
+
+func TestHooks_Emit__Reentrant(t *testing.T) {
+	log := &testLogger{}
+	h := hooks{log: log}
+	var calls int
+
+	// A hook can subscribe another hook, and one which panics does not stop the others.
+	h.add(func(_ context.Context, e Event) {
+		h.add(func(_ context.Context, e Event) {})
+	})
+	h.add(func(_ context.Context, e Event) {
+		panic("oops")
+	})
+	h.add(func(_ context.Context, e Event) {
+		calls++
+	})
+
+	h.emit(context.Background(), Event{Type: EventStarted})
+	testutil.Equal(t, "calls", 1, calls)
+	testutil.Length(t, h.registry, 4)
+	testutil.Length(t, log.errors, 1)
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	r := &eventRecorder{}
+	c.Subscribe(r.hook)
+
+	if err := c.Add(testTask{Val: "a"}, testTask{Val: "b"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.assertTypes(t, EventAdded, EventAdded)
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 2)
+	testutil.Equal(t, "id", got[0].ID, r.events[0].TaskID)
+	testutil.Equal(t, "queue", "test", r.events[0].Queue)
+}
+
+func TestDispatcher_Hooks__Success(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	r := &eventRecorder{}
+	d.client.Subscribe(r.hook)
+
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		return nil
+	}))
+
+	tk := &task.Task{
+		ID:        "1",
+		Queue:     "test",
+		Task:      testutil.Encode(t, &testTask{Val: "1"}),
+		Attempts:  1,
+		CreatedAt: now(),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+
+	d.processTask(tk)
+	r.assertTypes(t, EventStarted, EventSucceeded)
+	testutil.Equal(t, "id", "1", r.events[1].TaskID)
+	testutil.Equal(t, "attempt", 1, r.events[1].Attempt)
+	testutil.Equal(t, "error", nil, r.events[1].Error)
+}
+
+func TestDispatcher_Hooks__Failure(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	r := &eventRecorder{}
+	d.client.Subscribe(r.hook)
+	taskErr := errors.New("failure error")
+
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		return taskErr
+	}))
+
+	tk := &task.Task{
+		ID:        "1",
+		Queue:     "test",
+		Task:      testutil.Encode(t, &testTask{Val: "1"}),
+		Attempts:  1,
+		CreatedAt: now(),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+
+	d.processTask(tk)
+	<-d.ready
+	tk.Attempts++
+	d.processTask(tk)
+
+	r.assertTypes(t, EventStarted, EventRetrying, EventStarted, EventExhausted)
+	testutil.Equal(t, "retrying error", taskErr, r.events[1].Error)
+	testutil.Equal(t, "exhausted error", taskErr, r.events[3].Error)
+	testutil.Equal(t, "exhausted attempt", 2, r.events[3].Attempt)
+}
+
+func TestDispatcher_Hooks__Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = ctx
+	r := &eventRecorder{}
+	d.client.Subscribe(r.hook)
+
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		cancel()
+		return ctx.Err()
+	}))
+
+	tk := &task.Task{
+		ID:        "1",
+		Queue:     "test",
+		Task:      testutil.Encode(t, &testTask{Val: "1"}),
+		Attempts:  1,
+		CreatedAt: now(),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+
+	d.processTask(tk)
+	r.assertTypes(t, EventStarted, EventCancelled)
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 1)
+	testutil.Equal(t, "ready", 0, len(d.ready))
+}
+
+func TestDispatcher_Hooks__Fetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newDispatcher(t)
+	d.ctx = ctx
+	d.ticker = time.NewTicker(time.Hour)
+	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.ready = make(chan struct{}, 1)
+	d.availableWorkers = make(chan struct{}, d.numWorkers)
+	d.availableWorkers <- struct{}{}
+	r := &eventRecorder{}
+	d.client.Subscribe(r.hook)
+
+	testutil.InsertTask(t, d.client.db, &task.Task{
+		ID:        "1",
+		Queue:     "test",
+		Task:      testutil.Encode(t, &testTask{Val: "1"}),
+		CreatedAt: now(),
+	})
+
+	d.fetch()
+	<-d.tasks
+	r.assertTypes(t, EventClaimed)
+	testutil.Equal(t, "attempt", 1, r.events[0].Attempt)
+
+	// Release the claimed task.
+	d.releaseAfter = -time.Hour
+	d.availableWorkers <- struct{}{}
+	d.fetch()
+	<-d.tasks
+	r.assertTypes(t, EventClaimed, EventReleased, EventClaimed)
+	testutil.Equal(t, "attempt", 2, r.events[2].Attempt)
+}
@@ -0,0 +1,235 @@
+package circuit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/drajk/backlite/internal/query"
+)
+
+// The states of a Breaker.
+const (
+	// Closed allows executions.
+	Closed = "closed"
+
+	// Open rejects executions until the cooldown has passed.
+	Open = "open"
+
+	// HalfOpen allows a single probe execution, which determines if the breaker closes or opens again.
+	HalfOpen = "half-open"
+)
+
+type (
+	// Breaker is a circuit breaker which opens after a number of consecutive failed executions within a window,
+	// rejecting executions for a cooldown, after which it half-opens and allows a single probe execution. If the probe
+	// succeeds, the breaker closes, otherwise it opens again.
+	Breaker struct {
+		// Threshold is the number of consecutive failures which opens the breaker.
+		Threshold int
+
+		// Window is the duration within which the consecutive failures must occur. If zero, the failures are counted
+		// regardless of the time between them.
+		Window time.Duration
+
+		// Cooldown is the duration the breaker stays open before half-opening.
+		Cooldown time.Duration
+
+		// State is the state of the breaker.
+		State string
+
+		// Failures is the number of consecutive failures.
+		Failures int
+
+		// Since is the time of the first of the consecutive failures.
+		Since time.Time
+
+		// OpenedAt is the time the breaker last opened.
+		OpenedAt time.Time
+
+		// Probe is the ID of the probe execution while the breaker is half-open.
+		Probe string
+	}
+
+	// State is the stored state of the breaker of a queue. Each process keeps its own breakers, so the state is the
+	// one last stored by the process named.
+	State struct {
+		Queue     string
+		State     string
+		Failures  int
+		OpenedAt  *time.Time
+		UpdatedAt time.Time
+		Process   string
+	}
+)
+
+// New creates a closed Breaker.
+func New(threshold int, window, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		Threshold: threshold,
+		Window:    window,
+		Cooldown:  cooldown,
+		State:     Closed,
+	}
+}
+
+// Allow returns true if an execution with a given ID can start. Once the cooldown has passed, an open breaker
+// half-opens and allows the execution as the probe.
+func (b *Breaker) Allow(id string, at time.Time) bool {
+	switch b.State {
+	case Open:
+		if at.Before(b.Until()) {
+			return false
+		}
+		b.State = HalfOpen
+		b.Probe = id
+		return true
+
+	case HalfOpen:
+		if b.Probe != "" {
+			return false
+		}
+		b.Probe = id
+		return true
+	}
+
+	return true
+}
+
+// Blocked returns true if no executions can start, because the breaker is open and the cooldown has not passed, or
+// it is half-open and the probe is executing.
+func (b *Breaker) Blocked(at time.Time) bool {
+	switch b.State {
+	case Open:
+		return at.Before(b.Until())
+	case HalfOpen:
+		return b.Probe != ""
+	}
+	return false
+}
+
+// Until returns the time an open breaker half-opens.
+func (b *Breaker) Until() time.Time {
+	return b.OpenedAt.Add(b.Cooldown)
+}
+
+// Cancel releases the probe with a given ID, if it did not execute, so another execution can be the probe.
+func (b *Breaker) Cancel(id string) {
+	if b.State == HalfOpen && b.Probe == id {
+		b.Probe = ""
+	}
+}
+
+// Success records a successful execution with a given ID. Only the probe is recorded while half-open.
+func (b *Breaker) Success(id string) {
+	switch b.State {
+	case Closed:
+		b.Failures = 0
+
+	case HalfOpen:
+		if b.Probe == id {
+			b.State = Closed
+			b.Failures = 0
+			b.Probe = ""
+		}
+	}
+}
+
+// Failure records a failed execution with a given ID. Only the probe is recorded while half-open.
+func (b *Breaker) Failure(id string, at time.Time) {
+	switch b.State {
+	case Closed:
+		if b.Failures == 0 || (b.Window > 0 && at.Sub(b.Since) > b.Window) {
+			b.Failures = 0
+			b.Since = at
+		}
+
+		b.Failures++
+		if b.Failures >= b.Threshold {
+			b.State = Open
+			b.OpenedAt = at
+		}
+
+	case HalfOpen:
+		if b.Probe == id {
+			b.State = Open
+			b.OpenedAt = at
+			b.Failures++
+			b.Probe = ""
+		}
+	}
+}
+
+// Save stores the state of the breaker of a given queue in the database, along with the process which stored it.
+func (b *Breaker) Save(ctx context.Context, db *sql.DB, queue, process string, at time.Time) error {
+	var openedAt *int64
+	if !b.OpenedAt.IsZero() {
+		v := b.OpenedAt.UnixMilli()
+		openedAt = &v
+	}
+
+	update := func() (int64, error) {
+		res, err := db.ExecContext(ctx, query.UpdateCircuit, b.State, b.Failures, openedAt, at.UnixMilli(), process, queue)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+
+	if n, err := update(); err != nil || n > 0 {
+		return err
+	}
+
+	// If another process stored the state first, the insert fails and the state is updated again.
+	_, err := db.ExecContext(
+		ctx,
+		query.InsertCircuit,
+		queue,
+		b.State,
+		b.Failures,
+		openedAt,
+		at.UnixMilli(),
+		process,
+	)
+	if err != nil {
+		_, err = update()
+	}
+
+	return err
+}
+
+// GetStates loads the stored states of breakers from the database using a given query and arguments.
+func GetStates(ctx context.Context, db *sql.DB, query string, args ...any) ([]State, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	states := make([]State, 0)
+
+	for rows.Next() {
+		var s State
+		var openedAt *int64
+		var updatedAt int64
+		var process *string
+
+		if err = rows.Scan(&s.Queue, &s.State, &s.Failures, &openedAt, &updatedAt, &process); err != nil {
+			return nil, err
+		}
+
+		if openedAt != nil {
+			v := time.UnixMilli(*openedAt)
+			s.OpenedAt = &v
+		}
+		s.UpdatedAt = time.UnixMilli(updatedAt)
+		if process != nil {
+			s.Process = *process
+		}
+
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
@@ -0,0 +1,105 @@
+package circuit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	at := time.Now()
+	b := New(3, time.Minute, time.Hour)
+	testutil.Equal(t, "state", Closed, b.State)
+
+	// Failures outside the window are not consecutive.
+	b.Failure("1", at)
+	b.Failure("2", at.Add(2*time.Minute))
+	testutil.Equal(t, "window", 1, b.Failures)
+
+	// A success resets the failures.
+	b.Success("3")
+	testutil.Equal(t, "reset", 0, b.Failures)
+
+	for _, id := range []string{"4", "5", "6"} {
+		testutil.Equal(t, "allow", true, b.Allow(id, at))
+		b.Failure(id, at)
+	}
+	testutil.Equal(t, "opened", Open, b.State)
+	testutil.Equal(t, "blocked", true, b.Blocked(at))
+	testutil.Equal(t, "allow open", false, b.Allow("7", at))
+	testutil.Equal(t, "until", at.Add(time.Hour), b.Until())
+
+	// Once the cooldown has passed, a single probe is allowed.
+	at = at.Add(time.Hour)
+	testutil.Equal(t, "cooled down", false, b.Blocked(at))
+	testutil.Equal(t, "probe", true, b.Allow("8", at))
+	testutil.Equal(t, "half-open", HalfOpen, b.State)
+	testutil.Equal(t, "blocked probing", true, b.Blocked(at))
+	testutil.Equal(t, "second probe", false, b.Allow("9", at))
+
+	// A probe which did not execute can be replaced.
+	b.Cancel("8")
+	testutil.Equal(t, "cancelled", false, b.Blocked(at))
+	testutil.Equal(t, "replacement probe", true, b.Allow("9", at))
+
+	// Only the probe is recorded while half-open.
+	b.Failure("6", at)
+	testutil.Equal(t, "other failure", HalfOpen, b.State)
+
+	b.Failure("9", at)
+	testutil.Equal(t, "reopened", Open, b.State)
+	testutil.Equal(t, "reopened until", at.Add(time.Hour), b.Until())
+
+	at = at.Add(time.Hour)
+	testutil.Equal(t, "probe", true, b.Allow("10", at))
+	b.Success("10")
+	testutil.Equal(t, "closed", Closed, b.State)
+	testutil.Equal(t, "failures", 0, b.Failures)
+}
+
+func TestBreaker_Save(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	at := time.UnixMilli(time.Now().UnixMilli())
+	b := New(1, 0, time.Minute)
+
+	if err := b.Save(ctx, db, "a", "host-1:1", at); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Failure("1", at)
+	if err := b.Save(ctx, db, "a", "host-2:2", at.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(1, 0, 0).Save(ctx, db, "b", "host-1:1", at); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := GetStates(ctx, db, `
+		SELECT queue, state, failures, opened_at, updated_at, process
+		FROM backlite_circuits
+		ORDER BY queue
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Length(t, states, 2)
+	testutil.Equal(t, "queue", "a", states[0].Queue)
+	testutil.Equal(t, "state", Open, states[0].State)
+	testutil.Equal(t, "failures", 1, states[0].Failures)
+	testutil.Equal(t, "opened at", at, *states[0].OpenedAt)
+	testutil.Equal(t, "updated at", at.Add(time.Second), states[0].UpdatedAt)
+	testutil.Equal(t, "process", "host-2:2", states[0].Process)
+
+	testutil.Equal(t, "queue", "b", states[1].Queue)
+	testutil.Equal(t, "state", Closed, states[1].State)
+	if states[1].OpenedAt != nil {
+		t.Error("opened at should not be set")
+	}
+}
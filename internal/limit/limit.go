@@ -0,0 +1,215 @@
+package limit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/drajk/backlite/internal/query"
+)
+
+// maxAttempts is the maximum number of attempts to update a shared bucket when other processes update it concurrently.
+const maxAttempts = 5
+
+// ErrConflict is returned when a shared bucket could not be updated due to concurrent updates.
+var ErrConflict = errors.New("rate limit updated concurrently")
+
+// Bucket is a token bucket.
+type Bucket struct {
+	// Rate is the number of tokens added per nanosecond.
+	Rate float64
+
+	// Burst is the maximum number of tokens.
+	Burst float64
+
+	// Tokens is the number of tokens available as of UpdatedAt.
+	Tokens float64
+
+	// UpdatedAt is the last time tokens were added.
+	UpdatedAt time.Time
+}
+
+// NewBucket creates a full bucket which allows a limit of tokens to be taken per interval, and up to burst at once.
+func NewBucket(limit int, interval time.Duration, burst int, at time.Time) Bucket {
+	if burst < 1 {
+		burst = limit
+	}
+
+	return Bucket{
+		Rate:      float64(limit) / float64(interval),
+		Burst:     float64(burst),
+		Tokens:    float64(burst),
+		UpdatedAt: at,
+	}
+}
+
+// Refill adds the tokens accumulated since the bucket was last updated.
+func (b *Bucket) Refill(at time.Time) {
+	if at.After(b.UpdatedAt) {
+		b.Tokens = min(b.Burst, b.Tokens+float64(at.Sub(b.UpdatedAt))*b.Rate)
+		b.UpdatedAt = at
+	}
+}
+
+// Available returns true if a token is available.
+func (b *Bucket) Available(at time.Time) bool {
+	b.Refill(at)
+	return b.Tokens >= 1
+}
+
+// Take takes a token and returns true if one is available.
+func (b *Bucket) Take(at time.Time) bool {
+	if !b.Available(at) {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+// Give returns a token which was taken but not used.
+func (b *Bucket) Give() {
+	b.Tokens = min(b.Burst, b.Tokens+1)
+}
+
+// Next returns the time the next token will be available.
+func (b *Bucket) Next(at time.Time) time.Time {
+	b.Refill(at)
+	if b.Tokens >= 1 {
+		return at
+	}
+	return at.Add(time.Duration((1 - b.Tokens) / b.Rate))
+}
+
+// TakeShared takes a token from a bucket with a given name which is stored in the database and shared by every process
+// using the database. The state of the bucket is updated with optimistic concurrency control. If a token is not
+// available, the time the next token will be available is returned.
+func TakeShared(ctx context.Context, db *sql.DB, name string, b Bucket, at time.Time) (bool, time.Time, error) {
+	var err, insertErr error
+
+	for range maxAttempts {
+		var tokens float64
+		var updatedAt, version int64
+
+		err = db.QueryRowContext(ctx, query.SelectRateLimit, name).Scan(&tokens, &updatedAt, &version)
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// If the bucket still does not exist, the insert did not fail because another process created it.
+			if insertErr != nil {
+				return false, at, insertErr
+			}
+
+			// Start with a full bucket. If another process creates the bucket first, the insert fails and the
+			// bucket is loaded again.
+			ok := b.Take(at)
+			if _, insertErr = db.ExecContext(ctx, query.InsertRateLimit, name, b.Tokens, at.UnixMilli()); insertErr != nil {
+				continue
+			}
+			return ok, b.Next(at), nil
+
+		case err != nil:
+			return false, at, err
+		}
+
+		state := b
+		state.Tokens = tokens
+		state.UpdatedAt = time.UnixMilli(updatedAt)
+
+		if !state.Take(at) {
+			return false, state.Next(at), nil
+		}
+
+		res, err := db.ExecContext(
+			ctx,
+			query.UpdateRateLimit,
+			state.Tokens,
+			state.UpdatedAt.UnixMilli(),
+			name,
+			version,
+		)
+		if err != nil {
+			return false, at, err
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return false, at, err
+		} else if n > 0 {
+			return true, at, nil
+		}
+	}
+
+	if err == nil {
+		err = ErrConflict
+	}
+
+	return false, at, err
+}
+
+// GiveShared returns a token, which was taken but not used, to a bucket with a given name which is stored in the
+// database and shared by every process using the database.
+func GiveShared(ctx context.Context, db *sql.DB, name string, b Bucket, at time.Time) error {
+	for range maxAttempts {
+		var tokens float64
+		var updatedAt, version int64
+
+		err := db.QueryRowContext(ctx, query.SelectRateLimit, name).Scan(&tokens, &updatedAt, &version)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		case err != nil:
+			return err
+		}
+
+		state := b
+		state.Tokens = tokens
+		state.UpdatedAt = time.UnixMilli(updatedAt)
+		state.Refill(at)
+		state.Give()
+
+		res, err := db.ExecContext(
+			ctx,
+			query.UpdateRateLimit,
+			state.Tokens,
+			state.UpdatedAt.UnixMilli(),
+			name,
+			version,
+		)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+	}
+
+	return ErrConflict
+}
+
+// DeleteFull deletes the buckets stored in the database whose name starts with a given prefix and which have refilled
+// to their burst since they were last updated. A bucket which does not exist starts full, so this has no effect on the
+// limit, but stops the buckets of names which are no longer used from accumulating.
+func DeleteFull(ctx context.Context, db *sql.DB, prefix string, b Bucket, at time.Time) (int64, error) {
+	if prefix == "" {
+		return 0, errors.New("prefix is required")
+	}
+
+	// The names with the prefix are those between the prefix and the prefix with its last byte incremented.
+	end := prefix[:len(prefix)-1] + string(rune(prefix[len(prefix)-1]+1))
+
+	res, err := db.ExecContext(
+		ctx,
+		query.DeleteFullRateLimits,
+		prefix,
+		end,
+		at.UnixMilli(),
+		b.Rate*float64(time.Millisecond),
+		b.Burst,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
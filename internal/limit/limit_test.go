@@ -0,0 +1,181 @@
+package limit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Now()
+	b := NewBucket(10, time.Second, 2, start)
+
+	// Burst.
+	testutil.Equal(t, "take 1", true, b.Take(start))
+	testutil.Equal(t, "take 2", true, b.Take(start))
+	testutil.Equal(t, "take 3", false, b.Take(start))
+	testutil.Equal(t, "available", false, b.Available(start))
+	testutil.Equal(t, "next", start.Add(100*time.Millisecond), b.Next(start))
+
+	// Refill.
+	at := start.Add(150 * time.Millisecond)
+	testutil.Equal(t, "refilled", true, b.Take(at))
+	testutil.Equal(t, "partial", false, b.Take(at))
+	testutil.Equal(t, "next partial", at.Add(50*time.Millisecond), b.Next(at))
+
+	// The bucket does not exceed the burst.
+	at = at.Add(time.Hour)
+	testutil.Equal(t, "take 1", true, b.Take(at))
+	testutil.Equal(t, "take 2", true, b.Take(at))
+	testutil.Equal(t, "take 3", false, b.Take(at))
+
+	// The burst defaults to the limit.
+	b = NewBucket(3, time.Second, 0, start)
+	testutil.Equal(t, "default burst", 3.0, b.Burst)
+}
+
+func TestTakeShared(t *testing.T) {
+	ctx := context.Background()
+	dbs := testutil.NewSharedDBs(t, 3)
+	at := time.UnixMilli(time.Now().UnixMilli())
+	b := NewBucket(5, time.Minute, 0, at)
+
+	// Processes taking tokens concurrently should share the bucket.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	taken := 0
+
+	for _, db := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 3 {
+				ok, _, err := TakeShared(ctx, db, "test", b, at)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					mu.Lock()
+					taken++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	testutil.Equal(t, "taken", 5, taken)
+
+	ok, next, err := TakeShared(ctx, dbs[0], "test", b, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "exhausted", false, ok)
+	testutil.Equal(t, "next", at.Add(12*time.Second), next)
+
+	// Tokens are refilled over time.
+	ok, _, err = TakeShared(ctx, dbs[1], "test", b, at.Add(12*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "refilled", true, ok)
+
+	// Buckets are independent by name.
+	ok, _, err = TakeShared(ctx, dbs[2], "other", b, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "other", true, ok)
+}
+
+func TestTakeShared__InsertError(t *testing.T) {
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	// The tokens cannot be stored, so creating the bucket fails for a reason other than another process creating it.
+	b := Bucket{Rate: 1, Burst: math.NaN(), Tokens: math.NaN()}
+	_, _, err := TakeShared(context.Background(), db, "test", b, time.Now())
+	switch {
+	case err == nil:
+		t.Fatal("expected error")
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, ErrConflict):
+		t.Errorf("expected insert error, got %v", err)
+	}
+}
+
+func TestGiveShared(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	at := time.UnixMilli(time.Now().UnixMilli())
+	b := NewBucket(2, time.Hour, 0, at)
+
+	tokens := func() float64 {
+		var v float64
+		if err := db.QueryRow("SELECT tokens FROM backlite_rate_limits WHERE queue = ?", "test").Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// Giving to a bucket which does not exist yet has no effect.
+	if err := GiveShared(ctx, db, "test", b, at); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := TakeShared(ctx, db, "test", b, at); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "tokens", float64(1), tokens())
+
+	// The bucket cannot exceed its burst.
+	for range 2 {
+		if err := GiveShared(ctx, db, "test", b, at); err != nil {
+			t.Fatal(err)
+		}
+		testutil.Equal(t, "tokens", float64(2), tokens())
+	}
+}
+
+func TestDeleteFull(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	at := time.UnixMilli(time.Now().UnixMilli())
+	b := NewBucket(2, time.Hour, 0, at)
+
+	for _, name := range []string{"a#1", "a#2", "a#3", "b#1"} {
+		if _, _, err := TakeShared(ctx, db, name, b, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Return the token of one bucket so it is full again.
+	if err := GiveShared(ctx, db, "a#1", b, at); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := DeleteFull(ctx, db, "a#", b, at)
+	testutil.Equal(t, "error", nil, err)
+	testutil.Equal(t, "deleted", int64(1), n)
+
+	// The buckets refill over time.
+	n, err = DeleteFull(ctx, db, "a#", b, at.Add(time.Hour/2))
+	testutil.Equal(t, "error", nil, err)
+	testutil.Equal(t, "deleted", int64(2), n)
+
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM backlite_rate_limits").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "remaining", 1, count)
+}
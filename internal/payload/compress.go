@@ -0,0 +1,70 @@
+package payload
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+const (
+	// Gzip is the name of the gzip compression algorithm.
+	Gzip = "gzip"
+
+	// Flate is the name of the flate compression algorithm.
+	Flate = "flate"
+)
+
+// Compress compresses data using a given algorithm.
+func Compress(algorithm string, data []byte) ([]byte, error) {
+	var w io.WriteCloser
+	var err error
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+
+	switch algorithm {
+	case Gzip:
+		w = gzip.NewWriter(buf)
+	case Flate:
+		w, err = flate.NewWriter(buf, flate.DefaultCompression)
+	default:
+		err = fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses data that was compressed using a given algorithm.
+func Decompress(algorithm string, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+
+	switch algorithm {
+	case Gzip:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case Flate:
+		r = flate.NewReader(bytes.NewReader(data))
+	default:
+		err = fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
@@ -0,0 +1,38 @@
+package payload
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("backlite"), 100)
+
+	for _, algorithm := range []string{Gzip, Flate} {
+		compressed, err := Compress(algorithm, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(compressed) >= len(data) {
+			t.Errorf("%s: data not compressed", algorithm)
+		}
+
+		got, err := Decompress(algorithm, compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, got) {
+			t.Errorf("%s: decompressed data does not match", algorithm)
+		}
+	}
+
+	if _, err := Compress("zip", data); err == nil {
+		t.Error("expected error, got none")
+	}
+
+	if _, err := Decompress("zip", data); err == nil {
+		t.Error("expected error, got none")
+	}
+}
@@ -0,0 +1,70 @@
+package payload
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// TaskData labels the associated data of encrypted task payloads.
+	TaskData = "task"
+
+	// ResultData labels the associated data of encrypted task results.
+	ResultData = "result"
+)
+
+// AssociatedData returns the additional data that encrypted data of a given label belonging to a task is bound to,
+// so it fails to decrypt if it is moved to another task or queue, or swapped between the payload and the result.
+func AssociatedData(label, id, queue string) []byte {
+	// Each value is prefixed by its length so the values cannot be shifted from one to another.
+	b := make([]byte, 0, len(label)+len(id)+len(queue)+3*binary.MaxVarintLen64)
+	for _, v := range []string{label, queue, id} {
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// Encrypt encrypts data with AES-GCM using the given key, which must be 16, 24 or 32 bytes, and authenticates the
+// given additional data, which must be provided again in order to decrypt it. The random nonce is prepended to the
+// returned ciphertext.
+func Encrypt(key, data, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, additional), nil
+}
+
+// Decrypt decrypts data that was encrypted by Encrypt with the given key and additional data.
+func Decrypt(key, data, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additional)
+}
+
+// newGCM creates an AES-GCM AEAD with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,63 @@
+package payload
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	data := []byte("backlite")
+	ad := AssociatedData(TaskData, "1", "queue")
+
+	encrypted, err := Encrypt(key, data, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(encrypted, data) {
+		t.Error("data not encrypted")
+	}
+
+	again, err := Encrypt(key, data, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(encrypted, again) {
+		t.Error("nonce was reused")
+	}
+
+	got, err := Decrypt(key, encrypted, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, got) {
+		t.Error("decrypted data does not match")
+	}
+
+	if _, err = Decrypt(bytes.Repeat([]byte("x"), 32), encrypted, ad); err == nil {
+		t.Error("expected error decrypting with the wrong key")
+	}
+
+	for name, other := range map[string][]byte{
+		"task":    AssociatedData(TaskData, "2", "queue"),
+		"queue":   AssociatedData(TaskData, "1", "other"),
+		"label":   AssociatedData(ResultData, "1", "queue"),
+		"shifted": AssociatedData(TaskData, "", "queue1"),
+		"none":    nil,
+	} {
+		if _, err = Decrypt(key, encrypted, other); err == nil {
+			t.Errorf("expected error decrypting with different associated data: %s", name)
+		}
+	}
+
+	if _, err = Decrypt(key, encrypted[:5], ad); err == nil {
+		t.Error("expected error decrypting short data")
+	}
+
+	if _, err = Encrypt([]byte("short"), data, ad); err == nil {
+		t.Error("expected error with invalid key size")
+	}
+}
@@ -0,0 +1,120 @@
+package query
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+const selectMigrationVersion = `
+	SELECT COALESCE(MAX(version), 0)
+	FROM backlite_migrations
+`
+
+const insertMigration = `
+	INSERT INTO backlite_migrations
+		(version, applied_at)
+	VALUES (?, ?)
+`
+
+const countMigration = `
+	SELECT COUNT(*)
+	FROM backlite_migrations
+	WHERE version = ?
+`
+
+const deleteMigration = `
+	DELETE FROM backlite_migrations
+	WHERE version = ?
+`
+
+// Migrations returns the schema migrations, in the order they must be applied. The version of each migration is
+// its position in the list, starting at 1.
+func Migrations() []string {
+	entries, err := migrations.ReadDir("migrations")
+	if err != nil {
+		panic(err)
+	}
+
+	// Entries are sorted by file name, which is prefixed by the version.
+	list := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		b, err := migrations.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		list = append(list, string(b))
+	}
+
+	return list
+}
+
+// Statements splits SQL into its individual statements, since not every driver executes multiple statements at once.
+func Statements(sql string) []string {
+	var statements []string
+	for _, stmt := range strings.Split(sql, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// Migrate applies the migrations which have not yet been applied to a database containing the schema, recording
+// the version of each. Each migration is applied in its own transaction, although some databases, such as MySQL,
+// commit schema changes implicitly. Multiple processes can migrate the same database at once, since each migration is
+// only applied by the process which records its version first.
+func Migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(selectMigrationVersion).Scan(&version); err != nil {
+		return fmt.Errorf("unable to load schema version: %w", err)
+	}
+
+	for i, migration := range Migrations() {
+		if i+1 <= version {
+			continue
+		}
+
+		if err := migrate(db, i+1, migration); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// migrate applies a single migration, unless another process has already applied it. The version is recorded before
+// the migration is applied, which claims it, since the primary key prevents another process from recording it too.
+func migrate(db *sql.DB, version int, migration string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(insertMigration, version, time.Now().UnixMilli()); err != nil {
+		// Another process may have applied the migration since the version was loaded.
+		_ = tx.Rollback()
+		var n int
+		if db.QueryRow(countMigration, version).Scan(&n) == nil && n > 0 {
+			return nil
+		}
+		return err
+	}
+
+	for _, stmt := range Statements(migration) {
+		if _, err = tx.Exec(stmt); err != nil {
+			// Remove the version in case a schema change committed it implicitly, so the migration can be applied again.
+			_ = tx.Rollback()
+			_, _ = db.Exec(deleteMigration, version)
+			return fmt.Errorf("%v\nStatement: %s", err, stmt)
+		}
+	}
+
+	return tx.Commit()
+}
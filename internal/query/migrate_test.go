@@ -0,0 +1,47 @@
+package query
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:/%s?vfs=memdb&_timeout=1000", uuid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(Schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// A migration which another process applied after the version was loaded is not applied again.
+	migration := Migrations()[0]
+	for range 2 {
+		if err = migrate(db, 1, migration); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A migration which fails is not recorded.
+	if err = migrate(db, 2, "ALTER TABLE missing ADD COLUMN a TEXT"); err == nil {
+		t.Error("expected error")
+	}
+
+	var versions int
+	if err = db.QueryRow("SELECT COUNT(*) FROM backlite_migrations").Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != 1 {
+		t.Errorf("expected 1 version, got %d", versions)
+	}
+
+	if err = Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+}
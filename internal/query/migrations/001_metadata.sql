@@ -0,0 +1 @@
+ALTER TABLE backlite_tasks ADD COLUMN metadata TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE backlite_tasks ADD COLUMN tags TEXT;
+ALTER TABLE backlite_tasks_completed ADD COLUMN tags TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE backlite_tasks ADD COLUMN codec VARCHAR(255);
+ALTER TABLE backlite_tasks_completed ADD COLUMN codec VARCHAR(255);
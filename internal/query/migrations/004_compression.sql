@@ -0,0 +1,2 @@
+ALTER TABLE backlite_tasks ADD COLUMN compression VARCHAR(32);
+ALTER TABLE backlite_tasks_completed ADD COLUMN compression VARCHAR(32);
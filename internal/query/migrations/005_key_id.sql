@@ -0,0 +1,2 @@
+ALTER TABLE backlite_tasks ADD COLUMN key_id VARCHAR(255);
+ALTER TABLE backlite_tasks_completed ADD COLUMN key_id VARCHAR(255);
@@ -0,0 +1,2 @@
+ALTER TABLE backlite_tasks ADD COLUMN offloaded INT NOT NULL DEFAULT 0;
+ALTER TABLE backlite_tasks_completed ADD COLUMN offloaded INT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE backlite_tasks ADD COLUMN version INT NOT NULL DEFAULT 1;
+ALTER TABLE backlite_tasks_completed ADD COLUMN version INT NOT NULL DEFAULT 1;
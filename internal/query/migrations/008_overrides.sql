@@ -0,0 +1,3 @@
+ALTER TABLE backlite_tasks ADD COLUMN max_attempts INT;
+ALTER TABLE backlite_tasks ADD COLUMN timeout_micro BIGINT;
+ALTER TABLE backlite_tasks ADD COLUMN backoff_micro BIGINT;
@@ -0,0 +1,2 @@
+ALTER TABLE backlite_tasks ADD COLUMN deadline BIGINT;
+ALTER TABLE backlite_tasks_completed ADD COLUMN expired INT NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE backlite_tasks ADD COLUMN debounce_key VARCHAR(255);
@@ -0,0 +1 @@
+ALTER TABLE backlite_tasks ADD COLUMN partition_key VARCHAR(255);
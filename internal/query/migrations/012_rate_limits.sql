@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS backlite_rate_limits (
+    queue VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE NOT NULL,
+    updated_at BIGINT NOT NULL,
+    version BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1 @@
+ALTER TABLE backlite_tasks ADD COLUMN throttle_key VARCHAR(255);
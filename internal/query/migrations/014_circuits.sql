@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS backlite_circuits (
+    queue VARCHAR(255) PRIMARY KEY,
+    state VARCHAR(32) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    opened_at BIGINT,
+    updated_at BIGINT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE backlite_tasks_completed ADD COLUMN result LONGBLOB;
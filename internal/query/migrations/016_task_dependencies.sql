@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS backlite_task_dependencies (
+    task_id VARCHAR(255) NOT NULL,
+    parent_id VARCHAR(255) NOT NULL,
+    run_on_failure INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (task_id, parent_id)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS backlite_workflows (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    created_at BIGINT NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS backlite_workflow_steps (
+    task_id VARCHAR(255) PRIMARY KEY,
+    workflow_id VARCHAR(255) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    stage INT NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    error TEXT,
+    updated_at BIGINT NOT NULL
+);
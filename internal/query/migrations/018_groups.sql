@@ -0,0 +1,10 @@
+ALTER TABLE backlite_tasks ADD COLUMN group_id VARCHAR(255);
+
+CREATE TABLE IF NOT EXISTS backlite_groups (
+    id VARCHAR(255) PRIMARY KEY,
+    total INT NOT NULL,
+    succeeded INT NOT NULL DEFAULT 0,
+    failed INT NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL,
+    completed_at BIGINT
+);
@@ -0,0 +1,3 @@
+ALTER TABLE backlite_workflow_steps ADD COLUMN compensation_task_id VARCHAR(255);
+ALTER TABLE backlite_workflow_steps ADD COLUMN compensation_status VARCHAR(32);
+ALTER TABLE backlite_workflow_steps ADD COLUMN compensation_error TEXT;
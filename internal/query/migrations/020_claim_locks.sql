@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS backlite_claim_locks (
+    queue VARCHAR(255) PRIMARY KEY,
+    claimed_at BIGINT NOT NULL
+);
@@ -0,0 +1 @@
+CREATE INDEX backlite_workflow_steps_workflow_status ON backlite_workflow_steps (workflow_id, status);
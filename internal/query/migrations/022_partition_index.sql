@@ -0,0 +1 @@
+CREATE INDEX backlite_tasks_partition ON backlite_tasks (queue, partition_key, id);
@@ -0,0 +1 @@
+ALTER TABLE backlite_circuits ADD COLUMN process VARCHAR(255);
@@ -11,24 +11,118 @@ var Schema string
 
 const InsertTask = `
 	INSERT INTO backlite_tasks 
-	    (id, created_at, queue, task, wait_until)
-	VALUES (?, ?, ?, ?, ?)
+	    (id, created_at, queue, task, wait_until, metadata, tags, codec, compression, key_id, offloaded, version,
+	     max_attempts, timeout_micro, backoff_micro, deadline, debounce_key, partition_key,
+	     throttle_key, group_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 
-const SelectScheduledTasks = `
+const selectScheduledTasks = `
 	SELECT 
-	    id, queue, task, attempts, wait_until, created_at, last_executed_at, null AS placeholder
+	    id, queue, task, attempts, wait_until, created_at, last_executed_at, claimed_at, metadata, tags, codec,
+	    compression, key_id, offloaded, version, max_attempts, timeout_micro, backoff_micro,
+	    deadline, debounce_key, partition_key, throttle_key, group_id
 	FROM 
 	    backlite_tasks
 	WHERE
-	    claimed_at IS NULL
-		OR claimed_at < ?
+	    (
+	        claimed_at IS NULL
+	        OR claimed_at < ?
+	    )
+		AND (
+		    partition_key IS NULL
+		    OR id = (
+		        SELECT MIN(p.id)
+		        FROM backlite_tasks p
+		        WHERE
+		            p.queue = backlite_tasks.queue
+		            AND p.partition_key = backlite_tasks.partition_key
+		    )
+		)
+		AND NOT EXISTS (
+		    SELECT 1
+		    FROM backlite_task_dependencies d
+		    WHERE d.task_id = backlite_tasks.id
+		)
+		%s
 	ORDER BY
 	    wait_until ASC,
 		id ASC
 	LIMIT ?
 `
 
+func SelectScheduledTasks(excludeQueues, excludeKeys int) string {
+	var cond strings.Builder
+
+	if excludeQueues > 0 {
+		param := strings.Repeat("?,", excludeQueues)
+		fmt.Fprintf(&cond, "AND queue NOT IN (%s)", param[:len(param)-1])
+	}
+
+	excludeThrottleKeys(&cond, excludeKeys)
+
+	return fmt.Sprintf(selectScheduledTasks, cond.String())
+}
+
+func SelectScheduledQueueTasks(excludeKeys int) string {
+	var cond strings.Builder
+	cond.WriteString("AND queue = ?")
+	excludeThrottleKeys(&cond, excludeKeys)
+
+	return fmt.Sprintf(selectScheduledTasks, cond.String())
+}
+
+func excludeThrottleKeys(cond *strings.Builder, keys int) {
+	for range keys {
+		cond.WriteString("\n\t\tAND NOT (queue = ? AND throttle_key IS NOT NULL AND throttle_key = ?)")
+	}
+}
+
+const RescheduleTask = `
+	UPDATE backlite_tasks
+	SET wait_until = ?
+	WHERE
+	    id = ?
+		AND claimed_at IS NULL
+`
+
+const SelectPendingTaskPayload = `
+	SELECT task, offloaded
+	FROM backlite_tasks
+	WHERE
+	    id = ?
+		AND queue = ?
+		AND claimed_at IS NULL
+`
+
+const UpdateTaskPayload = `
+	UPDATE backlite_tasks
+	SET
+	    task = ?,
+	    codec = ?,
+	    compression = ?,
+	    key_id = ?,
+	    offloaded = ?,
+	    version = ?
+	WHERE
+	    id = ?
+		AND queue = ?
+		AND claimed_at IS NULL
+`
+
+const SelectDebouncedTasks = `
+	SELECT
+	    id, queue, task, attempts, wait_until, created_at, last_executed_at, claimed_at, metadata, tags, codec,
+	    compression, key_id, offloaded, version, max_attempts, timeout_micro, backoff_micro,
+	    deadline, debounce_key, partition_key, throttle_key, group_id
+	FROM backlite_tasks
+	WHERE
+	    queue = ?
+		AND debounce_key = ?
+		AND claimed_at IS NULL
+		AND id <> ?
+`
+
 const DeleteTask = `
 	DELETE FROM backlite_tasks
 	WHERE id = ?
@@ -36,8 +130,9 @@ const DeleteTask = `
 
 const InsertCompletedTask = `
 	INSERT INTO backlite_tasks_completed
-		(id, created_at, queue, last_executed_at, attempts, last_duration_micro, succeeded, task, expires_at, error)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		(id, created_at, queue, last_executed_at, attempts, last_duration_micro, succeeded, task, expires_at, error, tags,
+		 codec, compression, key_id, offloaded, version, expired, result)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 
 const TaskFailed = `
@@ -49,6 +144,14 @@ const TaskFailed = `
 	WHERE id = ?
 `
 
+const SelectExpiredCompletedBlobs = `
+	SELECT task FROM backlite_tasks_completed
+	WHERE
+	    offloaded = 1
+		AND expires_at IS NOT NULL
+		AND expires_at <= ?
+`
+
 const DeleteExpiredCompletedTasks = `
 	DELETE FROM backlite_tasks_completed
 	WHERE
@@ -56,16 +159,485 @@ const DeleteExpiredCompletedTasks = `
 		AND expires_at <= ?
 `
 
-func ClaimTasks(count int) string {
+const SelectCompletedTask = `
+	SELECT
+	    id, created_at, queue, last_executed_at, attempts, last_duration_micro, succeeded, task, expires_at, error,
+	    tags, codec, compression, key_id, offloaded, version, expired, result
+	FROM backlite_tasks_completed
+	WHERE
+	    id = ?
+`
+
+const CountTask = `
+	SELECT COUNT(*)
+	FROM backlite_tasks
+	WHERE
+	    id = ?
+`
+
+// ClaimTask returns a query which claims a task. If capped, the task is only claimed as long as the number of running
+// tasks in its queue is below a maximum, and if throttled, as long as the number of running tasks in its queue with
+// the same throttle key is below a maximum. The running tasks are selected through derived tables since MySQL does
+// not allow the target table to be selected directly. Capped claims must be executed in a transaction which holds the
+// claim lock of the queue, see LockClaims, since the running tasks are otherwise counted concurrently on MySQL.
+func ClaimTask(capped, throttled bool) string {
 	const query = `
-		UPDATE backlite_tasks
-		SET
-			claimed_at = ?,
-			attempts = attempts + 1
-		WHERE id IN (%s)
+	UPDATE backlite_tasks
+	SET
+		claimed_at = ?,
+		attempts = attempts + 1
+	WHERE
+	    id = ?
+		AND (
+		    claimed_at IS NULL
+		    OR claimed_at < ?
+		)
+		%s
+		%s
+`
+
+	var capCond, throttleCond string
+
+	if capped {
+		capCond = `AND (
+		    SELECT COUNT(*)
+		    FROM (
+		        SELECT id
+		        FROM backlite_tasks
+		        WHERE
+		            queue = ?
+		            AND claimed_at >= ?
+		    ) AS running
+		) < ?`
+	}
+
+	if throttled {
+		throttleCond = `AND (
+		    SELECT COUNT(*)
+		    FROM (
+		        SELECT id
+		        FROM backlite_tasks
+		        WHERE
+		            queue = ?
+		            AND throttle_key = ?
+		            AND claimed_at >= ?
+		    ) AS throttled
+		) < ?`
+	}
+
+	return fmt.Sprintf(query, capCond, throttleCond)
+}
+
+// LockClaims locks the claims of a queue for the remainder of a transaction.
+const LockClaims = `
+	UPDATE backlite_claim_locks
+	SET claimed_at = ?
+	WHERE queue = ?
+`
+
+const InsertClaimLock = `
+	INSERT INTO backlite_claim_locks
+		(queue, claimed_at)
+	VALUES (?, ?)
+`
+
+const SelectRateLimit = `
+	SELECT tokens, updated_at, version
+	FROM backlite_rate_limits
+	WHERE queue = ?
+`
+
+const InsertRateLimit = `
+	INSERT INTO backlite_rate_limits
+		(queue, tokens, updated_at)
+	VALUES (?, ?, ?)
+`
+
+const DeleteFullRateLimits = `
+	DELETE FROM backlite_rate_limits
+	WHERE
+	    queue > ?
+		AND queue < ?
+		AND tokens + (? - updated_at) * ? >= ?
+`
+
+const UpdateRateLimit = `
+	UPDATE backlite_rate_limits
+	SET
+	    tokens = ?,
+	    updated_at = ?,
+	    version = version + 1
+	WHERE
+	    queue = ?
+		AND version = ?
+`
+
+func CountRunningTasks(queues int) string {
+	const query = `
+		SELECT queue, COUNT(*)
+		FROM backlite_tasks
+		WHERE
+			claimed_at >= ?
+			AND queue IN (%s)
+		GROUP BY queue
 	`
 
-	param := strings.Repeat("?,", count)
+	param := strings.Repeat("?,", queues)
 
 	return fmt.Sprintf(query, param[:len(param)-1])
 }
+
+func CountRunningKeys(queues int) string {
+	const query = `
+		SELECT queue, throttle_key, COUNT(*)
+		FROM backlite_tasks
+		WHERE
+			claimed_at >= ?
+			AND throttle_key IS NOT NULL
+			AND queue IN (%s)
+		GROUP BY queue, throttle_key
+	`
+
+	param := strings.Repeat("?,", queues)
+
+	return fmt.Sprintf(query, param[:len(param)-1])
+}
+
+const UpdateCircuit = `
+	UPDATE backlite_circuits
+	SET
+	    state = ?,
+	    failures = ?,
+	    opened_at = ?,
+	    updated_at = ?,
+	    process = ?
+	WHERE queue = ?
+`
+
+const InsertCircuit = `
+	INSERT INTO backlite_circuits
+		(queue, state, failures, opened_at, updated_at, process)
+	VALUES (?, ?, ?, ?, ?, ?)
+`
+
+const InsertDependency = `
+	INSERT INTO backlite_task_dependencies (task_id, parent_id, run_on_failure)
+	SELECT ?, ?, ?
+	FROM backlite_tasks
+	WHERE id = ?
+`
+
+const ResolveDependencies = `
+	DELETE FROM backlite_task_dependencies
+	WHERE parent_id = ?
+`
+
+const DeleteDependencies = `
+	DELETE FROM backlite_task_dependencies
+	WHERE task_id = ?
+`
+
+const ReplaceParent = `
+	UPDATE backlite_task_dependencies
+	SET parent_id = ?
+	WHERE
+	    parent_id = ?
+		AND task_id <> ?
+		AND task_id NOT IN (
+		    SELECT task_id
+		    FROM (
+		        SELECT task_id
+		        FROM backlite_task_dependencies
+		        WHERE parent_id = ?
+		    ) replaced
+		)
+`
+
+const SelectAbandonedTasks = `
+	SELECT
+	    id, queue, task, attempts, wait_until, created_at, last_executed_at, claimed_at, metadata, tags, codec,
+	    compression, key_id, offloaded, version, max_attempts, timeout_micro, backoff_micro,
+	    deadline, debounce_key, partition_key, throttle_key, group_id
+	FROM
+	    backlite_tasks
+	WHERE
+	    id IN (
+	        SELECT task_id
+	        FROM backlite_task_dependencies
+	        WHERE
+	            parent_id = ?
+	            AND run_on_failure = 0
+	    )
+	ORDER BY
+	    id ASC
+`
+
+func SelectFailedTasks(ids int) string {
+	const query = `
+		SELECT id
+		FROM backlite_tasks_completed
+		WHERE
+			succeeded = 0
+			AND id IN (%s)
+		ORDER BY id ASC
+		LIMIT 1
+	`
+
+	param := strings.Repeat("?,", ids)
+	return fmt.Sprintf(query, param[:len(param)-1])
+}
+
+const InsertWorkflow = `
+	INSERT INTO backlite_workflows
+		(id, name, status, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?)
+`
+
+const InsertWorkflowStep = `
+	INSERT INTO backlite_workflow_steps
+		(task_id, workflow_id, name, stage, status, error, compensation_task_id, compensation_status,
+		 compensation_error, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+const SelectStepWorkflow = `
+	SELECT s.workflow_id, w.status
+	FROM backlite_workflow_steps s
+	INNER JOIN backlite_workflows w ON w.id = s.workflow_id
+	WHERE s.task_id = ?
+`
+
+const CompleteWorkflowStep = `
+	UPDATE backlite_workflow_steps
+	SET
+	    status = ?,
+	    error = ?,
+	    updated_at = ?
+	WHERE
+	    task_id = ?
+`
+
+const SucceedWorkflow = `
+	UPDATE backlite_workflows
+	SET
+	    status = ?,
+	    updated_at = ?
+	WHERE
+	    id = ?
+		AND status = ?
+		AND NOT EXISTS (
+		    SELECT 1
+		    FROM backlite_workflow_steps s
+		    WHERE
+		        s.workflow_id = backlite_workflows.id
+				AND s.status <> ?
+		)
+`
+
+const SelectWaitingCompensations = `
+	SELECT
+	    task_id,
+	    status,
+	    compensation_task_id,
+	    EXISTS (
+	        SELECT 1
+	        FROM backlite_task_dependencies d
+	        WHERE d.task_id = backlite_workflow_steps.task_id
+	    )
+	FROM backlite_workflow_steps
+	WHERE
+	    workflow_id = ?
+		AND compensation_status = ?
+	ORDER BY
+	    stage DESC,
+	    task_id DESC
+`
+
+const SelectFailedCompensations = `
+	SELECT
+	    task_id, workflow_id, name, stage, status, error, compensation_task_id, compensation_status,
+	    compensation_error, updated_at
+	FROM backlite_workflow_steps
+	WHERE
+	    workflow_id = ?
+		AND compensation_status IN (?, ?)
+	ORDER BY
+	    stage DESC,
+	    task_id DESC
+`
+
+const SelectWaitingCompensation = `
+	SELECT compensation_task_id
+	FROM backlite_workflow_steps
+	WHERE
+	    task_id = ?
+		AND compensation_status = ?
+`
+
+const SelectCompensationTail = `
+	SELECT compensation_task_id
+	FROM backlite_workflow_steps s
+	WHERE
+	    s.workflow_id = ?
+		AND s.compensation_status = ?
+		AND NOT EXISTS (
+		    SELECT 1
+		    FROM backlite_task_dependencies d
+		    WHERE d.parent_id = s.compensation_task_id
+		)
+	LIMIT 1
+`
+
+const SelectCompensationWorkflow = `
+	SELECT workflow_id
+	FROM backlite_workflow_steps
+	WHERE compensation_task_id = ?
+`
+
+const UpdateCompensation = `
+	UPDATE backlite_workflow_steps
+	SET
+	    compensation_task_id = ?,
+	    compensation_status = ?,
+	    compensation_error = NULL,
+	    updated_at = ?
+	WHERE
+	    task_id = ?
+`
+
+const CompleteCompensation = `
+	UPDATE backlite_workflow_steps
+	SET
+	    compensation_status = ?,
+	    compensation_error = ?,
+	    updated_at = ?
+	WHERE
+	    compensation_task_id = ?
+`
+
+const SkipCompensations = `
+	UPDATE backlite_workflow_steps
+	SET
+	    compensation_status = ?,
+	    updated_at = ?
+	WHERE
+	    workflow_id = ?
+		AND compensation_status = ?
+		AND EXISTS (
+		    SELECT 1
+		    FROM backlite_task_dependencies d
+		    WHERE
+		        d.task_id = backlite_workflow_steps.compensation_task_id
+				AND d.parent_id = ?
+		)
+`
+
+const UpdateWorkflowStatus = `
+	UPDATE backlite_workflows
+	SET
+	    status = ?,
+	    updated_at = ?
+	WHERE
+	    id = ?
+		AND status = ?
+`
+
+const FinishCompensation = `
+	UPDATE backlite_workflows
+	SET
+	    status = CASE
+	        WHEN EXISTS (
+	            SELECT 1
+	            FROM backlite_workflow_steps s
+	            WHERE
+	                s.workflow_id = backlite_workflows.id
+	                AND s.compensation_status IN (?, ?)
+	        ) THEN ?
+	        ELSE ?
+	    END,
+	    updated_at = ?
+	WHERE
+	    id = ?
+		AND status = ?
+		AND NOT EXISTS (
+		    SELECT 1
+		    FROM backlite_workflow_steps s
+		    WHERE
+		        s.workflow_id = backlite_workflows.id
+				AND s.compensation_status IN (?, ?)
+		)
+`
+
+const InsertGroup = `
+	INSERT INTO backlite_groups
+		(id, total, created_at)
+	VALUES (?, ?, ?)
+`
+
+const GrowGroup = `
+	UPDATE backlite_groups
+	SET total = total + ?
+	WHERE
+	    id = ?
+		AND completed_at IS NULL
+`
+
+const ShrinkGroup = `
+	UPDATE backlite_groups
+	SET total = total - 1
+	WHERE
+	    id = ?
+		AND completed_at IS NULL
+`
+
+const CountGroup = `
+	SELECT COUNT(*)
+	FROM backlite_groups
+	WHERE id = ?
+`
+
+const SelectGroup = `
+	SELECT id, total, succeeded, failed, created_at, completed_at
+	FROM backlite_groups
+	WHERE id = ?
+`
+
+const UpdateGroupProgress = `
+	UPDATE backlite_groups
+	SET
+	    succeeded = succeeded + ?,
+	    failed = failed + ?
+	WHERE
+	    id = ?
+`
+
+const CompleteGroup = `
+	UPDATE backlite_groups
+	SET completed_at = ?
+	WHERE
+	    id = ?
+		AND completed_at IS NULL
+		AND succeeded + failed >= total
+`
+
+const InsertHold = `
+	INSERT INTO backlite_task_dependencies (task_id, parent_id, run_on_failure)
+	VALUES (?, ?, ?)
+`
+
+const ReplaceDependency = `
+	UPDATE backlite_task_dependencies
+	SET
+	    parent_id = ?,
+	    run_on_failure = ?
+	WHERE
+	    task_id = ?
+		AND parent_id = ?
+`
+
+const DeleteDependency = `
+	DELETE FROM backlite_task_dependencies
+	WHERE
+	    task_id = ?
+		AND parent_id = ?
+`
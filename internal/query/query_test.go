@@ -1,18 +1,112 @@
 package query
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
-func TestClaimTasks(t *testing.T) {
-	got := ClaimTasks(3)
+func TestSelectScheduledTasks(t *testing.T) {
+	got := SelectScheduledTasks(0, 0)
+	if strings.Contains(got, "NOT IN") || strings.Contains(got, "%") {
+		t.Errorf("unexpected query:\n%s", got)
+	}
+
+	if !strings.Contains(got, "FROM backlite_task_dependencies") {
+		t.Errorf("expected tasks with dependencies to be excluded, got:\n%s", got)
+	}
+
+	if !strings.Contains(got, "p.queue = backlite_tasks.queue") {
+		t.Errorf("expected partitions to be scoped to their queue, got:\n%s", got)
+	}
+
+	got = SelectScheduledTasks(3, 0)
+	if !strings.Contains(got, "AND queue NOT IN (?,?,?)") {
+		t.Errorf("expected queue exclusion, got:\n%s", got)
+	}
+
+	if strings.Count(got, "?") != 5 {
+		t.Errorf("expected 5 parameters, got:\n%s", got)
+	}
+
+	got = SelectScheduledTasks(0, 2)
+	if strings.Contains(got, "NOT IN") || strings.Count(got, "AND NOT (queue = ? AND") != 2 {
+		t.Errorf("expected key exclusions, got:\n%s", got)
+	}
+
+	if strings.Count(got, "?") != 6 {
+		t.Errorf("expected 6 parameters, got:\n%s", got)
+	}
+}
+
+func TestSelectScheduledQueueTasks(t *testing.T) {
+	got := SelectScheduledQueueTasks(1)
+	if !strings.Contains(got, "AND queue = ?") || strings.Contains(got, "NOT IN") {
+		t.Errorf("expected queue condition, got:\n%s", got)
+	}
+
+	if strings.Count(got, "?") != 5 {
+		t.Errorf("expected 5 parameters, got:\n%s", got)
+	}
+}
+
+func TestClaimTask(t *testing.T) {
+	for _, c := range []struct {
+		capped, throttled bool
+		params            int
+	}{
+		{false, false, 3},
+		{true, false, 6},
+		{false, true, 7},
+		{true, true, 10},
+	} {
+		got := ClaimTask(c.capped, c.throttled)
+		if n := strings.Count(got, "?"); n != c.params {
+			t.Errorf("expected %d parameters for capped=%v throttled=%v, got %d:\n%s",
+				c.params, c.capped, c.throttled, n, got)
+		}
+		if strings.Contains(got, "%") {
+			t.Errorf("unexpected query:\n%s", got)
+		}
+	}
+}
+
+func TestClaimTask__Unguarded(t *testing.T) {
+	got := ClaimTask(false, false)
 	expected := `
 		UPDATE backlite_tasks
 		SET
 			claimed_at = ?,
 			attempts = attempts + 1
-		WHERE id IN (?,?,?)
+		WHERE
+			id = ?
+			AND (
+				claimed_at IS NULL
+				OR claimed_at < ?
+			)
 	`
 
-	if got != expected {
+	if strings.Join(strings.Fields(got), " ") != strings.Join(strings.Fields(expected), " ") {
 		t.Errorf("expected\n%s\n,got:\n%s", expected, got)
 	}
 }
+
+func TestCountRunningTasks(t *testing.T) {
+	got := CountRunningTasks(2)
+	if !strings.Contains(got, "queue IN (?,?)") {
+		t.Errorf("expected queue parameters, got:\n%s", got)
+	}
+}
+
+func TestCountRunningKeys(t *testing.T) {
+	got := CountRunningKeys(3)
+	if !strings.Contains(got, "queue IN (?,?,?)") || !strings.Contains(got, "GROUP BY queue, throttle_key") {
+		t.Errorf("unexpected query:\n%s", got)
+	}
+}
+
+func TestSelectFailedTasks(t *testing.T) {
+	got := SelectFailedTasks(2)
+	if !strings.Contains(got, "id IN (?,?)") {
+		t.Errorf("expected id parameters, got:\n%s", got)
+	}
+}
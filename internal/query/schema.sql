@@ -21,3 +21,8 @@ CREATE TABLE IF NOT EXISTS backlite_tasks_completed (
     expires_at BIGINT,
     error TEXT
 );
+
+CREATE TABLE IF NOT EXISTS backlite_migrations (
+    version INT PRIMARY KEY,
+    applied_at BIGINT NOT NULL
+);
@@ -3,6 +3,7 @@ package task
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/drajk/backlite/internal/query"
@@ -41,6 +42,30 @@ type (
 
 		// Error is the error message provided by the Task processor.
 		Error *string
+
+		// Tags are arbitrary key/value pairs used to identify and filter tasks.
+		Tags map[string]string
+
+		// Codec is the name of the codec the task data was encoded with.
+		Codec string
+
+		// Compression is the name of the algorithm the task data was compressed with, if compressed.
+		Compression string
+
+		// KeyID is the ID of the key the task data was encrypted with, if encrypted.
+		KeyID string
+
+		// Offloaded indicates if the task data was stored in a BlobStore, in which case Task contains the blob key.
+		Offloaded bool
+
+		// Version is the version of the task payload, which determines the upgrades required before it can be decoded.
+		Version int
+
+		// Expired indicates if the Task expired before it was executed.
+		Expired bool
+
+		// Result is the encoded value returned by the Task processor, if the queue returns results.
+		Result []byte
 	}
 
 	// CompletedTasks contains multiple completed tasks.
@@ -55,7 +80,12 @@ func (c *Completed) InsertTx(ctx context.Context, tx *sql.Tx) error {
 		expiresAt = &v
 	}
 
-	_, err := tx.ExecContext(
+	tags, err := encodeMap(c.Tags)
+	if err != nil {
+		return fmt.Errorf("unable to encode task tags: %w", err)
+	}
+
+	_, err = tx.ExecContext(
 		ctx,
 		query.InsertCompletedTask,
 		c.ID,
@@ -68,6 +98,14 @@ func (c *Completed) InsertTx(ctx context.Context, tx *sql.Tx) error {
 		c.Task,
 		expiresAt,
 		c.Error,
+		tags,
+		nullString(c.Codec),
+		nullString(c.Compression),
+		nullString(c.KeyID),
+		c.Offloaded,
+		c.Version,
+		c.Expired,
+		c.Result,
 	)
 	return err
 }
@@ -87,6 +125,7 @@ func GetCompletedTasks(ctx context.Context, db *sql.DB, query string, args ...an
 		var task Completed
 		var lastExecutedAt, createdAt int64
 		var expiresAt *int64
+		var tags, codec, compression, keyID *string
 
 		err = rows.Scan(
 			&task.ID,
@@ -99,6 +138,14 @@ func GetCompletedTasks(ctx context.Context, db *sql.DB, query string, args ...an
 			&task.Task,
 			&expiresAt,
 			&task.Error,
+			&tags,
+			&codec,
+			&compression,
+			&keyID,
+			&task.Offloaded,
+			&task.Version,
+			&task.Expired,
+			&task.Result,
 		)
 
 		if err != nil {
@@ -113,6 +160,22 @@ func GetCompletedTasks(ctx context.Context, db *sql.DB, query string, args ...an
 			task.ExpiresAt = &v
 		}
 
+		if task.Tags, err = decodeMap(tags); err != nil {
+			return nil, err
+		}
+
+		if codec != nil {
+			task.Codec = *codec
+		}
+
+		if compression != nil {
+			task.Compression = *compression
+		}
+
+		if keyID != nil {
+			task.KeyID = *keyID
+		}
+
 		tasks = append(tasks, &task)
 	}
 
@@ -123,12 +186,60 @@ func GetCompletedTasks(ctx context.Context, db *sql.DB, query string, args ...an
 	return tasks, nil
 }
 
-// DeleteExpiredCompleted deletes completed tasks that have an expiration date in the past.
-func DeleteExpiredCompleted(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(
-		ctx,
-		query.DeleteExpiredCompletedTasks,
-		time.Now().UnixMilli(),
-	)
-	return err
+// GetCompleted loads a completed task by ID. Nil is returned if no such completed task exists.
+func GetCompleted(ctx context.Context, db *sql.DB, id string) (*Completed, error) {
+	tasks, err := GetCompletedTasks(ctx, db, query.SelectCompletedTask, id)
+	if err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+
+	return tasks[0], nil
+}
+
+// DeleteExpiredCompleted deletes completed tasks that have an expiration date in the past and returns the blob keys
+// of any deleted task data that was offloaded, so the blobs can be deleted.
+func DeleteExpiredCompleted(ctx context.Context, db *sql.DB) ([]string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	ts := time.Now().UnixMilli()
+
+	rows, err := tx.QueryContext(ctx, query.SelectExpiredCompletedBlobs, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key []byte
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(key))
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The rows must be closed before the connection can be used again.
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, query.DeleteExpiredCompletedTasks, ts); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
 }
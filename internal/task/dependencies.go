@@ -0,0 +1,80 @@
+package task
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/drajk/backlite/internal/query"
+)
+
+// ResolveDependenciesTx removes the dependencies on a task which succeeded, as part of a database transaction, so the
+// tasks which depend on it can be executed once their other parents have succeeded. The number of dependencies which
+// were removed is returned.
+func ResolveDependenciesTx(ctx context.Context, tx *sql.Tx, id string) (int64, error) {
+	res, err := tx.ExecContext(ctx, query.ResolveDependencies, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// HoldTx holds a task until a given parent, which does not have to be a task, is resolved, as part of a database
+// transaction. Whether the task runs if the parent fails is also provided.
+func HoldTx(ctx context.Context, tx *sql.Tx, id, parent string, runOnFailure bool) error {
+	_, err := tx.ExecContext(ctx, query.InsertHold, id, parent, runOnFailure)
+	return err
+}
+
+// ReplaceDependencyTx replaces the parent a task depends on with another, as part of a database transaction.
+func ReplaceDependencyTx(ctx context.Context, tx *sql.Tx, id, parent, replacement string, runOnFailure bool) error {
+	_, err := tx.ExecContext(ctx, query.ReplaceDependency, replacement, runOnFailure, id, parent)
+	return err
+}
+
+// RemoveDependencyTx removes the dependency of a task on a given parent, as part of a database transaction.
+func RemoveDependencyTx(ctx context.Context, tx *sql.Tx, id, parent string) error {
+	_, err := tx.ExecContext(ctx, query.DeleteDependency, id, parent)
+	return err
+}
+
+// AbandonDependentsTx resolves the dependencies on a task which failed, as part of a database transaction. The tasks
+// which should not run when a parent fails are deleted and returned, while the dependencies of those which should
+// are removed, and the number of them is returned.
+func AbandonDependentsTx(ctx context.Context, tx *sql.Tx, id string) (Tasks, int64, error) {
+	abandoned, err := GetTasks(ctx, tx, query.SelectAbandonedTasks, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, t := range abandoned {
+		if err = t.DeleteTx(ctx, tx); err != nil {
+			return nil, 0, err
+		}
+
+		if _, err = tx.ExecContext(ctx, query.DeleteDependencies, t.ID); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	released, err := ResolveDependenciesTx(ctx, tx, id)
+	return abandoned, released, err
+}
+
+// GetFailedParentTx returns the ID of the first of the given tasks which completed without succeeding, as part of a
+// database transaction. An empty string is returned if none of them failed, or if they were not retained.
+func GetFailedParentTx(ctx context.Context, tx *sql.Tx, ids []string) (string, error) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	var id string
+	err := tx.QueryRowContext(ctx, query.SelectFailedTasks(len(ids)), args...).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return id, err
+}
@@ -0,0 +1,125 @@
+package task
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/drajk/backlite/internal/query"
+)
+
+// Group is the progress of a group of tasks.
+type Group struct {
+	// ID is the ID of the group.
+	ID string
+
+	// Total is the number of tasks in the group.
+	Total int
+
+	// Succeeded is the number of tasks in the group which succeeded.
+	Succeeded int
+
+	// Failed is the number of tasks in the group which completed without succeeding.
+	Failed int
+
+	// CreatedAt is when the group was created.
+	CreatedAt time.Time
+
+	// CompletedAt is when every task in the group completed, if they have.
+	CompletedAt *time.Time
+}
+
+// AddToGroupTx adds a number of tasks to a group, creating the group if it does not exist, as part of a database
+// transaction. False is returned if the group has already completed, in which case nothing can be added to it.
+func AddToGroupTx(ctx context.Context, tx *sql.Tx, id string, tasks int, at time.Time) (bool, error) {
+	res, err := tx.ExecContext(ctx, query.GrowGroup, tasks, id)
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return n > 0, err
+	}
+
+	// The group either does not exist or has completed.
+	var exists int
+	err = tx.QueryRowContext(ctx, query.CountGroup, id).Scan(&exists)
+	if err != nil || exists > 0 {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, query.InsertGroup, id, tasks, at.UnixMilli())
+	return err == nil, err
+}
+
+// CompleteGroupTaskTx records the outcome of a task in a group, as part of a database transaction. If that was the
+// last task in the group to complete, the group is marked as completed, and the tasks which were held until then are
+// released. Whether the group completed is returned.
+func CompleteGroupTaskTx(ctx context.Context, tx *sql.Tx, id string, succeeded bool, at time.Time) (bool, error) {
+	var s, f int
+	if succeeded {
+		s = 1
+	} else {
+		f = 1
+	}
+
+	if _, err := tx.ExecContext(ctx, query.UpdateGroupProgress, s, f, id); err != nil {
+		return false, err
+	}
+
+	return CompleteGroupTx(ctx, tx, id, at)
+}
+
+// RemoveFromGroupTx removes a task which was deleted without completing, such as a debounced task which was replaced,
+// from a group, as part of a database transaction. If every other task in the group has completed, the group is
+// marked as completed, and the tasks which were held until then are released. Whether the group completed is returned.
+func RemoveFromGroupTx(ctx context.Context, tx *sql.Tx, id string, at time.Time) (bool, error) {
+	if _, err := tx.ExecContext(ctx, query.ShrinkGroup, id); err != nil {
+		return false, err
+	}
+
+	return CompleteGroupTx(ctx, tx, id, at)
+}
+
+// CompleteGroupTx marks a group as completed if every task in it has completed, such as a group without tasks, and
+// releases the tasks which were held until then, as part of a database transaction. Whether the group completed is
+// returned.
+func CompleteGroupTx(ctx context.Context, tx *sql.Tx, id string, at time.Time) (bool, error) {
+	res, err := tx.ExecContext(ctx, query.CompleteGroup, at.UnixMilli(), id)
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = ResolveDependenciesTx(ctx, tx, id)
+	return err == nil, err
+}
+
+// GetGroup loads the progress of a group. Nil is returned if no such group exists.
+func GetGroup(ctx context.Context, db *sql.DB, id string) (*Group, error) {
+	var g Group
+	var createdAt int64
+	var completedAt *int64
+
+	err := db.QueryRowContext(ctx, query.SelectGroup, id).
+		Scan(&g.ID, &g.Total, &g.Succeeded, &g.Failed, &createdAt, &completedAt)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	g.CreatedAt = time.UnixMilli(createdAt)
+	if completedAt != nil {
+		v := time.UnixMilli(*completedAt)
+		g.CompletedAt = &v
+	}
+
+	return &g, nil
+}
@@ -3,6 +3,8 @@ package task
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -35,6 +37,62 @@ type Task struct {
 
 	// ClaimedAt is the time this Task was claimed for execution.
 	ClaimedAt *time.Time
+
+	// Metadata is propagation metadata, such as trace context, captured when the Task was created.
+	Metadata map[string]string
+
+	// Tags are arbitrary key/value pairs used to identify and filter tasks.
+	Tags map[string]string
+
+	// Codec is the name of the codec the task data was encoded with.
+	Codec string
+
+	// Compression is the name of the algorithm the task data was compressed with, if compressed.
+	Compression string
+
+	// KeyID is the ID of the key the task data was encrypted with, if encrypted.
+	KeyID string
+
+	// Offloaded indicates if the task data was stored in a BlobStore, in which case Task contains the blob key.
+	Offloaded bool
+
+	// Version is the version of the task payload, which determines the upgrades required before it can be decoded.
+	Version int
+
+	// MaxAttempts overrides the maximum number of attempts of the queue, if set.
+	MaxAttempts *int
+
+	// Timeout overrides the execution timeout of the queue, if set.
+	Timeout *time.Duration
+
+	// Backoff overrides the retry backoff of the queue, if set.
+	Backoff *time.Duration
+
+	// Deadline is the time before which the Task must start executing, after which it expires.
+	Deadline *time.Time
+
+	// DebounceKey is the key used to replace this Task, if it has not been claimed, when another Task is added to the
+	// same queue with the same key.
+	DebounceKey string
+
+	// PartitionKey is the key of the partition, within its queue, this Task belongs to. Tasks within a partition are
+	// executed one at a time in the order they were added.
+	PartitionKey string
+
+	// ThrottleKey is the key, such as a customer ID, used to bound the throughput of the tasks in the queue which
+	// share it.
+	ThrottleKey string
+
+	// GroupID is the ID of the group the Task belongs to, if any, whose progress is updated when the Task completes.
+	GroupID string
+
+	// Parents are the IDs of the tasks which must complete before this Task is executed. These are only stored when
+	// the Task is inserted, and only for parents which have not yet completed.
+	Parents []string
+
+	// RunOnParentFailure indicates if this Task should be executed once its parents complete even if they failed,
+	// rather than being abandoned.
+	RunOnParentFailure bool
 }
 
 // InsertTx inserts a task as part of a database transaction.
@@ -53,13 +111,28 @@ func (t *Task) InsertTx(ctx context.Context, tx *sql.Tx) error {
 		t.CreatedAt = time.Now()
 	}
 
-	var wait *int64
+	var wait, deadline *int64
 	if t.WaitUntil != nil {
 		v := t.WaitUntil.UnixMilli()
 		wait = &v
 	}
 
-	_, err := tx.ExecContext(
+	if t.Deadline != nil {
+		v := t.Deadline.UnixMilli()
+		deadline = &v
+	}
+
+	metadata, err := encodeMap(t.Metadata)
+	if err != nil {
+		return fmt.Errorf("unable to encode task metadata: %w", err)
+	}
+
+	tags, err := encodeMap(t.Tags)
+	if err != nil {
+		return fmt.Errorf("unable to encode task tags: %w", err)
+	}
+
+	_, err = tx.ExecContext(
 		ctx,
 		query.InsertTask,
 		t.ID,
@@ -67,9 +140,88 @@ func (t *Task) InsertTx(ctx context.Context, tx *sql.Tx) error {
 		t.Queue,
 		t.Task,
 		wait,
+		metadata,
+		tags,
+		nullString(t.Codec),
+		nullString(t.Compression),
+		nullString(t.KeyID),
+		t.Offloaded,
+		t.Version,
+		t.MaxAttempts,
+		microseconds(t.Timeout),
+		microseconds(t.Backoff),
+		deadline,
+		nullString(t.DebounceKey),
+		nullString(t.PartitionKey),
+		nullString(t.ThrottleKey),
+		nullString(t.GroupID),
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	for _, parent := range t.Parents {
+		_, err = tx.ExecContext(ctx, query.InsertDependency, t.ID, parent, t.RunOnParentFailure, parent)
+		if err != nil {
+			return fmt.Errorf("unable to insert task dependency: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ReplaceDebouncedTx deletes the other tasks in the queue of the task with the same debounce key, which have not been
+// claimed, as part of a database transaction, so that the task, which must already be inserted, replaces them. The
+// tasks which depend on the deleted tasks depend on the task instead. The deleted tasks are returned.
+func (t *Task) ReplaceDebouncedTx(ctx context.Context, tx *sql.Tx) (Tasks, error) {
+	replaced, err := GetTasks(ctx, tx, query.SelectDebouncedTasks, t.Queue, t.DebounceKey, t.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range replaced {
+		if err = r.DeleteTx(ctx, tx); err != nil {
+			return nil, err
+		}
+
+		if _, err = tx.ExecContext(ctx, query.DeleteDependencies, r.ID); err != nil {
+			return nil, err
+		}
+
+		// Dependants which already depend on the task, or the task itself, no longer need the replaced task.
+		if _, err = tx.ExecContext(ctx, query.ReplaceParent, t.ID, r.ID, t.ID, t.ID); err != nil {
+			return nil, err
+		}
+
+		if _, err = tx.ExecContext(ctx, query.ResolveDependencies, r.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return replaced, nil
+}
+
+// UpdatePayloadTx replaces the data of a task, as long as it has not been claimed, as part of a database transaction
+// and returns whether the task was updated.
+func (t *Task) UpdatePayloadTx(ctx context.Context, tx *sql.Tx) (bool, error) {
+	res, err := tx.ExecContext(
+		ctx,
+		query.UpdateTaskPayload,
+		t.Task,
+		nullString(t.Codec),
+		nullString(t.Compression),
+		nullString(t.KeyID),
+		t.Offloaded,
+		t.Version,
+		t.ID,
+		t.Queue,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
 // DeleteTx deletes a task as part of a database transaction.
@@ -89,3 +241,84 @@ func (t *Task) Fail(ctx context.Context, db *sql.DB, waitUntil time.Time) error
 	)
 	return err
 }
+
+// Reschedule updates the time a task should not be executed until, as long as it has not been claimed, and returns
+// whether the task was updated.
+func Reschedule(ctx context.Context, db *sql.DB, id string, waitUntil time.Time) (bool, error) {
+	res, err := db.ExecContext(ctx, query.RescheduleTask, waitUntil.UnixMilli(), id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Exists determines if a task which has not completed exists.
+func Exists(ctx context.Context, db *sql.DB, id string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, query.CountTask, id).Scan(&n)
+	return n > 0, err
+}
+
+// GetPendingPayloadTx loads the data of a task in a given queue which has not been claimed, as part of a database
+// transaction. Nil is returned if no such task exists.
+func GetPendingPayloadTx(ctx context.Context, tx *sql.Tx, id, queue string) (*Task, error) {
+	t := Task{ID: id, Queue: queue}
+
+	err := tx.QueryRowContext(ctx, query.SelectPendingTaskPayload, id, queue).Scan(&t.Task, &t.Offloaded)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// encodeMap encodes a map as JSON for storage, or returns nil if the map is empty.
+func encodeMap(m map[string]string) (*string, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	v := string(b)
+	return &v, nil
+}
+
+// decodeMap decodes a map stored as JSON.
+func decodeMap(v *string) (map[string]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal([]byte(*v), &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// nullString returns nil if the string is empty so it can be stored as NULL.
+func nullString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return &v
+}
+
+// microseconds returns a duration in microseconds for storage, or nil if the duration is not set.
+func microseconds(d *time.Duration) *int64 {
+	if d == nil {
+		return nil
+	}
+	v := d.Microseconds()
+	return &v
+}
@@ -8,33 +8,131 @@ import (
 	"github.com/drajk/backlite/internal/query"
 )
 
-// Tasks are a slice of tasks.
-type Tasks []*Task
+// maxExcludedKeys is the maximum number of throttle keys excluded when loading tasks, which bounds the size of the
+// query. Tasks with the remaining keys are loaded, and their limits are checked by the dispatcher once loaded.
+const maxExcludedKeys = 200
 
-// Claim updates a Task in the database to indicate that it has been claimed by a processor to be executed.
-func (t Tasks) Claim(ctx context.Context, db *sql.DB) error {
-	if len(t) == 0 {
-		return nil
+type (
+	// Tasks are a slice of tasks.
+	Tasks []*Task
+
+	// querier executes queries against a database or as part of a database transaction.
+	querier interface {
+		QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	}
+
+	// execer executes statements against a database or as part of a database transaction.
+	execer interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	}
+
+	// Throttled identifies the tasks in a queue with a given throttle key.
+	Throttled struct {
+		Queue string
+		Key   string
+	}
+
+	// Exclusions are the queues, and throttle keys within queues, whose tasks should not be loaded.
+	Exclusions struct {
+		Queues []string
+		Keys   []Throttled
 	}
 
-	params := make([]any, 0, len(t)+1)
-	params = append(params, time.Now().UnixMilli())
+	// Caps are the maximum number of tasks which can run at once.
+	Caps struct {
+		// Queues are the maximum number of running tasks in each queue, keyed by queue.
+		Queues map[string]int
+
+		// Keys are the maximum number of running tasks with the same throttle key in each queue, keyed by queue.
+		Keys map[string]int
+	}
+)
+
+// Claim updates the Tasks in the database to indicate that they have been claimed by a processor to be executed and
+// returns the Tasks that were claimed. Tasks are only claimed if they have not been claimed by another processor since
+// they were loaded, unless that claim is older than the given deadline, which ensures that a Task is only executed
+// once when multiple processors share the database. Tasks are also not claimed if their queue, or their throttle key
+// within their queue, is at its cap of running tasks, which are those claimed after the deadline.
+func (t Tasks) Claim(ctx context.Context, db *sql.DB, deadline time.Time, caps Caps) (Tasks, error) {
+	claimed := make(Tasks, 0, len(t))
+	ts := time.Now().UnixMilli()
 
 	for _, task := range t {
-		params = append(params, task.ID)
+		params := []any{ts, task.ID, deadline.UnixMilli()}
+
+		queueCap, capped := caps.Queues[task.Queue]
+		if capped {
+			params = append(params, task.Queue, deadline.UnixMilli(), queueCap)
+		}
+
+		keyCap, throttled := caps.Keys[task.Queue]
+		throttled = throttled && task.ThrottleKey != ""
+		if throttled {
+			params = append(params, task.Queue, task.ThrottleKey, deadline.UnixMilli(), keyCap)
+		}
+
+		var ok bool
+		var err error
+		if capped || throttled {
+			ok, err = claimLocked(ctx, db, task.Queue, ts, query.ClaimTask(capped, throttled), params)
+		} else {
+			ok, err = claim(ctx, db, query.ClaimTask(false, false), params)
+		}
+
+		if err != nil {
+			return claimed, err
+		}
+
+		if ok {
+			claimed = append(claimed, task)
+		}
 	}
 
-	_, err := db.ExecContext(
-		ctx,
-		query.ClaimTasks(len(t)),
-		params...,
-	)
+	return claimed, nil
+}
+
+// claim executes a query which claims a task and returns whether the task was claimed.
+func claim(ctx context.Context, db execer, q string, params []any) (bool, error) {
+	res, err := db.ExecContext(ctx, q, params...)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// claimLocked executes a query which claims a task, in a transaction holding the claim lock of the queue of the task,
+// so that concurrent claims cannot count the same running tasks and exceed the caps of the queue. If another process
+// creates the lock of the queue first, an error is returned, which only happens for the first claims of the queue.
+func claimLocked(ctx context.Context, db *sql.DB, queue string, ts int64, q string, params []any) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
 
-	return err
+	locked, err := claim(ctx, tx, query.LockClaims, []any{ts, queue})
+	if err != nil {
+		return false, err
+	}
+
+	if !locked {
+		if _, err = tx.ExecContext(ctx, query.InsertClaimLock, queue, ts); err != nil {
+			return false, err
+		}
+	}
+
+	ok, err := claim(ctx, tx, q, params)
+	if err != nil {
+		return false, err
+	}
+
+	return ok, tx.Commit()
 }
 
-// GetTasks loads tasks from the database using a given query and arguments.
-func GetTasks(ctx context.Context, db *sql.DB, query string, args ...any) (Tasks, error) {
+// GetTasks loads tasks from the database, or as part of a database transaction, using a given query and arguments.
+func GetTasks(ctx context.Context, db querier, query string, args ...any) (Tasks, error) {
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
@@ -52,10 +150,20 @@ func GetTasks(ctx context.Context, db *sql.DB, query string, args ...any) (Tasks
 		return &v
 	}
 
+	toDuration := func(micro *int64) *time.Duration {
+		if micro == nil {
+			return nil
+		}
+		v := time.Duration(*micro) * time.Microsecond
+		return &v
+	}
+
 	for rows.Next() {
 		var task Task
 		var createdAt int64
-		var waitUntil, lastExecutedAt, claimedAt *int64
+		var waitUntil, lastExecutedAt, claimedAt, deadline *int64
+		var metadata, tags, codec, compression, keyID, debounceKey, partitionKey, throttleKey, groupID *string
+		var timeout, backoff *int64
 
 		err = rows.Scan(
 			&task.ID,
@@ -66,6 +174,21 @@ func GetTasks(ctx context.Context, db *sql.DB, query string, args ...any) (Tasks
 			&createdAt,
 			&lastExecutedAt,
 			&claimedAt,
+			&metadata,
+			&tags,
+			&codec,
+			&compression,
+			&keyID,
+			&task.Offloaded,
+			&task.Version,
+			&task.MaxAttempts,
+			&timeout,
+			&backoff,
+			&deadline,
+			&debounceKey,
+			&partitionKey,
+			&throttleKey,
+			&groupID,
 		)
 
 		if err != nil {
@@ -76,6 +199,45 @@ func GetTasks(ctx context.Context, db *sql.DB, query string, args ...any) (Tasks
 		task.WaitUntil = toTime(waitUntil)
 		task.LastExecutedAt = toTime(lastExecutedAt)
 		task.ClaimedAt = toTime(claimedAt)
+		task.Timeout = toDuration(timeout)
+		task.Backoff = toDuration(backoff)
+		task.Deadline = toTime(deadline)
+
+		if task.Metadata, err = decodeMap(metadata); err != nil {
+			return nil, err
+		}
+
+		if task.Tags, err = decodeMap(tags); err != nil {
+			return nil, err
+		}
+
+		if codec != nil {
+			task.Codec = *codec
+		}
+
+		if compression != nil {
+			task.Compression = *compression
+		}
+
+		if keyID != nil {
+			task.KeyID = *keyID
+		}
+
+		if debounceKey != nil {
+			task.DebounceKey = *debounceKey
+		}
+
+		if partitionKey != nil {
+			task.PartitionKey = *partitionKey
+		}
+
+		if throttleKey != nil {
+			task.ThrottleKey = *throttleKey
+		}
+
+		if groupID != nil {
+			task.GroupID = *groupID
+		}
 
 		tasks = append(tasks, &task)
 	}
@@ -90,12 +252,129 @@ func GetTasks(ctx context.Context, db *sql.DB, query string, args ...any) (Tasks
 // GetScheduledTasks loads the tasks that are next up to be executed in order of execution time.
 // It's important to note that this does not filter out tasks that are not yet ready based on their wait time.
 // The deadline provided is used to include tasks that have been claimed if that given amount of time has elapsed.
-func GetScheduledTasks(ctx context.Context, db *sql.DB, deadline time.Time, limit int) (Tasks, error) {
+// Tasks in the excluded queues, or with the excluded throttle keys, are not loaded, although at most maxExcludedKeys
+// throttle keys are excluded.
+func GetScheduledTasks(
+	ctx context.Context,
+	db *sql.DB,
+	deadline time.Time,
+	limit int,
+	exclude Exclusions) (Tasks, error) {
+	exclude.Keys = exclude.Keys[:min(len(exclude.Keys), maxExcludedKeys)]
+	params := make([]any, 0, len(exclude.Queues)+2*len(exclude.Keys)+2)
+	params = append(params, deadline.UnixMilli())
+
+	for _, queue := range exclude.Queues {
+		params = append(params, queue)
+	}
+
+	for _, key := range exclude.Keys {
+		params = append(params, key.Queue, key.Key)
+	}
+
+	params = append(params, limit)
+
+	return GetTasks(
+		ctx,
+		db,
+		query.SelectScheduledTasks(len(exclude.Queues), len(exclude.Keys)),
+		params...,
+	)
+}
+
+// GetScheduledQueueTasks loads the tasks in a given queue that are next up to be executed in order of execution time,
+// in the same manner as GetScheduledTasks. Tasks with the excluded throttle keys are not loaded.
+func GetScheduledQueueTasks(
+	ctx context.Context,
+	db *sql.DB,
+	deadline time.Time,
+	queue string,
+	limit int,
+	excludeKeys []Throttled) (Tasks, error) {
+	excludeKeys = excludeKeys[:min(len(excludeKeys), maxExcludedKeys)]
+	params := make([]any, 0, 2*len(excludeKeys)+3)
+	params = append(params, deadline.UnixMilli(), queue)
+
+	for _, key := range excludeKeys {
+		params = append(params, key.Queue, key.Key)
+	}
+
+	params = append(params, limit)
+
 	return GetTasks(
 		ctx,
 		db,
-		query.SelectScheduledTasks,
-		deadline.UnixMilli(),
-		limit,
+		query.SelectScheduledQueueTasks(len(excludeKeys)),
+		params...,
 	)
 }
+
+// CountRunning counts the tasks in the given queues which are running, which are those claimed after the deadline,
+// keyed by queue.
+func CountRunning(ctx context.Context, db *sql.DB, deadline time.Time, queues ...string) (map[string]int, error) {
+	counts := make(map[string]int, len(queues))
+	if len(queues) == 0 {
+		return counts, nil
+	}
+
+	params := make([]any, 0, len(queues)+1)
+	params = append(params, deadline.UnixMilli())
+	for _, queue := range queues {
+		params = append(params, queue)
+	}
+
+	rows, err := db.QueryContext(ctx, query.CountRunningTasks(len(queues)), params...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var queue string
+		var count int
+		if err = rows.Scan(&queue, &count); err != nil {
+			return nil, err
+		}
+		counts[queue] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// CountRunningKeys counts the tasks in the given queues which are running, which are those claimed after the deadline,
+// for each throttle key with running tasks.
+func CountRunningKeys(
+	ctx context.Context,
+	db *sql.DB,
+	deadline time.Time,
+	queues ...string) (map[Throttled]int, error) {
+	counts := make(map[Throttled]int)
+	if len(queues) == 0 {
+		return counts, nil
+	}
+
+	params := make([]any, 0, len(queues)+1)
+	params = append(params, deadline.UnixMilli())
+	for _, queue := range queues {
+		params = append(params, queue)
+	}
+
+	rows, err := db.QueryContext(ctx, query.CountRunningKeys(len(queues)), params...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var key Throttled
+		var count int
+		if err = rows.Scan(&key.Queue, &key.Key, &count); err != nil {
+			return nil, err
+		}
+		counts[key] = count
+	}
+
+	return counts, rows.Err()
+}
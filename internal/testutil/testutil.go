@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -19,7 +20,9 @@ import (
 func GetTasks(t *testing.T, db *sql.DB) task.Tasks {
 	got, err := task.GetTasks(context.Background(), db, `
 		SELECT 
-			id, queue, task, attempts, wait_until, created_at, last_executed_at, claimed_at
+			id, queue, task, attempts, wait_until, created_at, last_executed_at, claimed_at, metadata, tags, codec,
+			compression, key_id, offloaded, version, max_attempts, timeout_micro, backoff_micro,
+			deadline, debounce_key, partition_key, throttle_key, group_id
 		FROM 
 			backlite_tasks
 		ORDER BY
@@ -187,9 +190,40 @@ func NewDB(t *testing.T) *sql.DB {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	if err = query.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
 	return db
 }
 
+// NewSharedDBs opens n databases backed by the same SQLite file, as if they were opened by separate processes.
+func NewSharedDBs(t *testing.T, n int) []*sql.DB {
+	path := filepath.Join(t.TempDir(), "backlite.db")
+	dbs := make([]*sql.DB, n)
+
+	for i := range dbs {
+		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_timeout=5000", path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		dbs[i] = db
+	}
+
+	if _, err := dbs[0].Exec(query.Schema); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := query.Migrate(dbs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	return dbs
+}
+
 func WaitForChan[T any](t *testing.T, signal chan T) {
 	select {
 	case <-signal:
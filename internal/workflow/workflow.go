@@ -0,0 +1,543 @@
+package workflow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/drajk/backlite/internal/query"
+	"github.com/drajk/backlite/internal/task"
+)
+
+// The statuses of a Run.
+const (
+	// Running is a run with steps which have not completed.
+	Running = "running"
+
+	// Succeeded is a run whose steps have all succeeded.
+	Succeeded = "succeeded"
+
+	// Failed is a run with a step which did not succeed, and whose compensations, if any, did not all succeed.
+	Failed = "failed"
+
+	// Compensating is a failed run whose compensations are executing.
+	Compensating = "compensating"
+
+	// Compensated is a failed run whose compensations have all succeeded.
+	Compensated = "compensated"
+)
+
+// The statuses of a Step.
+const (
+	// Pending is a step whose task has not completed.
+	Pending = "pending"
+
+	// StepSucceeded is a step whose task succeeded.
+	StepSucceeded = "succeeded"
+
+	// StepFailed is a step whose task failed all of its attempts.
+	StepFailed = "failed"
+
+	// StepExpired is a step whose task expired before it was executed.
+	StepExpired = "expired"
+
+	// StepAbandoned is a step whose task was abandoned because a step it depends on did not succeed.
+	StepAbandoned = "abandoned"
+)
+
+// The statuses of the compensation of a Step, in addition to the statuses of a step once the compensation task has
+// completed.
+const (
+	// CompensationWaiting is a compensation whose task is held in case the run fails.
+	CompensationWaiting = "waiting"
+
+	// CompensationPending is a compensation whose task has been released and has not completed.
+	CompensationPending = "pending"
+
+	// CompensationSkipped is a compensation which was not required, because the run succeeded or the step did not.
+	CompensationSkipped = "skipped"
+)
+
+type (
+	// Run is a started instance of a workflow.
+	Run struct {
+		// ID is the ID of the run.
+		ID string
+
+		// Name is the name of the workflow.
+		Name string
+
+		// Status is the status of the run.
+		Status string
+
+		// CreatedAt is when the run was started.
+		CreatedAt time.Time
+
+		// UpdatedAt is when the status of the run last changed.
+		UpdatedAt time.Time
+
+		// Steps are the steps of the run, if loaded.
+		Steps []Step
+	}
+
+	// Step is a step within a run, which is executed by a task.
+	Step struct {
+		// TaskID is the ID of the task which executes the step.
+		TaskID string
+
+		// WorkflowID is the ID of the run the step belongs to.
+		WorkflowID string
+
+		// Name is the name of the step.
+		Name string
+
+		// Stage is the position of the stage of the step within the workflow, starting at 1. The steps of a stage are
+		// executed in parallel once every step of the previous stage has succeeded.
+		Stage int
+
+		// Status is the status of the step.
+		Status string
+
+		// Error is the error of the task, if it did not succeed.
+		Error *string
+
+		// CompensationTaskID is the ID of the task which undoes the step if the run fails, if it has one.
+		CompensationTaskID *string
+
+		// CompensationStatus is the status of the compensation, if the step has one.
+		CompensationStatus *string
+
+		// CompensationError is the error of the compensation task, if it did not succeed.
+		CompensationError *string
+
+		// UpdatedAt is when the status of the step last changed.
+		UpdatedAt time.Time
+	}
+
+	// Outcome is the status of a run once one of its steps has completed.
+	Outcome struct {
+		// RunID is the ID of the run.
+		RunID string
+
+		// Status is the status of the run.
+		Status string
+
+		// Changed indicates if the completion of the step changed the status of the run.
+		Changed bool
+	}
+)
+
+// InsertTx inserts a run, along with its steps, as part of a database transaction.
+func (r *Run) InsertTx(ctx context.Context, tx *sql.Tx) error {
+	if len(r.ID) == 0 {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return fmt.Errorf("unable to generate workflow ID: %w", err)
+		}
+		r.ID = id.String()
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		query.InsertWorkflow,
+		r.ID,
+		r.Name,
+		r.Status,
+		r.CreatedAt.UnixMilli(),
+		r.UpdatedAt.UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+
+	for i := range r.Steps {
+		s := &r.Steps[i]
+		s.WorkflowID = r.ID
+
+		_, err = tx.ExecContext(
+			ctx,
+			query.InsertWorkflowStep,
+			s.TaskID,
+			s.WorkflowID,
+			s.Name,
+			s.Stage,
+			s.Status,
+			s.Error,
+			s.CompensationTaskID,
+			s.CompensationStatus,
+			s.CompensationError,
+			s.UpdatedAt.UnixMilli(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CompleteStepTx records the status of the step executed by a given task, if the task is a step of a run, as part of a
+// database transaction. The run fails as soon as one of its steps does not succeed, and succeeds once all of its steps
+// have succeeded. Nil is returned if the task is not a step, otherwise the outcome for the run is returned.
+func CompleteStepTx(
+	ctx context.Context,
+	tx *sql.Tx,
+	taskID, status string,
+	stepErr *string,
+	at time.Time,
+) (*Outcome, error) {
+	var o Outcome
+	err := tx.QueryRowContext(ctx, query.SelectStepWorkflow, taskID).Scan(&o.RunID, &o.Status)
+	switch {
+	// Most tasks are not steps of a run.
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, query.CompleteWorkflowStep, status, stepErr, at.UnixMilli(), taskID)
+	if err != nil || o.Status != Running {
+		return &o, err
+	}
+
+	var res sql.Result
+	if status == StepSucceeded {
+		res, err = tx.ExecContext(ctx, query.SucceedWorkflow, Succeeded, at.UnixMilli(), o.RunID, Running, StepSucceeded)
+	} else {
+		res, err = tx.ExecContext(ctx, query.UpdateWorkflowStatus, Failed, at.UnixMilli(), o.RunID, Running)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if n > 0 {
+		o.Changed = true
+		o.Status = Failed
+		if status == StepSucceeded {
+			o.Status = Succeeded
+		}
+	}
+
+	return &o, nil
+}
+
+// CompensateTx starts compensating a run which failed, as part of a database transaction. The compensation tasks of
+// the steps which succeeded are released in the reverse order of their steps, each held until the one before it has
+// completed, whether or not it succeeded. The compensations of the steps which are still executing, such as those in
+// the same stage as the step which failed, are held until those steps complete, see CompensateLateStepTx. The
+// compensations of the other steps are skipped, and their tasks are deleted and returned, along with the number of
+// compensation tasks which were released.
+func CompensateTx(ctx context.Context, tx *sql.Tx, runID string, at time.Time) (task.Tasks, int64, error) {
+	rows, err := tx.QueryContext(ctx, query.SelectWaitingCompensations, runID, CompensationWaiting)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type compensation struct {
+		stepID, status, taskID string
+		held                   bool
+	}
+
+	var compensations []compensation
+	for rows.Next() {
+		var c compensation
+		if err = rows.Scan(&c.stepID, &c.status, &c.taskID, &c.held); err != nil {
+			_ = rows.Close()
+			return nil, 0, err
+		}
+		compensations = append(compensations, c)
+	}
+
+	if err = errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, 0, err
+	}
+
+	var prev string
+	for _, c := range compensations {
+		// Steps which are pending without being held by a step before them may still succeed.
+		if c.status == Pending && !c.held {
+			if err = task.ReplaceDependencyTx(ctx, tx, c.taskID, runID, stepHold(c.stepID), false); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		if c.status != StepSucceeded {
+			continue
+		}
+
+		if prev == "" {
+			err = task.RemoveDependencyTx(ctx, tx, c.taskID, runID)
+		} else {
+			err = task.ReplaceDependencyTx(ctx, tx, c.taskID, runID, prev, true)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err = updateCompensation(ctx, tx, c.stepID, c.taskID, CompensationPending, at); err != nil {
+			return nil, 0, err
+		}
+
+		prev = c.taskID
+	}
+
+	// Only the first compensation is released, since each of the others is held by the one before it.
+	var released int64
+	if prev != "" {
+		released = 1
+		if _, err = TransitionTx(ctx, tx, runID, Failed, Compensating, at); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	skipped, err := SkipCompensationsTx(ctx, tx, runID, at)
+	return skipped, released, err
+}
+
+// CompensateLateStepTx resolves the compensation of a step which completed after its run failed, as part of a database
+// transaction. If the step succeeded, its compensation is released, held until the last compensation which has been
+// released has completed, and 1 is returned. Otherwise, the compensation is skipped and its task is deleted and
+// returned.
+func CompensateLateStepTx(
+	ctx context.Context,
+	tx *sql.Tx,
+	runID, stepID string,
+	succeeded bool,
+	at time.Time,
+) (task.Tasks, int64, error) {
+	var taskID string
+	err := tx.QueryRowContext(ctx, query.SelectWaitingCompensation, stepID, CompensationWaiting).Scan(&taskID)
+	switch {
+	// The compensations of steps which were abandoned have already been skipped.
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, 0, nil
+	case err != nil:
+		return nil, 0, err
+	}
+
+	if !succeeded {
+		skipped, _, err := task.AbandonDependentsTx(ctx, tx, stepHold(stepID))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err = updateCompensation(ctx, tx, stepID, taskID, CompensationSkipped, at); err != nil {
+			return nil, 0, err
+		}
+
+		return skipped, 0, finishCompensation(ctx, tx, runID, at)
+	}
+
+	var tail string
+	err = tx.QueryRowContext(ctx, query.SelectCompensationTail, runID, CompensationPending).Scan(&tail)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, err
+	}
+
+	var released int64
+	if tail == "" {
+		released = 1
+		err = task.RemoveDependencyTx(ctx, tx, taskID, stepHold(stepID))
+	} else {
+		err = task.ReplaceDependencyTx(ctx, tx, taskID, stepHold(stepID), tail, true)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err = updateCompensation(ctx, tx, stepID, taskID, CompensationPending, at); err != nil {
+		return nil, 0, err
+	}
+
+	_, err = TransitionTx(ctx, tx, runID, Failed, Compensating, at)
+	return nil, released, err
+}
+
+// SkipCompensationsTx skips the compensations of a run which are held by it, as part of a database transaction, such
+// as once the run has succeeded. Their tasks are deleted and returned.
+func SkipCompensationsTx(ctx context.Context, tx *sql.Tx, runID string, at time.Time) (task.Tasks, error) {
+	_, err := tx.ExecContext(
+		ctx,
+		query.SkipCompensations,
+		CompensationSkipped,
+		at.UnixMilli(),
+		runID,
+		CompensationWaiting,
+		runID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Waiting compensation tasks are held by the run, and do not execute if it is abandoned.
+	skipped, _, err := task.AbandonDependentsTx(ctx, tx, runID)
+	return skipped, err
+}
+
+// CompleteCompensationTx records the status of the compensation executed by a given task, if the task compensates a
+// step of a run, as part of a database transaction. Once every released compensation of the run has completed, the
+// run is compensated if they all succeeded, otherwise it has failed.
+func CompleteCompensationTx(
+	ctx context.Context,
+	tx *sql.Tx,
+	taskID, status string,
+	compErr *string,
+	at time.Time,
+) error {
+	// Most tasks do not compensate a step.
+	runID, err := getRunID(ctx, tx, query.SelectCompensationWorkflow, taskID)
+	if err != nil || runID == "" {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query.CompleteCompensation, status, compErr, at.UnixMilli(), taskID)
+	if err != nil {
+		return err
+	}
+
+	return finishCompensation(ctx, tx, runID, at)
+}
+
+// finishCompensation completes a compensating run once none of its compensations are pending or waiting.
+func finishCompensation(ctx context.Context, tx *sql.Tx, runID string, at time.Time) error {
+	_, err := tx.ExecContext(
+		ctx,
+		query.FinishCompensation,
+		StepFailed,
+		StepExpired,
+		Failed,
+		Compensated,
+		at.UnixMilli(),
+		runID,
+		Compensating,
+		CompensationPending,
+		CompensationWaiting,
+	)
+
+	return err
+}
+
+// RetryCompensationTx replaces the task of the compensation of a step, which did not succeed, with another task that
+// has been added to retry it, as part of a database transaction.
+func RetryCompensationTx(ctx context.Context, tx *sql.Tx, stepID, taskID string, at time.Time) error {
+	return updateCompensation(ctx, tx, stepID, taskID, CompensationPending, at)
+}
+
+// GetFailedCompensations loads the steps of a run whose compensations did not succeed, in the reverse order of their
+// steps.
+func GetFailedCompensations(ctx context.Context, db *sql.DB, runID string) ([]Step, error) {
+	return GetSteps(ctx, db, query.SelectFailedCompensations, runID, StepFailed, StepExpired)
+}
+
+// TransitionTx changes the status of a run, if it has a given status, as part of a database transaction. Whether the
+// status changed is returned.
+func TransitionTx(ctx context.Context, tx *sql.Tx, runID, from, to string, at time.Time) (bool, error) {
+	res, err := tx.ExecContext(ctx, query.UpdateWorkflowStatus, to, at.UnixMilli(), runID, from)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// updateCompensation sets the task and status of the compensation of a step.
+func updateCompensation(ctx context.Context, tx *sql.Tx, stepID, taskID, status string, at time.Time) error {
+	_, err := tx.ExecContext(ctx, query.UpdateCompensation, taskID, status, at.UnixMilli(), stepID)
+	return err
+}
+
+// stepHold returns the ID which holds the compensation of a step that was still executing when its run failed, until
+// the step completes.
+func stepHold(stepID string) string {
+	return "step:" + stepID
+}
+
+// getRunID returns the ID of the run found by a given query for a task, or an empty string if there isn't one.
+func getRunID(ctx context.Context, tx *sql.Tx, query, taskID string) (string, error) {
+	var id string
+	err := tx.QueryRowContext(ctx, query, taskID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// GetRuns loads runs, without their steps, from the database using a given query and arguments.
+func GetRuns(ctx context.Context, db *sql.DB, query string, args ...any) ([]Run, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	runs := make([]Run, 0)
+
+	for rows.Next() {
+		var r Run
+		var createdAt, updatedAt int64
+
+		if err = rows.Scan(&r.ID, &r.Name, &r.Status, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+
+		r.CreatedAt = time.UnixMilli(createdAt)
+		r.UpdatedAt = time.UnixMilli(updatedAt)
+
+		runs = append(runs, r)
+	}
+
+	return runs, rows.Err()
+}
+
+// GetSteps loads steps from the database using a given query and arguments.
+func GetSteps(ctx context.Context, db *sql.DB, query string, args ...any) ([]Step, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	steps := make([]Step, 0)
+
+	for rows.Next() {
+		var s Step
+		var updatedAt int64
+
+		err = rows.Scan(
+			&s.TaskID,
+			&s.WorkflowID,
+			&s.Name,
+			&s.Stage,
+			&s.Status,
+			&s.Error,
+			&s.CompensationTaskID,
+			&s.CompensationStatus,
+			&s.CompensationError,
+			&updatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		s.UpdatedAt = time.UnixMilli(updatedAt)
+
+		steps = append(steps, s)
+	}
+
+	return steps, rows.Err()
+}
@@ -0,0 +1,260 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestCompleteStepTx(t *testing.T) {
+	db := testutil.NewDB(t)
+	ctx := context.Background()
+	at := time.UnixMilli(time.Now().UnixMilli())
+
+	run := Run{
+		Name:      "onboarding",
+		Status:    Running,
+		CreatedAt: at,
+		UpdatedAt: at,
+		Steps: []Step{
+			{TaskID: "1", Name: "provision", Stage: 1, Status: Pending, UpdatedAt: at},
+			{TaskID: "2", Name: "welcome", Stage: 2, Status: Pending, UpdatedAt: at},
+		},
+	}
+
+	complete := func(taskID, status string, stepErr *string) *Outcome {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := CompleteStepTx(ctx, tx, taskID, status, stepErr, at.Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	getRun := func(id string) Run {
+		runs, err := GetRuns(ctx, db, "SELECT id, name, status, created_at, updated_at FROM backlite_workflows WHERE id = ?", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.Length(t, runs, 1)
+		return runs[0]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = run.InsertTx(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "step workflow id", run.ID, run.Steps[0].WorkflowID)
+
+	// Tasks which are not steps are ignored.
+	testutil.Equal(t, "not a step", nil, complete("3", StepSucceeded, nil))
+
+	// The run is running until all of the steps have succeeded.
+	o := complete("1", StepSucceeded, nil)
+	testutil.Equal(t, "running", Outcome{RunID: run.ID, Status: Running}, *o)
+	testutil.Equal(t, "running", Running, getRun(run.ID).Status)
+
+	o = complete("2", StepSucceeded, nil)
+	testutil.Equal(t, "outcome", Outcome{RunID: run.ID, Status: Succeeded, Changed: true}, *o)
+	got := getRun(run.ID)
+	testutil.Equal(t, "succeeded", Succeeded, got.Status)
+	testutil.Equal(t, "updated at", at.Add(time.Second), got.UpdatedAt)
+
+	// The run fails as soon as a step does not succeed.
+	failed := Run{
+		Name:      "onboarding",
+		Status:    Running,
+		CreatedAt: at,
+		UpdatedAt: at,
+		Steps: []Step{
+			{TaskID: "4", Name: "provision", Stage: 1, Status: Pending, UpdatedAt: at},
+			{TaskID: "5", Name: "welcome", Stage: 2, Status: Pending, UpdatedAt: at},
+		},
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = failed.InsertTx(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	errStr := "failure error"
+	o = complete("4", StepFailed, &errStr)
+	testutil.Equal(t, "outcome", Outcome{RunID: failed.ID, Status: Failed, Changed: true}, *o)
+	testutil.Equal(t, "failed", Failed, getRun(failed.ID).Status)
+
+	steps, err := GetSteps(ctx, db, `
+		SELECT
+			task_id, workflow_id, name, stage, status, error, compensation_task_id, compensation_status,
+			compensation_error, updated_at
+		FROM backlite_workflow_steps
+		WHERE workflow_id = ?
+		ORDER BY task_id
+	`, failed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, steps, 2)
+	testutil.Equal(t, "failed step", StepFailed, steps[0].Status)
+	testutil.Equal(t, "failed step error", errStr, *steps[0].Error)
+	testutil.Equal(t, "pending step", Pending, steps[1].Status)
+}
+
+func TestCompensateTx(t *testing.T) {
+	db := testutil.NewDB(t)
+	ctx := context.Background()
+	at := time.UnixMilli(time.Now().UnixMilli())
+	waiting := CompensationWaiting
+
+	run := Run{
+		ID:        "run",
+		Name:      "checkout",
+		Status:    Failed,
+		CreatedAt: at,
+		UpdatedAt: at,
+	}
+
+	for i, status := range []string{StepSucceeded, StepSucceeded, StepFailed} {
+		id := fmt.Sprint(i + 1)
+		compensation := &task.Task{ID: "c" + id, Queue: "test", Task: []byte("data"), CreatedAt: at}
+		testutil.InsertTask(t, db, compensation)
+
+		run.Steps = append(run.Steps, Step{
+			TaskID:             id,
+			Name:               "step" + id,
+			Stage:              i + 1,
+			Status:             status,
+			CompensationTaskID: &compensation.ID,
+			CompensationStatus: &waiting,
+			UpdatedAt:          at,
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range run.Steps {
+		if err = task.HoldTx(ctx, tx, *s.CompensationTaskID, run.ID, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = run.InsertTx(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	skipped, released, err := CompensateTx(ctx, tx, run.ID, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compensations of the steps which succeeded execute in reverse order.
+	testutil.Equal(t, "released", int64(1), released)
+	testutil.Length(t, skipped, 1)
+	testutil.Equal(t, "skipped", "c3", skipped[0].ID)
+
+	var parent string
+	err = db.QueryRow("SELECT parent_id FROM backlite_task_dependencies WHERE task_id = 'c1'").Scan(&parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "c1 parent", "c2", parent)
+
+	var n int
+	if err = db.QueryRow("SELECT COUNT(*) FROM backlite_task_dependencies").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "dependencies", 1, n)
+
+	getStatuses := func() (string, map[string]string) {
+		runs, err := GetRuns(ctx, db, "SELECT id, name, status, created_at, updated_at FROM backlite_workflows")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		steps, err := GetSteps(ctx, db, `
+			SELECT
+				task_id, workflow_id, name, stage, status, error, compensation_task_id, compensation_status,
+				compensation_error, updated_at
+			FROM backlite_workflow_steps
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statuses := make(map[string]string, len(steps))
+		for _, s := range steps {
+			statuses[s.Name] = *s.CompensationStatus
+		}
+		return runs[0].Status, statuses
+	}
+
+	status, statuses := getStatuses()
+	testutil.Equal(t, "run", Compensating, status)
+	testutil.Equal(t, "step1", CompensationPending, statuses["step1"])
+	testutil.Equal(t, "step2", CompensationPending, statuses["step2"])
+	testutil.Equal(t, "step3", CompensationSkipped, statuses["step3"])
+
+	complete := func(taskID, status string, compErr *string) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = CompleteCompensationTx(ctx, tx, taskID, status, compErr, at); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The run is compensating until every compensation has completed, and fails if any of them did not succeed.
+	complete("c2", StepSucceeded, nil)
+	status, _ = getStatuses()
+	testutil.Equal(t, "run", Compensating, status)
+
+	errStr := "failure error"
+	complete("c1", StepFailed, &errStr)
+	status, statuses = getStatuses()
+	testutil.Equal(t, "run", Failed, status)
+	testutil.Equal(t, "step1", StepFailed, statuses["step1"])
+	testutil.Equal(t, "step2", StepSucceeded, statuses["step2"])
+
+	steps, err := GetFailedCompensations(ctx, db, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, steps, 1)
+	testutil.Equal(t, "failed compensation", "step1", steps[0].Name)
+	testutil.Equal(t, "compensation error", errStr, *steps[0].CompensationError)
+}
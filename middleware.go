@@ -0,0 +1,138 @@
+package backlite
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+type (
+	// TaskInfo contains information about a task that is being processed.
+	TaskInfo struct {
+		// ID is the task ID.
+		ID string
+
+		// Queue is the name of the queue the task belongs to.
+		Queue string
+
+		// Attempt is the current execution attempt number.
+		Attempt int
+
+		// CreatedAt is when the task was originally created.
+		CreatedAt time.Time
+	}
+
+	// Handler handles the processing of a given task payload.
+	Handler func(ctx context.Context, info TaskInfo, payload []byte) error
+
+	// Middleware wraps a Handler in order to execute code before and/or after the next Handler in the chain.
+	Middleware func(next Handler) Handler
+
+	// PanicError is returned by the CapturePanics middleware when a panic is recovered.
+	PanicError struct {
+		// Value is the value the panic was called with.
+		Value any
+
+		// Stack is the stack trace of the goroutine that panicked.
+		Stack []byte
+	}
+)
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// chain wraps a Handler with the provided middleware so the first middleware is the outermost.
+func chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// LogDuration provides middleware which logs when a task starts and how long the processing took.
+func LogDuration(log Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, info TaskInfo, payload []byte) error {
+			log.Info("task started",
+				"id", info.ID,
+				"queue", info.Queue,
+				"attempt", info.Attempt,
+			)
+
+			start := time.Now()
+			err := next(ctx, info, payload)
+
+			log.Info("task finished",
+				"id", info.ID,
+				"queue", info.Queue,
+				"attempt", info.Attempt,
+				"duration", time.Since(start),
+				"error", err,
+			)
+
+			return err
+		}
+	}
+}
+
+// CapturePanics provides middleware which recovers from panics and returns a *PanicError which includes the stack
+// trace of where the panic occurred.
+func CapturePanics() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, info TaskInfo, payload []byte) (err error) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					err = &PanicError{
+						Value: rec,
+						Stack: debug.Stack(),
+					}
+				}
+			}()
+
+			return next(ctx, info, payload)
+		}
+	}
+}
+
+// EnforceTimeout provides middleware which sets a timeout on the context and returns the context error as soon as
+// the timeout elapses, even if the next Handler does not respect the context cancellation. Be aware that in that
+// case, the next Handler will continue executing in the background until it returns.
+func EnforceTimeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, info TaskInfo, payload []byte) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			type result struct {
+				err   error
+				panic any
+			}
+
+			done := make(chan result, 1)
+
+			go func() {
+				defer func() {
+					if rec := recover(); rec != nil {
+						done <- result{panic: rec}
+					}
+				}()
+
+				done <- result{err: next(ctx, info, payload)}
+			}()
+
+			select {
+			case res := <-done:
+				// Re-panic so the panic can be handled further up the chain.
+				if res.panic != nil {
+					panic(res.panic)
+				}
+				return res.err
+
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+type testLogger struct {
+	infos  []string
+	errors []string
+}
+
+func (l *testLogger) Info(message string, params ...any) {
+	l.infos = append(l.infos, message)
+}
+
+func (l *testLogger) Error(message string, params ...any) {
+	l.errors = append(l.errors, message)
+}
+
+func orderMiddleware(name string, calls *[]string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, info TaskInfo, payload []byte) error {
+			*calls = append(*calls, name)
+			return next(ctx, info, payload)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	h := chain(func(ctx context.Context, info TaskInfo, payload []byte) error {
+		calls = append(calls, "handler")
+		return nil
+	}, orderMiddleware("a", &calls), orderMiddleware("b", &calls))
+
+	if err := h(context.Background(), TaskInfo{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, "calls", "a,b,handler", strings.Join(calls, ","))
+}
+
+func TestLogDuration(t *testing.T) {
+	log := &testLogger{}
+	taskErr := errors.New("fail")
+	h := LogDuration(log)(func(ctx context.Context, info TaskInfo, payload []byte) error {
+		return taskErr
+	})
+
+	err := h(context.Background(), TaskInfo{}, nil)
+	testutil.Equal(t, "error", taskErr, err)
+	testutil.Equal(t, "logs", "task started,task finished", strings.Join(log.infos, ","))
+}
+
+func TestCapturePanics(t *testing.T) {
+	h := CapturePanics()(func(ctx context.Context, info TaskInfo, payload []byte) error {
+		panic("oops")
+	})
+
+	err := h(context.Background(), TaskInfo{}, nil)
+
+	var pe *PanicError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+
+	testutil.Equal(t, "value", "oops", pe.Value.(string))
+
+	if !strings.Contains(string(pe.Stack), "TestCapturePanics") {
+		t.Error("stack trace not captured")
+	}
+}
+
+func TestEnforceTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	h := EnforceTimeout(10 * time.Millisecond)(func(ctx context.Context, info TaskInfo, payload []byte) error {
+		<-block
+		return nil
+	})
+
+	err := h(context.Background(), TaskInfo{}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	h = EnforceTimeout(time.Second)(func(ctx context.Context, info TaskInfo, payload []byte) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("deadline not set")
+		}
+		return nil
+	})
+
+	if err = h(context.Background(), TaskInfo{}, nil); err != nil {
+		t.Error(err)
+	}
+
+	h = CapturePanics()(EnforceTimeout(time.Second)(
+		func(ctx context.Context, info TaskInfo, payload []byte) error {
+			panic("oops")
+		}),
+	)
+
+	var pe *PanicError
+	if err = h(context.Background(), TaskInfo{}, nil); !errors.As(err, &pe) {
+		t.Errorf("expected panic error, got %v", err)
+	}
+}
+
+func TestDispatcher_ProcessTask__EnforceTimeout(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	d.middleware = []Middleware{EnforceTimeout(10 * time.Millisecond)}
+
+	// The processor of a result queue continues after the timeout, which must not affect the outcome of the task.
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	q := NewResultQueue[testTask, string](func(ctx context.Context, tk testTask) (string, error) {
+		<-release
+		return "late", nil
+	})
+	q.Config().Middleware = []Middleware{func(next Handler) Handler {
+		return func(ctx context.Context, info TaskInfo, payload []byte) error {
+			defer close(finished)
+			return next(ctx, info, payload)
+		}
+	}}
+	d.client.Register(q)
+
+	if err := d.client.Add(testTask{Val: "1"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := testutil.GetTasks(t, d.client.db)[0]
+	tk.Attempts++
+	d.processTask(tk)
+
+	close(release)
+	<-finished
+
+	// The task failed and will be retried.
+	got := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, got, 1)
+	testutil.Length(t, testutil.GetCompletedTasks(t, d.client.db), 0)
+}
+
+func TestDispatcher_ProcessTask__Middleware(t *testing.T) {
+	var calls []string
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	d.middleware = []Middleware{orderMiddleware("global", &calls)}
+
+	q := &queue[testTask]{
+		config: &QueueConfig{
+			Name:        "test",
+			MaxAttempts: 1,
+			Middleware: []Middleware{
+				orderMiddleware("queue", &calls),
+				func(next Handler) Handler {
+					return func(ctx context.Context, info TaskInfo, payload []byte) error {
+						testutil.Equal(t, "id", "1", info.ID)
+						testutil.Equal(t, "queue", "test", info.Queue)
+						testutil.Equal(t, "attempt", 1, info.Attempt)
+						testutil.Equal(t, "created at", now(), info.CreatedAt)
+						return next(ctx, info, payload)
+					}
+				},
+			},
+		},
+		processor: func(ctx context.Context, tk testTask) error {
+			calls = append(calls, "processor")
+			testutil.Equal(t, "val", "1", tk.Val)
+			return nil
+		},
+	}
+	d.client.Register(q)
+
+	tk := &task.Task{
+		ID:        "1",
+		Queue:     "test",
+		Task:      testutil.Encode(t, &testTask{Val: "1"}),
+		Attempts:  1,
+		CreatedAt: now(),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+
+	d.processTask(tk)
+	testutil.Equal(t, "calls", "global,queue,processor", strings.Join(calls, ","))
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+}
@@ -0,0 +1,209 @@
+package backlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/drajk/backlite/internal/payload"
+	"github.com/drajk/backlite/internal/task"
+)
+
+const (
+	// CompressionGzip compresses task payloads with gzip.
+	CompressionGzip CompressionAlgorithm = payload.Gzip
+
+	// CompressionFlate compresses task payloads with flate.
+	CompressionFlate CompressionAlgorithm = payload.Flate
+)
+
+type (
+	// CompressionAlgorithm is the name of a compression algorithm.
+	CompressionAlgorithm string
+
+	// Compression is the policy for compressing task payloads.
+	Compression struct {
+		// Algorithm is the compression algorithm to use.
+		Algorithm CompressionAlgorithm
+
+		// Threshold is the minimum size, in bytes, of an encoded task payload before it will be compressed.
+		Threshold int
+	}
+
+	// KeyProvider provides the keys used to encrypt and decrypt task payloads with AES-GCM. Keys must be 16, 24 or
+	// 32 bytes in order to select AES-128, AES-192 or AES-256. The ID of the key used to encrypt each task is stored
+	// with the task, which allows keys to be rotated while tasks encrypted with previous keys remain readable.
+	KeyProvider interface {
+		// CurrentKey returns the ID and value of the key used to encrypt new task payloads.
+		CurrentKey() (id string, key []byte, err error)
+
+		// Key returns the value of the key with the given ID in order to decrypt task payloads.
+		Key(id string) ([]byte, error)
+	}
+
+	// KeyRing is a KeyProvider containing a fixed set of keys.
+	KeyRing struct {
+		// Current is the ID of the key used to encrypt new task payloads.
+		Current string
+
+		// Keys contains the keys, keyed by ID. Previous keys should remain until all tasks encrypted with them
+		// have been removed from the database.
+		Keys map[string][]byte
+	}
+)
+
+func (k KeyRing) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k KeyRing) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key '%s' not found", id)
+	}
+	return key, nil
+}
+
+// pack prepares an encoded task payload to be stored in the database by applying the client's payload options,
+// compression, encryption, then offloading, and sets the result on the given task.
+func (c *Client) pack(ctx context.Context, m *task.Task, data []byte) error {
+	if c.compression != nil && len(data) >= c.compression.Threshold {
+		alg := string(c.compression.Algorithm)
+
+		compressed, err := payload.Compress(alg, data)
+		if err != nil {
+			return err
+		}
+
+		data = compressed
+		m.Compression = alg
+	}
+
+	if c.keys != nil {
+		id, key, err := c.keys.CurrentKey()
+		if err != nil {
+			return err
+		}
+
+		// The payload is bound to the ID of the task, so it must be generated now rather than when inserted.
+		if m.ID == "" {
+			tid, err := uuid.NewV7()
+			if err != nil {
+				return fmt.Errorf("unable to generate task ID: %w", err)
+			}
+			m.ID = tid.String()
+		}
+
+		encrypted, err := payload.Encrypt(key, data, payload.AssociatedData(payload.TaskData, m.ID, m.Queue))
+		if err != nil {
+			return err
+		}
+
+		data = encrypted
+		m.KeyID = id
+	}
+
+	if c.offload != nil && len(data) >= c.offload.Threshold {
+		key, err := uuid.NewV7()
+		if err != nil {
+			return fmt.Errorf("unable to generate blob key: %w", err)
+		}
+
+		if err = c.offload.Store.Put(ctx, key.String(), data); err != nil {
+			return fmt.Errorf("unable to store blob: %w", err)
+		}
+
+		data = []byte(key.String())
+		m.Offloaded = true
+	}
+
+	m.Task = data
+	return nil
+}
+
+// unpack restores the encoded payload of a task that was prepared for storage by pack.
+func (c *Client) unpack(ctx context.Context, t *task.Task) ([]byte, error) {
+	data := t.Task
+
+	if t.Offloaded {
+		if c.offload == nil {
+			return nil, fmt.Errorf("task data is stored in blob '%s' but no blob store is configured", t.Task)
+		}
+
+		blob, err := c.offload.Store.Get(ctx, string(t.Task))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load blob: %w", err)
+		}
+		data = blob
+	}
+
+	return c.open(t.KeyID, t.Compression, payload.AssociatedData(payload.TaskData, t.ID, t.Queue), data)
+}
+
+// packResult prepares the encoded result of a task to be stored with it once completed, by compressing and
+// encrypting it in the same way as the payload of the task, so the algorithm and key stored with the task apply to
+// both. Results are not offloaded.
+func (c *Client) packResult(t *task.Task, result []byte) ([]byte, error) {
+	var err error
+
+	if t.Compression != "" {
+		if result, err = payload.Compress(t.Compression, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.KeyID != "" {
+		if c.keys == nil {
+			return nil, fmt.Errorf("task is encrypted with key '%s' but no key provider is configured", t.KeyID)
+		}
+
+		key, err := c.keys.Key(t.KeyID)
+		if err != nil {
+			return nil, err
+		}
+
+		ad := payload.AssociatedData(payload.ResultData, t.ID, t.Queue)
+		if result, err = payload.Encrypt(key, result, ad); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// unpackResult restores the encoded result of a completed task that was prepared for storage by packResult.
+func (c *Client) unpackResult(t *task.Completed) ([]byte, error) {
+	return c.open(t.KeyID, t.Compression, payload.AssociatedData(payload.ResultData, t.ID, t.Queue), t.Result)
+}
+
+// open decrypts and decompresses data with the given key, associated data and algorithm, if any.
+func (c *Client) open(keyID, compression string, ad, data []byte) ([]byte, error) {
+	if keyID != "" {
+		if c.keys == nil {
+			return nil, fmt.Errorf("task is encrypted with key '%s' but no key provider is configured", keyID)
+		}
+
+		key, err := c.keys.Key(keyID)
+		if err != nil {
+			return nil, err
+		}
+
+		decrypted, err := payload.Decrypt(key, data, ad)
+		if err != nil {
+			return nil, err
+		}
+		data = decrypted
+	}
+
+	if compression != "" {
+		decompressed, err := payload.Decompress(compression, data)
+		if err != nil {
+			return nil, err
+		}
+		data = decompressed
+	}
+
+	return data, nil
+}
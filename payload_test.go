@@ -0,0 +1,212 @@
+package backlite
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestClient_Pack__Compression(t *testing.T) {
+	c := mustNewClient(t)
+	data := bytes.Repeat([]byte("a"), 100)
+
+	// Disabled.
+	var m task.Task
+	if err := c.pack(context.Background(), &m, data); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "compression", "", m.Compression)
+	testutil.Equal(t, "data", string(data), string(m.Task))
+
+	// Below the threshold.
+	c.compression = &Compression{Algorithm: CompressionGzip, Threshold: 101}
+	m = task.Task{}
+	if err := c.pack(context.Background(), &m, data); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "compression", "", m.Compression)
+
+	// Above the threshold.
+	for _, alg := range []CompressionAlgorithm{CompressionGzip, CompressionFlate} {
+		c.compression = &Compression{Algorithm: alg, Threshold: 100}
+		m = task.Task{}
+		if err := c.pack(context.Background(), &m, data); err != nil {
+			t.Fatal(err)
+		}
+		testutil.Equal(t, "compression", string(alg), m.Compression)
+
+		if len(m.Task) >= len(data) {
+			t.Error("data not compressed")
+		}
+
+		got, err := c.unpack(context.Background(), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.Equal(t, "data", string(data), string(got))
+	}
+
+	// Invalid algorithm.
+	c.compression = &Compression{Algorithm: "zip"}
+	if err := c.pack(context.Background(), &m, data); err == nil {
+		t.Error("expected error, got none")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	c.compression = &Compression{Algorithm: CompressionGzip, Threshold: 50}
+	defer c.db.Close()
+
+	large := testTask{Val: strings.Repeat("a", 100)}
+	if err := c.Add(testTask{Val: "a"}, large).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 2)
+	testutil.Equal(t, "small", "", got[0].Compression)
+	testutil.Equal(t, "large", "gzip", got[1].Compression)
+
+	// Process both tasks with compression disabled to ensure mixed data is supported.
+	c.compression = nil
+	var processed []string
+	c.Register(NewQueue[testTask](func(ctx context.Context, tk testTask) error {
+		processed = append(processed, tk.Val)
+		return nil
+	}))
+
+	d := newDispatcher(t)
+	d.client = c
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+
+	for _, tk := range got {
+		tk.Attempts++
+		d.processTask(tk)
+	}
+
+	testutil.Length(t, processed, 2)
+	testutil.Equal(t, "small", "a", processed[0])
+	testutil.Equal(t, "large", large.Val, processed[1])
+
+	ct := testutil.GetCompletedTasks(t, c.db)
+	testutil.Length(t, ct, 2)
+	testutil.Equal(t, "retained compression", "gzip", ct[1].Compression)
+}
+
+func TestKeyRing(t *testing.T) {
+	k := KeyRing{
+		Current: "2",
+		Keys: map[string][]byte{
+			"1": []byte("a"),
+			"2": []byte("b"),
+		},
+	}
+
+	id, key, err := k.CurrentKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "id", "2", id)
+	testutil.Equal(t, "key", "b", string(key))
+
+	key, err = k.Key("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "key", "a", string(key))
+
+	if _, err = k.Key("3"); err == nil {
+		t.Error("expected error, got none")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	keys := KeyRing{
+		Current: "1",
+		Keys: map[string][]byte{
+			"1": bytes.Repeat([]byte("1"), 32),
+		},
+	}
+
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	c.keys = keys
+	c.compression = &Compression{Algorithm: CompressionGzip, Threshold: 50}
+	defer c.db.Close()
+
+	large := testTask{Val: strings.Repeat("a", 100)}
+	if err := c.Add(testTask{Val: "a@example.com"}, large).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate the key and add another task.
+	keys.Current = "2"
+	keys.Keys["2"] = bytes.Repeat([]byte("2"), 16)
+	c.keys = keys
+	if err := c.Add(testTask{Val: "b@example.com"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 3)
+	testutil.Equal(t, "key id", "1", got[0].KeyID)
+	testutil.Equal(t, "key id", "1", got[1].KeyID)
+	testutil.Equal(t, "compression", "gzip", got[1].Compression)
+	testutil.Equal(t, "key id", "2", got[2].KeyID)
+
+	for _, tk := range got {
+		if bytes.Contains(tk.Task, []byte("example.com")) {
+			t.Error("task data is not encrypted")
+		}
+	}
+
+	// The data is bound to the task, so it cannot be moved to another.
+	moved := *got[0]
+	moved.ID = got[2].ID
+	if _, err := c.unpack(context.Background(), &moved); err == nil {
+		t.Error("expected error unpacking data moved to another task")
+	}
+
+	var processed []string
+	c.Register(NewQueue[testTask](func(ctx context.Context, tk testTask) error {
+		processed = append(processed, tk.Val)
+		return nil
+	}))
+
+	d := newDispatcher(t)
+	d.client = c
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+
+	for _, tk := range got {
+		tk.Attempts++
+		d.processTask(tk)
+	}
+
+	testutil.Length(t, processed, 3)
+	testutil.Equal(t, "first", "a@example.com", processed[0])
+	testutil.Equal(t, "second", large.Val, processed[1])
+	testutil.Equal(t, "third", "b@example.com", processed[2])
+
+	// Retained data should remain encrypted.
+	ct := testutil.GetCompletedTasks(t, c.db)
+	testutil.Length(t, ct, 3)
+	testutil.Equal(t, "retained key id", "1", ct[0].KeyID)
+
+	if bytes.Contains(ct[0].Task, []byte("example.com")) {
+		t.Error("retained task data is not encrypted")
+	}
+
+	// Without the keys, the task cannot be decrypted.
+	c.keys = nil
+	if _, err := c.unpack(context.Background(), got[0]); err == nil {
+		t.Error("expected error, got none")
+	}
+}
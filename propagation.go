@@ -0,0 +1,37 @@
+package backlite
+
+import "context"
+
+type (
+	// Propagator captures metadata, such as trace context or a request ID, from the context used when adding a task
+	// and restores it in to the context provided to the queue processor when the task is executed.
+	// The carrier is compatible with OpenTelemetry's propagation.MapCarrier.
+	Propagator interface {
+		// Inject stores metadata from the context in to the carrier.
+		Inject(ctx context.Context, carrier map[string]string)
+
+		// Extract returns a copy of the context containing the metadata stored in the carrier.
+		Extract(ctx context.Context, carrier map[string]string) context.Context
+	}
+
+	// propagators combines multiple propagators.
+	propagators []Propagator
+)
+
+// Propagators combines multiple propagators in to a single Propagator which calls each in order.
+func Propagators(p ...Propagator) Propagator {
+	return propagators(p)
+}
+
+func (p propagators) Inject(ctx context.Context, carrier map[string]string) {
+	for _, prop := range p {
+		prop.Inject(ctx, carrier)
+	}
+}
+
+func (p propagators) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	for _, prop := range p {
+		ctx = prop.Extract(ctx, carrier)
+	}
+	return ctx
+}
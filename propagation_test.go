@@ -0,0 +1,155 @@
+package backlite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+type (
+	testSpan struct {
+		name     string
+		traceID  string
+		spanID   string
+		parentID string
+	}
+
+	// testTracer is an in-memory tracer which exports ended spans.
+	testTracer struct {
+		exported []testSpan
+		ids      int
+		sync.Mutex
+	}
+
+	ctxKeySpan struct{}
+
+	// testPropagator propagates testTracer spans using the W3C traceparent format.
+	testPropagator struct{}
+
+	// testRequestIDPropagator propagates a request ID.
+	testRequestIDPropagator struct{}
+
+	ctxKeyRequestID struct{}
+)
+
+func (tr *testTracer) start(ctx context.Context, name string) (context.Context, *testSpan) {
+	tr.Lock()
+	defer tr.Unlock()
+	tr.ids++
+
+	s := &testSpan{
+		name:   name,
+		spanID: fmt.Sprintf("span-%d", tr.ids),
+	}
+
+	if parent, ok := ctx.Value(ctxKeySpan{}).(*testSpan); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = fmt.Sprintf("trace-%d", tr.ids)
+	}
+
+	return context.WithValue(ctx, ctxKeySpan{}, s), s
+}
+
+func (tr *testTracer) end(s *testSpan) {
+	tr.Lock()
+	defer tr.Unlock()
+	tr.exported = append(tr.exported, *s)
+}
+
+func (testPropagator) Inject(ctx context.Context, carrier map[string]string) {
+	if s, ok := ctx.Value(ctxKeySpan{}).(*testSpan); ok {
+		carrier["traceparent"] = fmt.Sprintf("00-%s-%s-01", s.traceID, s.spanID)
+	}
+}
+
+func (testPropagator) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	parts := strings.Split(carrier["traceparent"], "-")
+	if len(parts) != 6 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, ctxKeySpan{}, &testSpan{
+		traceID: strings.Join(parts[1:3], "-"),
+		spanID:  strings.Join(parts[3:5], "-"),
+	})
+}
+
+func (testRequestIDPropagator) Inject(ctx context.Context, carrier map[string]string) {
+	if id, ok := ctx.Value(ctxKeyRequestID{}).(string); ok {
+		carrier["request_id"] = id
+	}
+}
+
+func (testRequestIDPropagator) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if id, ok := carrier["request_id"]; ok {
+		return context.WithValue(ctx, ctxKeyRequestID{}, id)
+	}
+	return ctx
+}
+
+func TestPropagation(t *testing.T) {
+	tracer := &testTracer{}
+	c := mustNewClient(t)
+	c.propagator = Propagators(testPropagator{}, testRequestIDPropagator{})
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	var requestID string
+	c.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		_, span := tracer.start(ctx, "process")
+		defer tracer.end(span)
+		requestID, _ = ctx.Value(ctxKeyRequestID{}).(string)
+		return nil
+	}))
+
+	// Add the task within a request span.
+	ctx := context.WithValue(context.Background(), ctxKeyRequestID{}, "abc")
+	ctx, parent := tracer.start(ctx, "request")
+	if err := c.Add(testTask{Val: "1"}).Ctx(ctx).Save(); err != nil {
+		t.Fatal(err)
+	}
+	tracer.end(parent)
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "request id metadata", "abc", got[0].Metadata["request_id"])
+
+	// Execute the task.
+	d := newDispatcher(t)
+	d.client = c
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+	got[0].Attempts++
+	d.processTask(got[0])
+
+	testutil.Length(t, tracer.exported, 2)
+	child := tracer.exported[1]
+	testutil.Equal(t, "name", "process", child.name)
+	testutil.Equal(t, "trace", parent.traceID, child.traceID)
+	testutil.Equal(t, "parent", parent.spanID, child.parentID)
+	testutil.Equal(t, "request id", "abc", requestID)
+}
+
+func TestPropagation__NoMetadata(t *testing.T) {
+	c := mustNewClient(t)
+	c.propagator = testPropagator{}
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	if err := c.Add(testTask{Val: "1"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 1)
+
+	if got[0].Metadata != nil {
+		t.Error("metadata should be nil")
+	}
+}
@@ -3,10 +3,13 @@ package backlite
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/drajk/backlite/internal/task"
 )
 
 type (
@@ -36,6 +39,46 @@ type (
 		// Retention dictates if and how completed tasks will be retained in the database.
 		// If nil, no completed tasks will be retained.
 		Retention *Retention
+
+		// Middleware is applied around the processing of tasks in this queue. The first middleware is the outermost.
+		Middleware []Middleware
+
+		// Codec is the codec used to encode tasks added to this queue.
+		// If omitted, the codec provided to the client will be used.
+		Codec Codec
+
+		// Version is the current version of the task payload, which is stored with each task added to this queue.
+		// It should be incremented whenever the Task type changes in a way that previously added tasks will no
+		// longer decode correctly. If omitted, the version is 1.
+		Version int
+
+		// Upgraders contains the functions which upgrade task payloads to the current Version, keyed by the version
+		// they upgrade from. Each upgrader converts an encoded payload to the following version.
+		Upgraders map[int]Upgrader
+
+		// TTL is the duration after being added within which tasks must start executing, otherwise they expire and
+		// are discarded. Retries are not discarded. If omitted, tasks do not expire.
+		TTL time.Duration
+
+		// RateLimit limits the rate at which tasks in this queue are executed. Tasks are not claimed while the limit
+		// is exhausted, leaving the workers available for other queues.
+		// If nil, the rate is not limited.
+		RateLimit *RateLimit
+
+		// MaxConcurrency is the maximum number of tasks in this queue which can execute at once, across every client
+		// using the database. If omitted, the concurrency is only limited by the number of workers.
+		MaxConcurrency int
+
+		// Throttle bounds the throughput of the tasks in this queue which share a throttle key, such as a customer,
+		// so a single key cannot monopolize the queue.
+		Throttle *Throttle
+
+		// CircuitBreaker pauses the queue while its tasks are failing, such as when a downstream service is
+		// unavailable.
+		CircuitBreaker *CircuitBreaker
+
+		// Batch dictates how tasks are grouped in to batches if the queue was created with NewBatchQueue().
+		Batch *Batch
 	}
 
 	// Retention is the policy for how completed tasks will be retained in the database.
@@ -94,9 +137,7 @@ func (q *queue[T]) Config() *QueueConfig {
 func (q *queue[T]) Process(ctx context.Context, payload []byte) error {
 	var obj T
 
-	err := json.
-		NewDecoder(bytes.NewReader(payload)).
-		Decode(&obj)
+	err := codecFromContext(ctx).Decode(bytes.NewReader(payload), &obj)
 
 	if err != nil {
 		return err
@@ -111,6 +152,30 @@ func (q *queues) add(queue Queue) {
 		panic("queue name is missing")
 	}
 
+	if _, ok := queue.(resulter); ok {
+		if ret := queue.Config().Retention; ret == nil || ret.OnlyFailed {
+			panic(fmt.Sprintf("queue '%s' returns results but does not retain succeeded tasks", queue.Config().Name))
+		}
+	}
+
+	if r := queue.Config().RateLimit; r != nil {
+		if err := r.validate(); err != nil {
+			panic(fmt.Sprintf("queue '%s' has an invalid rate limit: %v", queue.Config().Name, err))
+		}
+	}
+
+	if t := queue.Config().Throttle; t != nil && t.RateLimit != nil {
+		if err := t.RateLimit.validate(); err != nil {
+			panic(fmt.Sprintf("queue '%s' has an invalid throttle rate limit: %v", queue.Config().Name, err))
+		}
+	}
+
+	if b := queue.Config().CircuitBreaker; b != nil {
+		if err := b.validate(); err != nil {
+			panic(fmt.Sprintf("queue '%s' has an invalid circuit breaker: %v", queue.Config().Name, err))
+		}
+	}
+
 	q.Lock()
 	defer q.Unlock()
 
@@ -121,6 +186,72 @@ func (q *queues) add(queue Queue) {
 	q.registry[queue.Config().Name] = queue
 }
 
+// caps returns the maximum concurrency of each queue, and of the throttle keys within each queue, which have one.
+func (q *queues) caps() task.Caps {
+	q.RLock()
+	defer q.RUnlock()
+
+	caps := task.Caps{
+		Queues: make(map[string]int),
+		Keys:   make(map[string]int),
+	}
+
+	for name, queue := range q.registry {
+		cfg := queue.Config()
+
+		if cfg.MaxConcurrency > 0 {
+			caps.Queues[name] = cfg.MaxConcurrency
+		}
+
+		if cfg.Throttle != nil && cfg.Throttle.MaxConcurrency > 0 {
+			caps.Keys[name] = cfg.Throttle.MaxConcurrency
+		}
+	}
+
+	return caps
+}
+
+// sharedThrottles returns the rate limit of the throttle keys within each queue which shares it.
+func (q *queues) sharedThrottles() map[string]*RateLimit {
+	q.RLock()
+	defer q.RUnlock()
+
+	limits := make(map[string]*RateLimit)
+	for name, queue := range q.registry {
+		if t := queue.Config().Throttle; t != nil && t.RateLimit != nil && t.RateLimit.Shared {
+			limits[name] = t.RateLimit
+		}
+	}
+
+	return limits
+}
+
+// batched returns the queues which process tasks in batches, ordered by name.
+func (q *queues) batched() []Queue {
+	q.RLock()
+	defer q.RUnlock()
+
+	var batched []Queue
+	for _, queue := range q.registry {
+		if _, ok := queue.(batcher); ok {
+			batched = append(batched, queue)
+		}
+	}
+
+	slices.SortFunc(batched, func(a, b Queue) int {
+		return strings.Compare(a.Config().Name, b.Config().Name)
+	})
+
+	return batched
+}
+
+// count returns the number of registered queues.
+func (q *queues) count() int {
+	q.RLock()
+	defer q.RUnlock()
+	return len(q.registry)
+}
+
 // get loads a queue from the registry by name.
 func (q *queues) get(name string) Queue {
 	q.RLock()
@@ -0,0 +1,336 @@
+package backlite
+
+import (
+	"errors"
+	"time"
+
+	"github.com/drajk/backlite/internal/limit"
+	"github.com/drajk/backlite/internal/task"
+)
+
+// limitPollInterval is how often the dispatcher fetches again while queues are at their concurrency cap, since tasks
+// may complete in other processes, or when the state of a shared rate limit could not be loaded.
+const limitPollInterval = time.Second
+
+type (
+	// RateLimit is the policy for limiting the rate at which tasks in a queue are executed.
+	RateLimit struct {
+		// Limit is the number of tasks which can be executed per Interval.
+		Limit int
+
+		// Interval is the duration over which Limit tasks can be executed.
+		Interval time.Duration
+
+		// Burst is the maximum number of tasks which can be executed at once after the queue has been idle.
+		// If omitted, Limit is used.
+		Burst int
+
+		// Shared indicates that the limit is shared by every client using the database, rather than enforced per
+		// client, by storing the state of the limit in the database.
+		Shared bool
+	}
+
+	// Throttle is the policy for bounding the throughput of the tasks in a queue which share a throttle key, which is
+	// provided when adding tasks. Each key is limited separately and tasks without a key are not throttled.
+	Throttle struct {
+		// MaxConcurrency is the maximum number of tasks with the same key which can execute at once, across every
+		// client using the database.
+		MaxConcurrency int
+
+		// RateLimit limits the rate at which tasks with the same key are executed.
+		RateLimit *RateLimit
+	}
+
+	// limiter enforces a RateLimit.
+	limiter struct {
+		// bucket is the token bucket, which is only used for its configuration if the limit is shared.
+		bucket limit.Bucket
+
+		// shared indicates that the state of the bucket is stored in the database.
+		shared bool
+
+		// until is the time the limit is exhausted until.
+		until time.Time
+	}
+
+	// concurrency tracks the number of running tasks in the queues, and throttle keys, which have a concurrency cap.
+	concurrency struct {
+		caps   task.Caps
+		queues map[string]int
+		keys   map[task.Throttled]int
+	}
+)
+
+// validate returns an error if the rate limit cannot be enforced.
+func (r *RateLimit) validate() error {
+	switch {
+	case r.Limit < 1:
+		return errors.New("limit must be greater than zero")
+	case r.Interval <= 0:
+		return errors.New("interval must be greater than zero")
+	case r.Burst < 0:
+		return errors.New("burst cannot be negative")
+	}
+	return nil
+}
+
+// limiter returns the limiter for a queue, or a throttle key within a queue, or nil if it is not rate limited.
+func (d *dispatcher) limiter(key task.Throttled) *limiter {
+	if l, ok := d.limiters[key]; ok {
+		return l
+	}
+
+	q := d.client.queues.get(key.Queue)
+	if q == nil {
+		return nil
+	}
+
+	r := q.Config().RateLimit
+	if key.Key != "" {
+		r = nil
+		if t := q.Config().Throttle; t != nil {
+			r = t.RateLimit
+		}
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	if d.limiters == nil {
+		d.limiters = make(map[task.Throttled]*limiter)
+	}
+
+	l := &limiter{
+		bucket: limit.NewBucket(r.Limit, r.Interval, r.Burst, now()),
+		shared: r.Shared,
+	}
+	d.limiters[key] = l
+	return l
+}
+
+// allow takes a token from the rate limits of the throttle key and the queue of a task, if they have them, and returns
+// true if the task can be executed. The throttle key is checked first so a key which has exhausted its limit does not
+// consume the limit of the queue.
+func (d *dispatcher) allow(t *task.Task) bool {
+	queue := task.Throttled{Queue: t.Queue}
+	if t.ThrottleKey == "" {
+		return d.take(queue)
+	}
+
+	key := task.Throttled{Queue: t.Queue, Key: t.ThrottleKey}
+	if !d.take(key) {
+		return false
+	}
+
+	if !d.take(queue) {
+		// The task will not execute, so the token of the throttle key is returned.
+		d.refund(key)
+		return false
+	}
+
+	return true
+}
+
+// take takes a token from the rate limit of a queue, or a throttle key within a queue, if it has one, and returns true
+// if a token was available.
+func (d *dispatcher) take(key task.Throttled) bool {
+	l := d.limiter(key)
+	if l == nil {
+		return true
+	}
+
+	var ok bool
+	var next time.Time
+
+	if l.shared {
+		var err error
+		ok, next, err = limit.TakeShared(d.ctx, d.client.db, sharedName(key), l.bucket, now())
+		if err != nil {
+			d.log.Error("failed to take shared rate limit token",
+				"queue", key.Queue,
+				"error", err,
+			)
+			ok, next = false, now().Add(limitPollInterval)
+		}
+	} else {
+		ok = l.bucket.Take(now())
+		next = l.bucket.Next(now())
+	}
+
+	if !ok {
+		l.until = next
+	}
+
+	return ok
+}
+
+// sharedName returns the name a shared rate limit is stored with. Throttle keys are stored alongside the queues, so
+// they are prefixed with their queue.
+func sharedName(key task.Throttled) string {
+	if key.Key == "" {
+		return key.Queue
+	}
+	return key.Queue + "#" + key.Key
+}
+
+// deleteFullKeys deletes the shared rate limits of throttle keys which have refilled, since they start full when they are
+// next used, so the rate limits of keys which are no longer used do not accumulate in the database.
+func (d *dispatcher) deleteFullKeys() {
+	for queue, r := range d.client.queues.sharedThrottles() {
+		b := limit.NewBucket(r.Limit, r.Interval, r.Burst, now())
+		if _, err := limit.DeleteFull(d.ctx, d.client.db, queue+"#", b, now()); err != nil {
+			d.log.Error("failed to delete full shared rate limits",
+				"queue", queue,
+				"error", err,
+			)
+		}
+	}
+}
+
+// disallow returns the tokens taken by allow for a task which was not executed, such as when another dispatcher claimed
+// it first.
+func (d *dispatcher) disallow(t *task.Task) {
+	d.refund(task.Throttled{Queue: t.Queue})
+	if t.ThrottleKey != "" {
+		d.refund(task.Throttled{Queue: t.Queue, Key: t.ThrottleKey})
+	}
+}
+
+// refund returns a token which was taken from the rate limit of a queue, or a throttle key within a queue, but not
+// used.
+func (d *dispatcher) refund(key task.Throttled) {
+	l := d.limiter(key)
+	if l == nil {
+		return
+	}
+
+	if !l.shared {
+		l.bucket.Give()
+		return
+	}
+
+	if err := limit.GiveShared(d.ctx, d.client.db, sharedName(key), l.bucket, now()); err != nil {
+		d.log.Error("failed to refund shared rate limit token",
+			"queue", key.Queue,
+			"error", err,
+		)
+	}
+}
+
+// limited returns the queues, and throttle keys within queues, which have exhausted their rate limit and the earliest
+// time one of them will be able to execute a task again.
+func (d *dispatcher) limited() (task.Exclusions, time.Time) {
+	var exclude task.Exclusions
+	var refill time.Time
+
+	for key, l := range d.limiters {
+		if !l.until.After(now()) {
+			// Since there can be many throttle keys, remove the limiters which no longer have an effect, which are
+			// those that are shared, since the state is in the database, or full.
+			if key.Key != "" {
+				l.bucket.Refill(now())
+				if l.shared || l.bucket.Tokens >= l.bucket.Burst {
+					delete(d.limiters, key)
+				}
+			}
+			continue
+		}
+
+		if key.Key == "" {
+			exclude.Queues = append(exclude.Queues, key.Queue)
+		} else {
+			exclude.Keys = append(exclude.Keys, key)
+		}
+
+		refill = earliest(refill, l.until)
+	}
+
+	return exclude, refill
+}
+
+// concurrency loads the number of running tasks, which are those claimed after the deadline, in the queues and
+// throttle keys which have a concurrency cap.
+func (d *dispatcher) concurrency(deadline time.Time) (*concurrency, error) {
+	r := &concurrency{
+		caps:   d.client.queues.caps(),
+		queues: make(map[string]int),
+		keys:   make(map[task.Throttled]int),
+	}
+
+	var err error
+
+	if len(r.caps.Queues) > 0 {
+		queues := make([]string, 0, len(r.caps.Queues))
+		for queue := range r.caps.Queues {
+			queues = append(queues, queue)
+		}
+
+		if r.queues, err = task.CountRunning(d.ctx, d.client.db, deadline, queues...); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.caps.Keys) > 0 {
+		queues := make([]string, 0, len(r.caps.Keys))
+		for queue := range r.caps.Keys {
+			queues = append(queues, queue)
+		}
+
+		if r.keys, err = task.CountRunningKeys(d.ctx, d.client.db, deadline, queues...); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// exclude adds the queues and throttle keys which are at their concurrency cap to the exclusions and returns true if
+// any were added.
+func (r *concurrency) exclude(e *task.Exclusions) bool {
+	n := len(e.Queues) + len(e.Keys)
+
+	for queue, c := range r.caps.Queues {
+		if r.queues[queue] >= c {
+			e.Queues = append(e.Queues, queue)
+		}
+	}
+
+	for key, count := range r.keys {
+		if c, ok := r.caps.Keys[key.Queue]; ok && count >= c {
+			e.Keys = append(e.Keys, key)
+		}
+	}
+
+	return len(e.Queues)+len(e.Keys) > n
+}
+
+// full returns true if the queue, or throttle key, of a task is at its concurrency cap.
+func (r *concurrency) full(t *task.Task) bool {
+	if c, ok := r.caps.Queues[t.Queue]; ok && r.queues[t.Queue] >= c {
+		return true
+	}
+
+	if c, ok := r.caps.Keys[t.Queue]; ok && t.ThrottleKey != "" {
+		return r.keys[task.Throttled{Queue: t.Queue, Key: t.ThrottleKey}] >= c
+	}
+
+	return false
+}
+
+// add records that a task is running.
+func (r *concurrency) add(t *task.Task) {
+	r.queues[t.Queue]++
+
+	if t.ThrottleKey != "" {
+		r.keys[task.Throttled{Queue: t.Queue, Key: t.ThrottleKey}]++
+	}
+}
+
+// earliest returns the earliest of two times, ignoring zero times.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,447 @@
+package backlite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/circuit"
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestClient_Register__RateLimit(t *testing.T) {
+	for name, r := range map[string]RateLimit{
+		"no limit":       {Interval: time.Second},
+		"no interval":    {Limit: 1},
+		"negative burst": {Limit: 1, Interval: time.Second, Burst: -1},
+	} {
+		for _, throttled := range []bool{false, true} {
+			c := mustNewClient(t)
+			q := NewQueue[testTaskRateLimited](func(ctx context.Context, _ testTaskRateLimited) error {
+				return nil
+			})
+
+			if throttled {
+				q.Config().RateLimit = nil
+				q.Config().Throttle = &Throttle{RateLimit: &r}
+			} else {
+				q.Config().RateLimit = &r
+			}
+
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("expected panic for %s, throttled: %v", name, throttled)
+					}
+				}()
+				c.Register(q)
+			}()
+		}
+	}
+}
+
+func TestDispatcher_Allow__Refund(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+
+	q := NewQueue[testTaskThrottled](func(ctx context.Context, _ testTaskThrottled) error {
+		return nil
+	})
+	q.Config().RateLimit = &RateLimit{Limit: 1, Interval: time.Hour}
+	d.client.Register(q)
+
+	tk := &task.Task{Queue: "test-throttled", ThrottleKey: "a"}
+	testutil.Equal(t, "first", true, d.allow(tk))
+	testutil.Equal(t, "second", false, d.allow(tk))
+
+	// The token of the throttle key should be returned since the queue had none.
+	l := d.limiters[task.Throttled{Queue: "test-throttled", Key: "a"}]
+	testutil.Equal(t, "tokens", float64(2), l.bucket.Tokens)
+}
+
+func TestDispatcher_Fetch__RateLimit(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ticker = time.NewTicker(time.Hour)
+	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.ready = make(chan struct{}, 1)
+	d.availableWorkers = make(chan struct{}, d.numWorkers)
+	for range d.numWorkers {
+		d.availableWorkers <- struct{}{}
+	}
+
+	d.client.dispatcher = &mockDispatcher{}
+	d.client.Register(NewQueue[testTaskRateLimited](func(ctx context.Context, _ testTaskRateLimited) error {
+		return nil
+	}))
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		return nil
+	}))
+
+	for _, tk := range []Task{
+		testTaskRateLimited{Val: "1"},
+		testTaskRateLimited{Val: "2"},
+		testTaskRateLimited{Val: "3"},
+		testTask{Val: "4"},
+	} {
+		if err := d.client.Add(tk).Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetched := func() []string {
+		var queues []string
+		for len(d.tasks) > 0 {
+			queues = append(queues, (<-d.tasks).Queue)
+			d.availableWorkers <- struct{}{}
+		}
+		return queues
+	}
+
+	// The rate limited queue allows 2 tasks, and the task after them is skipped rather than blocking the other
+	// queues, without fetching again until the limit could have refilled.
+	d.fetch()
+	got := fetched()
+	testutil.Length(t, got, 3)
+	testutil.Equal(t, "queue", "test-ratelimited", got[0])
+	testutil.Equal(t, "queue", "test-ratelimited", got[1])
+	testutil.Equal(t, "queue", "test", got[2])
+	testutil.Equal(t, "ready", 0, len(d.ready))
+
+	// The rate limited queue should be excluded.
+	d.fetch()
+	testutil.Length(t, fetched(), 0)
+	testutil.Equal(t, "ready", 0, len(d.ready))
+
+	// The next token is available after half of the interval.
+	exclude, refill := d.limited()
+	testutil.Length(t, exclude.Queues, 1)
+	testutil.Equal(t, "refill", now().Add(30*time.Minute), refill)
+}
+
+func TestDispatcher_Fetch__Refund(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ticker = time.NewTicker(time.Hour)
+	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.ready = make(chan struct{}, 1)
+	d.availableWorkers = make(chan struct{}, d.numWorkers)
+	for range d.numWorkers {
+		d.availableWorkers <- struct{}{}
+	}
+
+	d.client.dispatcher = &mockDispatcher{}
+	q := NewQueue[testTaskBreaker](func(ctx context.Context, _ testTaskBreaker) error {
+		return nil
+	})
+	q.Config().RateLimit = &RateLimit{Limit: 5, Interval: time.Hour}
+	d.client.Register(q)
+
+	for _, val := range []string{"1", "2", "3"} {
+		if err := d.client.Add(testTaskBreaker{Val: val}).Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The circuit half-opens when fetching, so only the probe task uses a token.
+	b := d.breaker("test-breaker")
+	b.State = circuit.Open
+	b.OpenedAt = now().Add(-time.Hour)
+
+	d.fetch()
+	testutil.Equal(t, "fetched", 1, len(d.tasks))
+	probe := <-d.tasks
+	d.availableWorkers <- struct{}{}
+
+	l := d.limiters[task.Throttled{Queue: "test-breaker"}]
+	testutil.Equal(t, "tokens", float64(4), l.bucket.Tokens)
+
+	// A task which is claimed by another dispatcher first does not use a token.
+	d.recordOutcome(probe, nil)
+	tasks := testutil.GetTasks(t, d.client.db)
+	if _, err := d.client.db.Exec("UPDATE backlite_tasks SET claimed_at = ?", now().UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, "allow", true, d.allow(tasks[0]))
+	claimed, err := d.claim(tasks[:1], now().Add(-time.Hour), d.client.queues.caps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, claimed, 0)
+	testutil.Equal(t, "tokens", float64(4), l.bucket.Tokens)
+}
+
+func TestDispatcher_Fetch__ManyCappedKeys(t *testing.T) {
+	d := newDispatcher(t)
+	d.numWorkers = 60
+	d.ctx = context.Background()
+	d.ticker = time.NewTicker(time.Hour)
+	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.ready = make(chan struct{}, 1)
+	d.availableWorkers = make(chan struct{}, d.numWorkers)
+	for range d.numWorkers {
+		d.availableWorkers <- struct{}{}
+	}
+
+	d.client.dispatcher = &mockDispatcher{}
+	d.client.Register(NewQueue[testTaskThrottled](func(ctx context.Context, _ testTaskThrottled) error {
+		return nil
+	}))
+	d.client.Register(NewQueue[testTask](func(ctx context.Context, _ testTask) error {
+		return nil
+	}))
+
+	// More keys are at their concurrency cap than can be excluded when fetching, which is at most 200.
+	keys := 250
+	add := func() {
+		for i := range keys {
+			err := d.client.Add(testTaskThrottled{Val: "1"}).Throttle(fmt.Sprint(i)).Save()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	add()
+	add()
+	if _, err := d.client.db.Exec("UPDATE backlite_tasks SET claimed_at = ?", now().UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	add()
+
+	if err := d.client.Add(testTask{Val: "1"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tasks with the keys which are not excluded are skipped without blocking the other queue, and the tasks are
+	// fetched again once the running tasks may have completed rather than immediately.
+	d.fetch()
+	if len(d.tasks) != 1 {
+		t.Fatalf("expected 1 task, got %d", len(d.tasks))
+	}
+	testutil.Equal(t, "queue", "test", (<-d.tasks).Queue)
+	testutil.Equal(t, "ready", 0, len(d.ready))
+}
+
+func TestDispatcher_Fetch__Shared(t *testing.T) {
+	// Dispatchers for separate clients sharing a database, as if they were in separate processes.
+	dispatchers := make([]*dispatcher, 2)
+	for i, db := range testutil.NewSharedDBs(t, len(dispatchers)) {
+		c, err := NewClient(ClientConfig{
+			DB:           db,
+			NumWorkers:   3,
+			ReleaseAfter: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Register(NewQueue[testTaskSharedLimit](func(ctx context.Context, _ testTaskSharedLimit) error {
+			return nil
+		}))
+		c.Register(NewQueue[testTaskCapped](func(ctx context.Context, _ testTaskCapped) error {
+			return nil
+		}))
+
+		d := c.dispatcher.(*dispatcher)
+		d.log = &noLogger{}
+		d.ctx = context.Background()
+		d.ticker = time.NewTicker(time.Hour)
+		d.tasks = make(chan *task.Task, d.numWorkers)
+		d.ready = make(chan struct{}, 1)
+		d.availableWorkers = make(chan struct{}, d.numWorkers)
+		for range d.numWorkers {
+			d.availableWorkers <- struct{}{}
+		}
+		dispatchers[i] = d
+	}
+
+	fetched := func(d *dispatcher) task.Tasks {
+		var tasks task.Tasks
+		for len(d.tasks) > 0 {
+			tasks = append(tasks, <-d.tasks)
+			d.availableWorkers <- struct{}{}
+		}
+		for len(d.ready) > 0 {
+			<-d.ready
+		}
+		return tasks
+	}
+
+	add := func(tasks ...Task) {
+		if err := dispatchers[0].client.Add(tasks...).Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The shared rate limit allows 2 tasks across both clients.
+	add(testTaskSharedLimit{Val: "1"}, testTaskSharedLimit{Val: "2"}, testTaskSharedLimit{Val: "3"})
+
+	dispatchers[0].fetch()
+	testutil.Length(t, fetched(dispatchers[0]), 2)
+
+	dispatchers[1].fetch()
+	testutil.Length(t, fetched(dispatchers[1]), 0)
+
+	exclude, refill := dispatchers[1].limited()
+	testutil.Length(t, exclude.Queues, 1)
+	testutil.Equal(t, "queue", "test-sharedlimit", exclude.Queues[0])
+	testutil.Equal(t, "refill", now().Add(30*time.Minute), refill)
+
+	// The concurrency cap allows 2 running tasks across both clients.
+	add(testTaskCapped{Val: "1"}, testTaskCapped{Val: "2"}, testTaskCapped{Val: "3"})
+
+	dispatchers[1].fetch()
+	got := fetched(dispatchers[1])
+	testutil.Length(t, got, 2)
+
+	dispatchers[0].fetch()
+	testutil.Length(t, fetched(dispatchers[0]), 0)
+
+	// The claims are serialized by the claim lock of the queue.
+	var locks int
+	if err := dispatchers[0].client.db.QueryRow(
+		"SELECT COUNT(*) FROM backlite_claim_locks WHERE queue = ?", "test-capped",
+	).Scan(&locks); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "locks", 1, locks)
+
+	// Once a task completes in one process, another can start in the other.
+	dispatchers[1].processTask(got[0])
+
+	dispatchers[0].fetch()
+	got = fetched(dispatchers[0])
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "queue", "test-capped", got[0].Queue)
+}
+
+func TestDispatcher_DeleteFullKeys(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.client.Register(NewQueue[testTaskSharedThrottle](func(ctx context.Context, _ testTaskSharedThrottle) error {
+		return nil
+	}))
+
+	insert := func(name string, tokens float64, at time.Time) {
+		if _, err := d.client.db.Exec(
+			"INSERT INTO backlite_rate_limits (queue, tokens, updated_at) VALUES (?, ?, ?)",
+			name, tokens, at.UnixMilli(),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert("test-sharedthrottle", 0, now())
+	insert("test-sharedthrottle#full", 2, now())
+	insert("test-sharedthrottle#idle", 0, now().Add(-time.Hour))
+	insert("test-sharedthrottle#used", 1, now())
+	insert("test-sharedthrottle-other#full", 2, now())
+
+	d.deleteFullKeys()
+
+	// Only the keys of the queue which have refilled are deleted.
+	rows, err := d.client.db.Query("SELECT queue FROM backlite_rate_limits ORDER BY queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	testutil.Equal(t, "names", "test-sharedthrottle,test-sharedthrottle#used,test-sharedthrottle-other#full",
+		strings.Join(names, ","))
+}
+
+func TestDispatcher_Fetch__Throttle(t *testing.T) {
+	d := newDispatcher(t)
+	d.numWorkers = 5
+	d.ctx = context.Background()
+	d.ticker = time.NewTicker(time.Hour)
+	d.tasks = make(chan *task.Task, d.numWorkers)
+	d.ready = make(chan struct{}, 1)
+	d.availableWorkers = make(chan struct{}, d.numWorkers)
+	for range d.numWorkers {
+		d.availableWorkers <- struct{}{}
+	}
+
+	d.client.dispatcher = &mockDispatcher{}
+	d.client.Register(NewQueue[testTaskThrottled](func(ctx context.Context, _ testTaskThrottled) error {
+		return nil
+	}))
+
+	add := func(key string, vals ...string) {
+		for _, val := range vals {
+			if err := d.client.Add(testTaskThrottled{Val: val}).Throttle(key).Save(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	add("big", "big1", "big2", "big3", "big4", "big5")
+	add("small", "small1")
+	add("", "none1")
+
+	fetched := func() task.Tasks {
+		var tasks task.Tasks
+		for len(d.tasks) > 0 {
+			tasks = append(tasks, <-d.tasks)
+			d.availableWorkers <- struct{}{}
+		}
+		for len(d.ready) > 0 {
+			<-d.ready
+		}
+		return tasks
+	}
+
+	keys := func(tasks task.Tasks) string {
+		k := make([]string, 0, len(tasks))
+		for _, tk := range tasks {
+			k = append(k, tk.ThrottleKey)
+		}
+		return strings.Join(k, ",")
+	}
+
+	// The big key can only run 2 tasks at once, after which its tasks are skipped, so the other keys, and tasks
+	// without a key, are not affected.
+	d.fetch()
+	big := fetched()
+	testutil.Equal(t, "first", "big,big,small", keys(big))
+
+	d.fetch()
+	none := fetched()
+	testutil.Length(t, none, 1)
+	testutil.Equal(t, "second", "", none[0].ThrottleKey)
+
+	d.fetch()
+	testutil.Length(t, fetched(), 0)
+
+	// Once a task with the big key completes, another can run.
+	d.processTask(big[0])
+	d.fetch()
+	next := fetched()
+	testutil.Equal(t, "third", "big", keys(next))
+
+	// The big key has exhausted its rate limit.
+	d.processTask(big[1])
+	d.processTask(next[0])
+	d.fetch()
+	testutil.Length(t, fetched(), 0)
+
+	exclude, refill := d.limited()
+	testutil.Length(t, exclude.Queues, 0)
+	testutil.Length(t, exclude.Keys, 1)
+	testutil.Equal(t, "key", task.Throttled{Queue: "test-throttled", Key: "big"}, exclude.Keys[0])
+	testutil.Equal(t, "refill", now().Add(20*time.Minute), refill)
+}
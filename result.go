@@ -0,0 +1,238 @@
+package backlite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+)
+
+// awaitPollInterval is how often Await checks the database for the outcome of a task which may be executed by
+// another process.
+const awaitPollInterval = time.Second
+
+type (
+	// ResultProcessor is a generic processor callback for a given result queue to process Tasks and return a result,
+	// which is stored with the completed task so it can be loaded with Result().
+	ResultProcessor[T Task, R any] func(context.Context, T) (R, error)
+
+	// resultQueue provides a type-safe implementation of Queue which stores the results returned by the processor.
+	resultQueue[T Task, R any] struct {
+		config    *QueueConfig
+		processor ResultProcessor[T, R]
+	}
+
+	// resulter is implemented by queues which return results.
+	resulter interface {
+		results()
+	}
+
+	// waiters stores a registry of channels waiting for tasks to complete, keyed by task ID.
+	waiters struct {
+		registry map[string][]chan Event
+		sync.Mutex
+	}
+
+	// ctxKeyResult is used to store the execution which the encoded result of a task is stored in, in a context.
+	ctxKeyResult struct{}
+)
+
+// NewResultQueue creates a new type-safe Queue of a given Task type whose processor returns a result. The result is
+// encoded with the codec of the task and stored with the completed task, so the configuration of the queue must
+// retain succeeded tasks.
+func NewResultQueue[T Task, R any](processor ResultProcessor[T, R]) Queue {
+	var task T
+	cfg := task.Config()
+
+	return &resultQueue[T, R]{
+		config:    &cfg,
+		processor: processor,
+	}
+}
+
+func (q *resultQueue[T, R]) Config() *QueueConfig {
+	return q.config
+}
+
+func (q *resultQueue[T, R]) Process(ctx context.Context, payload []byte) error {
+	var obj T
+
+	codec := codecFromContext(ctx)
+	if err := codec.Decode(bytes.NewReader(payload), &obj); err != nil {
+		return err
+	}
+
+	res, err := q.processor(ctx, obj)
+	if err != nil {
+		return err
+	}
+
+	// Encode the result in to the execution provided by the dispatcher, if any.
+	exec, ok := ctx.Value(ctxKeyResult{}).(*execution)
+	if !ok {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = codec.Encode(buf, res); err != nil {
+		return fmt.Errorf("unable to encode result: %w", err)
+	}
+	exec.store(buf.Bytes())
+
+	return nil
+}
+
+func (q *resultQueue[T, R]) results() {}
+
+// Result loads and decodes the result returned by the processor of a task in a queue created with NewResultQueue().
+// ErrTaskNotCompleted is returned if the task has not completed, or was not retained, and ErrExpired or ErrTaskFailed
+// are returned if the task did not succeed.
+func Result[T any](ctx context.Context, c *Client, id string) (T, error) {
+	var v T
+
+	completed, err := task.GetCompleted(ctx, c.db, id)
+	switch {
+	case err != nil:
+		return v, err
+	case completed == nil:
+		return v, ErrTaskNotCompleted
+	}
+
+	if err = outcome(completed); err != nil {
+		return v, err
+	}
+
+	if completed.Result == nil {
+		return v, ErrNoResult
+	}
+
+	codec := c.codecs.get(completed.Codec)
+	if codec == nil {
+		return v, fmt.Errorf("codec '%s' not registered", completed.Codec)
+	}
+
+	data, err := c.unpackResult(completed)
+	if err != nil {
+		return v, err
+	}
+
+	err = codec.Decode(bytes.NewReader(data), &v)
+	return v, err
+}
+
+// Await blocks until a task completes or the context is cancelled. Nil is returned if the task succeeded, otherwise
+// ErrExpired or ErrTaskFailed, which wraps the error of the task. Tasks executed by this client are awaited using the
+// dispatcher events, while tasks executed elsewhere are awaited by polling the database, which requires the queue to
+// retain completed tasks, otherwise ErrTaskNotFound is returned once the task completes.
+func (c *Client) Await(ctx context.Context, id string) error {
+	// Wait for events before checking the database so the completion cannot be missed.
+	done := c.waiters.add(id)
+	defer c.waiters.remove(id, done)
+
+	ticker := time.NewTicker(awaitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if ok, err := c.poll(ctx, id); ok {
+			return err
+		}
+
+		select {
+		case e := <-done:
+			switch e.Type {
+			case EventSucceeded:
+				return nil
+			case EventExpired:
+				return ErrExpired
+			default:
+				return fmt.Errorf("%w: %w", ErrTaskFailed, e.Error)
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// poll checks the database to determine if a task has completed, and if so, returns the outcome of it.
+func (c *Client) poll(ctx context.Context, id string) (bool, error) {
+	// Check for the task first since it is moved to the completed tasks in the same transaction it is removed.
+	exists, err := task.Exists(ctx, c.db, id)
+	switch {
+	case err != nil:
+		return true, err
+	case exists:
+		return false, nil
+	}
+
+	completed, err := task.GetCompleted(ctx, c.db, id)
+	switch {
+	case err != nil:
+		return true, err
+	case completed == nil:
+		return true, ErrTaskNotFound
+	}
+
+	return true, outcome(completed)
+}
+
+// outcome returns the error which describes the outcome of a completed task, which is nil if it succeeded.
+func outcome(c *task.Completed) error {
+	switch {
+	case c.Expired:
+		return ErrExpired
+	case c.Succeeded:
+		return nil
+	case c.Error == nil:
+		return ErrTaskFailed
+	default:
+		return fmt.Errorf("%w: %s", ErrTaskFailed, *c.Error)
+	}
+}
+
+// add registers a channel which receives the event emitted when a given task completes.
+func (w *waiters) add(id string) chan Event {
+	w.Lock()
+	defer w.Unlock()
+
+	ch := make(chan Event, 1)
+	w.registry[id] = append(w.registry[id], ch)
+	return ch
+}
+
+// remove removes a channel from the registry.
+func (w *waiters) remove(id string, ch chan Event) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.registry[id] = slices.DeleteFunc(w.registry[id], func(v chan Event) bool {
+		return v == ch
+	})
+
+	if len(w.registry[id]) == 0 {
+		delete(w.registry, id)
+	}
+}
+
+// notify is a Hook which passes the events emitted when tasks complete to the channels waiting for them.
+func (w *waiters) notify(_ context.Context, e Event) {
+	switch e.Type {
+	case EventSucceeded, EventExhausted, EventExpired, EventAbandoned:
+	default:
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	for _, ch := range w.registry[e.TaskID] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package backlite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+func TestResultQueue_Process(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	q := NewResultQueue[testTask, string](func(ctx context.Context, tk testTask) (string, error) {
+		if tk.Val == "fail" {
+			return "", errFailed
+		}
+		return "url:" + tk.Val, nil
+	})
+
+	exec := &execution{}
+	ctx := context.WithValue(context.Background(), ctxKeyResult{}, exec)
+
+	err := q.Process(ctx, testutil.Encode(t, testTask{Val: "1"}))
+	testutil.Equal(t, "error", nil, err)
+	testutil.Equal(t, "result", "\"url:1\"\n", string(exec.result))
+
+	exec.result = nil
+	err = q.Process(ctx, testutil.Encode(t, testTask{Val: "fail"}))
+	testutil.Equal(t, "error", errFailed, err)
+	testutil.Equal(t, "result", "", string(exec.result))
+
+	// Once sealed, the result is discarded.
+	exec.seal()
+	err = q.Process(ctx, testutil.Encode(t, testTask{Val: "1"}))
+	testutil.Equal(t, "error", nil, err)
+	testutil.Equal(t, "result", "", string(exec.result))
+
+	// Without an execution, the result is discarded.
+	err = q.Process(context.Background(), testutil.Encode(t, testTask{Val: "1"}))
+	testutil.Equal(t, "error", nil, err)
+}
+
+func TestClient_Register__Result(t *testing.T) {
+	c := mustNewClient(t)
+	c.Register(NewResultQueue[testTask, string](func(_ context.Context, _ testTask) (string, error) {
+		return "", nil
+	}))
+
+	register := func(q Queue) (panicked bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = true
+			}
+		}()
+		c.Register(q)
+		return false
+	}
+
+	if !register(NewResultQueue[testTaskNoRention, string](func(_ context.Context, _ testTaskNoRention) (string, error) {
+		return "", nil
+	})) {
+		t.Error("expected panic without retention")
+	}
+
+	if !register(NewResultQueue[testTaskRetainFailed, string](
+		func(_ context.Context, _ testTaskRetainFailed) (string, error) {
+			return "", nil
+		},
+	)) {
+		t.Error("expected panic when only retaining failed tasks")
+	}
+}
+
+func TestDispatcher_ProcessTask__Result(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+
+	d.client.Register(NewResultQueue[testTask, string](func(ctx context.Context, tk testTask) (string, error) {
+		return "url:" + tk.Val, nil
+	}))
+
+	tk := &task.Task{
+		ID:        "4",
+		Queue:     "test",
+		Task:      testutil.Encode(t, &testTask{Val: "1"}),
+		Attempts:  1,
+		CreatedAt: now(),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+
+	d.processTask(tk)
+
+	ct := testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 1)
+	testutil.Equal(t, "succeeded", true, ct[0].Succeeded)
+	testutil.Equal(t, "result", "\"url:1\"\n", string(ct[0].Result))
+
+	got, err := Result[string](context.Background(), d.client, "4")
+	testutil.Equal(t, "error", nil, err)
+	testutil.Equal(t, "value", "url:1", got)
+}
+
+func TestDispatcher_ProcessTask__ResultEncrypted(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.client.dispatcher = &mockDispatcher{}
+	d.client.keys = KeyRing{Current: "1", Keys: map[string][]byte{"1": bytes.Repeat([]byte("1"), 32)}}
+	d.client.compression = &Compression{Algorithm: CompressionGzip, Threshold: 1}
+
+	d.client.Register(NewResultQueue[testTask, string](func(ctx context.Context, tk testTask) (string, error) {
+		return "secret:" + tk.Val, nil
+	}))
+
+	if err := d.client.Add(testTask{Val: "1"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := testutil.GetTasks(t, d.client.db)[0]
+	tk.Attempts++
+	d.processTask(tk)
+
+	// The result should be compressed and encrypted with the algorithm and key of the task.
+	ct := testutil.GetCompletedTasks(t, d.client.db)
+	testutil.Length(t, ct, 1)
+	testutil.Equal(t, "key id", "1", ct[0].KeyID)
+	testutil.Equal(t, "compression", string(CompressionGzip), ct[0].Compression)
+	testutil.Equal(t, "plaintext", false, bytes.Contains(ct[0].Result, []byte("secret")))
+
+	got, err := Result[string](context.Background(), d.client, tk.ID)
+	testutil.Equal(t, "error", nil, err)
+	testutil.Equal(t, "value", "secret:1", got)
+
+	// The result cannot be swapped with the payload of the task.
+	ct[0].Result = ct[0].Task
+	if _, err = d.client.unpackResult(ct[0]); err == nil {
+		t.Error("expected error unpacking the payload as the result")
+	}
+}
+
+func TestResult(t *testing.T) {
+	c := mustNewClient(t)
+	ctx := context.Background()
+	errStr := "bad input"
+
+	result := bytes.NewBuffer(nil)
+	if err := (GobCodec{}).Encode(result, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.InsertCompleted(t, c.db, task.Completed{
+		ID:        "succeeded",
+		Queue:     "test",
+		Succeeded: true,
+		Codec:     "gob",
+		Result:    result.Bytes(),
+	})
+	testutil.InsertCompleted(t, c.db, task.Completed{
+		ID:        "no-result",
+		Queue:     "test",
+		Succeeded: true,
+	})
+	testutil.InsertCompleted(t, c.db, task.Completed{
+		ID:    "failed",
+		Queue: "test",
+		Error: &errStr,
+	})
+	testutil.InsertCompleted(t, c.db, task.Completed{
+		ID:      "expired",
+		Queue:   "test",
+		Expired: true,
+	})
+
+	got, err := Result[int](ctx, c, "succeeded")
+	testutil.Equal(t, "error", nil, err)
+	testutil.Equal(t, "value", 42, got)
+
+	_, err = Result[int](ctx, c, "no-result")
+	testutil.Equal(t, "no result", ErrNoResult, err)
+
+	_, err = Result[int](ctx, c, "failed")
+	if !errors.Is(err, ErrTaskFailed) {
+		t.Errorf("expected failure, got %v", err)
+	}
+	testutil.Equal(t, "failed message", "task failed: bad input", err.Error())
+
+	_, err = Result[int](ctx, c, "expired")
+	testutil.Equal(t, "expired", ErrExpired, err)
+
+	_, err = Result[int](ctx, c, "missing")
+	testutil.Equal(t, "missing", ErrTaskNotCompleted, err)
+}
+
+func TestClient_Await(t *testing.T) {
+	c := mustNewClient(t)
+	ctx := context.Background()
+
+	testutil.InsertCompleted(t, c.db, task.Completed{
+		ID:        "succeeded",
+		Queue:     "test",
+		Succeeded: true,
+	})
+	testutil.InsertCompleted(t, c.db, task.Completed{
+		ID:      "expired",
+		Queue:   "test",
+		Expired: true,
+	})
+
+	testutil.Equal(t, "succeeded", nil, c.Await(ctx, "succeeded"))
+	testutil.Equal(t, "expired", ErrExpired, c.Await(ctx, "expired"))
+	testutil.Equal(t, "missing", ErrTaskNotFound, c.Await(ctx, "missing"))
+
+	// Pending tasks are awaited until the context is cancelled.
+	testutil.InsertTask(t, c.db, &task.Task{
+		ID:        "pending",
+		Queue:     "test",
+		Task:      testutil.Encode(t, testTask{Val: "1"}),
+		CreatedAt: now(),
+	})
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	testutil.Equal(t, "timeout", context.DeadlineExceeded, c.Await(timeout, "pending"))
+
+	// Pending tasks are awaited until the dispatcher emits an event that they completed.
+	errFailed := errors.New("failed")
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Await(ctx, "pending")
+	}()
+
+	testutil.Wait()
+	c.hooks.emit(ctx, Event{Type: EventRetrying, TaskID: "pending", Error: errFailed})
+	c.hooks.emit(ctx, Event{Type: EventExhausted, TaskID: "other", Error: errFailed})
+	c.hooks.emit(ctx, Event{Type: EventExhausted, TaskID: "pending", Error: errFailed})
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTaskFailed) || !errors.Is(err, errFailed) {
+			t.Errorf("expected task failure, got %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("await did not return")
+	}
+
+	testutil.Equal(t, "waiters", 0, len(c.waiters.registry))
+}
@@ -3,16 +3,89 @@ package backlite
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 )
 
+var (
+	// ErrExpired is the error recorded for tasks which expired before they were executed.
+	ErrExpired = errors.New("task expired before it was executed")
+
+	// ErrTaskNotPending is returned when modifying a task which does not exist, possibly because it has completed,
+	// or which has been claimed for execution.
+	ErrTaskNotPending = errors.New("task not found or already claimed for execution")
+
+	// ErrTaskNotCompleted is returned when loading the result of a task which has not completed, or which completed
+	// without being retained.
+	ErrTaskNotCompleted = errors.New("task not completed or not retained")
+
+	// ErrTaskNotFound is returned when awaiting a task which does not exist, possibly because it completed without
+	// being retained.
+	ErrTaskNotFound = errors.New("task not found")
+
+	// ErrTaskFailed is returned when awaiting, or loading the result of, a task which failed, wrapping the error
+	// of the task.
+	ErrTaskFailed = errors.New("task failed")
+
+	// ErrNoResult is returned when loading the result of a task which succeeded without returning a result, because
+	// its queue was not created with NewResultQueue().
+	ErrNoResult = errors.New("task did not return a result")
+
+	// ErrParentFailed is the error recorded for tasks which were abandoned because a task they depend on failed, and
+	// is returned when adding tasks which depend on a task that has already failed.
+	ErrParentFailed = errors.New("parent task failed")
+
+	// ErrGroupCompleted is returned when adding tasks to a group in which every task has already completed.
+	ErrGroupCompleted = errors.New("group already completed")
+
+	// ErrGroupNotFound is returned when loading the status of a group which does not exist.
+	ErrGroupNotFound = errors.New("group not found")
+
+	// ErrBatchTimeout is returned when adding tasks with a timeout to a batch queue, since the timeout of the queue
+	// applies to the entire batch.
+	ErrBatchTimeout = errors.New("batch queues do not support task timeouts")
+
+	// ErrWorkflowNotFailed is returned when retrying the compensations of a workflow run which does not exist or has
+	// not failed.
+	ErrWorkflowNotFailed = errors.New("workflow run not found or not failed")
+)
+
+const (
+	// CancelOnParentFailure abandons a task, along with the tasks which depend on it, without executing it if any of
+	// its parents fail. This is the default.
+	CancelOnParentFailure ParentFailure = iota
+
+	// RunOnParentFailure executes a task once its parents complete, even if they failed.
+	RunOnParentFailure
+)
+
 type (
+	// ParentFailure is the policy for a task when a task it depends on fails.
+	ParentFailure int
+
 	// Task represents a task that will be placed in to a queue for execution.
 	Task interface {
 		// Config returns the configuration options for the queue that this Task will be placed in.
 		Config() QueueConfig
 	}
 
+	// Validator is an optional interface which a Task can implement in order to be validated when it is added.
+	// If validation fails, none of the tasks being added are saved.
+	Validator interface {
+		// Validate returns an error if the Task is invalid.
+		Validate() error
+	}
+
+	// ValidationError is returned when adding tasks if a Task failed validation.
+	ValidationError struct {
+		// Index is the index of the invalid Task within the tasks being added.
+		Index int
+
+		// Err is the error returned by the Task validation.
+		Err error
+	}
+
 	// TaskAddOp facilitates adding Tasks to the queue.
 	TaskAddOp struct {
 		client *Client
@@ -20,6 +93,25 @@ type (
 		tasks  []Task
 		wait   *time.Time
 		tx     *sql.Tx
+		tags   map[string]string
+
+		maxAttempts *int
+		timeout     *time.Duration
+		backoff     *time.Duration
+		deadline    *time.Time
+		debounce    string
+		partition   string
+		throttle    string
+		after       []string
+		onFailure   ParentFailure
+		grouped     bool
+		group       string
+		callback    Task
+		held        bool
+
+		ids      []string
+		blobs    []string
+		replaced []string
 	}
 )
 
@@ -41,11 +133,121 @@ func (t *TaskAddOp) Wait(duration time.Duration) *TaskAddOp {
 	return t
 }
 
+// Tags sets key/value pairs, such as a customer ID or tenant, which are stored with the tasks, carried in to the
+// completed tasks, and can be used to filter tasks.
+func (t *TaskAddOp) Tags(tags map[string]string) *TaskAddOp {
+	t.tags = tags
+	return t
+}
+
+// MaxAttempts overrides the maximum number of attempts to execute the tasks, rather than using the value in the
+// configuration of their queue.
+func (t *TaskAddOp) MaxAttempts(attempts int) *TaskAddOp {
+	t.maxAttempts = &attempts
+	return t
+}
+
+// Timeout overrides the duration the tasks are allowed to execute for, rather than using the value in the
+// configuration of their queue. This should remain lower than the release duration of the client. This is not
+// supported by batch queues.
+func (t *TaskAddOp) Timeout(timeout time.Duration) *TaskAddOp {
+	t.timeout = &timeout
+	return t
+}
+
+// Backoff overrides the duration failed tasks will be held in the queue until being retried, rather than using the
+// value in the configuration of their queue.
+func (t *TaskAddOp) Backoff(backoff time.Duration) *TaskAddOp {
+	t.backoff = &backoff
+	return t
+}
+
+// Deadline sets the time before which the tasks must start executing, otherwise they expire and are discarded.
+// Only the first attempt is subject to the deadline, so retries still execute after it has passed.
+// This overrides the TTL in the configuration of their queue.
+func (t *TaskAddOp) Deadline(deadline time.Time) *TaskAddOp {
+	t.deadline = &deadline
+	return t
+}
+
+// TTL sets the duration, from now, within which the tasks must start executing, otherwise they expire and are
+// discarded. This overrides the TTL in the configuration of their queue.
+func (t *TaskAddOp) TTL(ttl time.Duration) *TaskAddOp {
+	return t.Deadline(now().Add(ttl))
+}
+
+// Debounce replaces any tasks in the same queue that were added with the same key, and have not yet been claimed,
+// and waits the given period before the tasks are executed. When tasks are added repeatedly, only the last one will
+// execute, once the period has passed without another being added. Likewise, only the last of the provided tasks in
+// each queue is added. This overrides At() and Wait().
+func (t *TaskAddOp) Debounce(key string, period time.Duration) *TaskAddOp {
+	t.debounce = key
+	return t.Wait(period)
+}
+
+// Partition places the tasks in a partition of their queue with a given key, such as an account ID. Tasks within a
+// partition are executed one at a time, in the order they were added, even across multiple processes sharing the
+// database, while tasks in different partitions, or queues, execute concurrently. A task that is being retried blocks
+// the rest of its partition.
+func (t *TaskAddOp) Partition(key string) *TaskAddOp {
+	t.partition = key
+	return t
+}
+
+// Throttle sets the key, such as a customer ID, used to bound the throughput of the tasks in their queue which share
+// the key, according to the Throttle in the configuration of the queue, so a single key cannot monopolize the queue.
+func (t *TaskAddOp) Throttle(key string) *TaskAddOp {
+	t.throttle = key
+	return t
+}
+
+// After holds the tasks until the tasks with the given IDs, their parents, have all succeeded. If a parent fails, the
+// tasks are abandoned unless OnParentFailure() says otherwise. Parents which have already succeeded, or which completed
+// without being retained, are not waited for, while adding tasks which depend on a parent that has already failed
+// returns ErrParentFailed, unless the tasks run on parent failure.
+func (t *TaskAddOp) After(ids ...string) *TaskAddOp {
+	t.after = append(t.after, ids...)
+	return t
+}
+
+// OnParentFailure sets the policy for the tasks when any of the parents provided to After() fail.
+// If omitted, CancelOnParentFailure is used.
+func (t *TaskAddOp) OnParentFailure(policy ParentFailure) *TaskAddOp {
+	t.onFailure = policy
+	return t
+}
+
+// Group adds the tasks to a group with a given ID, such as a campaign, whose progress is updated as each task completes
+// and can be loaded with Client.GroupStatus(). If the ID is empty, one is generated, which GroupID() returns once the
+// tasks are saved. Tasks can be added to a group across multiple operations until every task in it has completed,
+// after which ErrGroupCompleted is returned.
+func (t *TaskAddOp) Group(id string) *TaskAddOp {
+	t.grouped = true
+	t.group = id
+	return t
+}
+
+// OnGroupComplete adds a callback task which is held until every task in the group has completed, whether or not
+// they succeeded. If Group() was not called, the tasks are added to a new group. The callback does not expire, since
+// the group may take longer to complete than the TTL of its queue.
+func (t *TaskAddOp) OnGroupComplete(callback Task) *TaskAddOp {
+	t.grouped = true
+	t.callback = callback
+	return t
+}
+
+// GroupID returns the ID of the group the tasks were added to, once they have been saved.
+func (t *TaskAddOp) GroupID() string {
+	return t.group
+}
+
 // Tx will include the task as part of a given database transaction.
 // When using this, it is critical that after you commit the transaction that you call Notify() on the
 // client so the dispatcher is aware that a new task has been created, otherwise it may not be executed.
 // This is necessary because there is, unfortunately, no way for outsiders to know if or when a transaction
 // is committed and since the dispatcher avoids continuous polling, it needs to know when tasks are added.
+// For the same reason, if payloads are offloaded, the blobs of the tasks are not deleted if the transaction is
+// rolled back, see Blobs().
 func (t *TaskAddOp) Tx(tx *sql.Tx) *TaskAddOp {
 	t.tx = tx
 	return t
@@ -55,3 +257,31 @@ func (t *TaskAddOp) Tx(tx *sql.Tx) *TaskAddOp {
 func (t *TaskAddOp) Save() error {
 	return t.client.save(t)
 }
+
+// IDs returns the IDs of the tasks, in the order they were provided, once they have been saved. When debouncing, only
+// the IDs of the tasks which were added are included.
+func (t *TaskAddOp) IDs() []string {
+	return t.ids
+}
+
+// Blobs returns the keys of the blobs the payloads of the tasks were offloaded to, once saved. If a transaction was
+// provided and it is rolled back, these should be deleted from the BlobStore, since the tasks which use them will not
+// exist, otherwise they remain in the store.
+func (t *TaskAddOp) Blobs() []string {
+	return t.blobs
+}
+
+// ReplacedBlobs returns the keys of the blobs of offloaded tasks which were replaced when debouncing, once saved.
+// These are deleted by the client unless a transaction was provided, in which case they should be deleted from the
+// BlobStore once the transaction has been committed, otherwise they remain in the store.
+func (t *TaskAddOp) ReplacedBlobs() []string {
+	return t.replaced
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("task %d is invalid: %v", e.Index, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
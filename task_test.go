@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -191,3 +192,262 @@ func TestTaskAddOp_Save__Transaction(t *testing.T) {
 	got := testutil.GetTasks(t, c.db)
 	testutil.Length(t, got, 1)
 }
+
+func TestTaskAddOp_Tags(t *testing.T) {
+	op := &TaskAddOp{}
+	tags := map[string]string{"customer": "42"}
+	op.Tags(tags)
+	testutil.Equal(t, "tags", "42", op.tags["customer"])
+}
+
+func TestTaskAddOp_Save__Tags(t *testing.T) {
+	c := mustNewClient(t)
+	m := &mockDispatcher{}
+	c.dispatcher = m
+	defer c.db.Close()
+
+	tk := testTask{Val: "g"}
+	op := c.Add(tk).Tags(map[string]string{"customer": "42", "source": "api"})
+
+	if err := op.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 1)
+	testutil.Equal(t, "tags", 2, len(got[0].Tags))
+	testutil.Equal(t, "customer", "42", got[0].Tags["customer"])
+	testutil.Equal(t, "source", "api", got[0].Tags["source"])
+}
+
+func TestTaskAddOp_Overrides(t *testing.T) {
+	op := &TaskAddOp{}
+	op.MaxAttempts(5).Timeout(time.Minute).Backoff(time.Second)
+	testutil.Equal(t, "max attempts", 5, *op.maxAttempts)
+	testutil.Equal(t, "timeout", time.Minute, *op.timeout)
+	testutil.Equal(t, "backoff", time.Second, *op.backoff)
+}
+
+func TestTaskAddOp_Save__Overrides(t *testing.T) {
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	if err := c.Add(testTask{Val: "a"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Add(testTask{Val: "b"}).
+		MaxAttempts(5).
+		Timeout(time.Minute).
+		Backoff(1500 * time.Microsecond).
+		Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 2)
+
+	if got[0].MaxAttempts != nil || got[0].Timeout != nil || got[0].Backoff != nil {
+		t.Error("overrides should not be set")
+	}
+
+	testutil.Equal(t, "max attempts", 5, *got[1].MaxAttempts)
+	testutil.Equal(t, "timeout", time.Minute, *got[1].Timeout)
+	testutil.Equal(t, "backoff", 1500*time.Microsecond, *got[1].Backoff)
+}
+
+func TestTaskAddOp_Deadline(t *testing.T) {
+	op := &TaskAddOp{}
+	deadline := time.Now().Add(time.Hour)
+	op.Deadline(deadline)
+	testutil.Equal(t, "deadline", deadline, *op.deadline)
+
+	op.TTL(time.Minute)
+	testutil.Equal(t, "ttl", now().Add(time.Minute), *op.deadline)
+}
+
+func TestTaskAddOp_Save__Deadline(t *testing.T) {
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	if err := c.Add(testTask{Val: "a"}, testTaskExpiring{Val: "b"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Add(testTaskExpiring{Val: "c"}).TTL(time.Minute).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 3)
+
+	if got[0].Deadline != nil {
+		t.Error("deadline should not be set")
+	}
+
+	testutil.Equal(t, "queue ttl", now().Add(10*time.Minute), *got[1].Deadline)
+	testutil.Equal(t, "task ttl", now().Add(time.Minute), *got[2].Deadline)
+}
+
+func TestTaskAddOp_Debounce(t *testing.T) {
+	op := &TaskAddOp{}
+	op.Debounce("doc-1", time.Minute)
+	testutil.Equal(t, "key", "doc-1", op.debounce)
+	testutil.Equal(t, "wait", now().Add(time.Minute), *op.wait)
+}
+
+func TestTaskAddOp_Save__Debounce(t *testing.T) {
+	ctx := context.Background()
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	add := func(tk Task, key string) {
+		if err := c.Add(tk).Debounce(key, time.Minute).Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A task with the same key which has been claimed should not be replaced.
+	add(testTask{Val: "claimed"}, "doc-1")
+	if _, err := testutil.GetTasks(t, c.db).Claim(ctx, c.db, now(), task.Caps{}); err != nil {
+		t.Fatal(err)
+	}
+
+	add(testTask{Val: "1"}, "doc-1")
+	add(testTask{Val: "2"}, "doc-1")
+	add(testTask{Val: "other"}, "doc-2")
+	add(testTaskNoRention{Val: "other queue"}, "doc-1")
+
+	// Within a provided transaction.
+	tx, err := c.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Add(testTask{Val: "3"}).Debounce("doc-1", time.Hour).Tx(tx).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 4)
+
+	expected := []struct {
+		val, key string
+	}{
+		{"claimed", "doc-1"},
+		{"other", "doc-2"},
+		{"other queue", "doc-1"},
+		{"3", "doc-1"},
+	}
+
+	for i, e := range expected {
+		testutil.Equal(t, "task", string(testutil.Encode(t, testTask{Val: e.val})), string(got[i].Task))
+		testutil.Equal(t, "key", e.key, got[i].DebounceKey)
+	}
+
+	testutil.Equal(t, "wait until", now().Add(time.Hour), *got[3].WaitUntil)
+}
+
+func TestTaskAddOp_Save__DebounceMany(t *testing.T) {
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	defer c.db.Close()
+
+	var added []string
+	c.hooks.add(func(ctx context.Context, e Event) {
+		if e.Type == EventAdded {
+			added = append(added, e.TaskID)
+		}
+	})
+
+	op := c.Add(testTask{Val: "1"}, testTaskNoRention{Val: "other queue"}, testTask{Val: "2"}).Debounce("doc-1", time.Minute)
+	if err := op.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the last task in each queue should be added.
+	got := testutil.GetTasks(t, c.db)
+	testutil.Length(t, got, 2)
+	testutil.Equal(t, "task", string(testutil.Encode(t, testTaskNoRention{Val: "other queue"})), string(got[0].Task))
+	testutil.Equal(t, "task", string(testutil.Encode(t, testTask{Val: "2"})), string(got[1].Task))
+
+	testutil.Length(t, op.IDs(), 2)
+	testutil.Length(t, added, 2)
+	for i, tk := range got {
+		testutil.Equal(t, "id", tk.ID, op.IDs()[i])
+		testutil.Equal(t, "added", tk.ID, added[i])
+	}
+}
+
+func TestTaskAddOp_Save__DebounceReplacedBlobs(t *testing.T) {
+	ctx := context.Background()
+	store := FileBlobStore{Dir: t.TempDir()}
+	c := mustNewClient(t)
+	c.dispatcher = &mockDispatcher{}
+	c.offload = &Offload{Store: store, Threshold: 50}
+	defer c.db.Close()
+
+	large := testTask{Val: strings.Repeat("a", 100)}
+	if err := c.Add(large).Debounce("doc-1", time.Minute).Save(); err != nil {
+		t.Fatal(err)
+	}
+	blob := string(testutil.GetTasks(t, c.db)[0].Task)
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := c.Add(testTask{Val: "b"}).Debounce("doc-1", time.Minute).Tx(tx)
+	if err = op.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blob of the replaced task is left for the caller, who provided the transaction.
+	testutil.Length(t, op.ReplacedBlobs(), 1)
+	testutil.Equal(t, "blob", blob, op.ReplacedBlobs()[0])
+
+	if _, err = store.Get(ctx, blob); err != nil {
+		t.Errorf("blob deleted: %v", err)
+	}
+}
+
+func TestTaskAddOp_Save__Validation(t *testing.T) {
+	c := mustNewClient(t)
+	m := &mockDispatcher{}
+	c.dispatcher = m
+	defer c.db.Close()
+
+	err := c.Add(testTaskValidated{Val: "a"}, testTaskValidated{}, testTask{Val: "b"}).Save()
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	testutil.Equal(t, "index", 1, verr.Index)
+	testutil.Equal(t, "message", "task 1 is invalid: val is required", err.Error())
+
+	if !errors.Is(err, errTestTaskInvalid) {
+		t.Error("validation error does not wrap the task error")
+	}
+
+	testutil.Length(t, testutil.GetTasks(t, c.db), 0)
+	testutil.Equal(t, "notified", false, m.notified)
+
+	if err = c.Add(testTaskValidated{Val: "a"}, testTask{Val: "b"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, testutil.GetTasks(t, c.db), 2)
+}
@@ -1,6 +1,11 @@
 package backlite
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+var errTestTaskInvalid = errors.New("val is required")
 
 type testTask struct {
 	Val string
@@ -115,3 +120,144 @@ func (t testTaskNoName) Config() QueueConfig {
 		Name: "",
 	}
 }
+
+type testTaskValidated struct {
+	Val string
+}
+
+func (t testTaskValidated) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-validated",
+		MaxAttempts: 1,
+	}
+}
+
+func (t testTaskValidated) Validate() error {
+	if t.Val == "" {
+		return errTestTaskInvalid
+	}
+	return nil
+}
+
+type testTaskExpiring struct {
+	Val string
+}
+
+func (t testTaskExpiring) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-expiring",
+		MaxAttempts: 1,
+		TTL:         10 * time.Minute,
+	}
+}
+
+type testTaskRateLimited struct {
+	Val string
+}
+
+func (t testTaskRateLimited) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-ratelimited",
+		MaxAttempts: 1,
+		RateLimit: &RateLimit{
+			Limit:    2,
+			Interval: time.Hour,
+		},
+	}
+}
+
+type testTaskSharedLimit struct {
+	Val string
+}
+
+func (t testTaskSharedLimit) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-sharedlimit",
+		MaxAttempts: 1,
+		RateLimit: &RateLimit{
+			Limit:    2,
+			Interval: time.Hour,
+			Shared:   true,
+		},
+	}
+}
+
+type testTaskCapped struct {
+	Val string
+}
+
+func (t testTaskCapped) Config() QueueConfig {
+	return QueueConfig{
+		Name:           "test-capped",
+		MaxConcurrency: 2,
+		MaxAttempts:    1,
+	}
+}
+
+type testTaskThrottled struct {
+	Val string
+}
+
+func (t testTaskThrottled) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-throttled",
+		MaxAttempts: 1,
+		Throttle: &Throttle{
+			MaxConcurrency: 2,
+			RateLimit: &RateLimit{
+				Limit:    3,
+				Interval: time.Hour,
+			},
+		},
+	}
+}
+
+type testTaskSharedThrottle struct {
+	Val string
+}
+
+func (t testTaskSharedThrottle) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-sharedthrottle",
+		MaxAttempts: 1,
+		Throttle: &Throttle{
+			RateLimit: &RateLimit{
+				Limit:    2,
+				Interval: time.Hour,
+				Shared:   true,
+			},
+		},
+	}
+}
+
+type testTaskBreaker struct {
+	Val string
+}
+
+func (t testTaskBreaker) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-breaker",
+		MaxAttempts: 1,
+		CircuitBreaker: &CircuitBreaker{
+			Failures: 2,
+			Window:   time.Minute,
+			Cooldown: 5 * time.Minute,
+		},
+	}
+}
+
+type testTaskBatch struct {
+	Val string
+}
+
+func (t testTaskBatch) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-batch",
+		MaxAttempts: 2,
+		Backoff:     time.Minute,
+		Batch: &Batch{
+			MaxSize: 3,
+			Linger:  time.Minute,
+		},
+	}
+}
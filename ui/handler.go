@@ -2,12 +2,17 @@ package ui
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html/template"
 	"log"
 	"net/http"
-	"text/template"
-	"time"
+	"strings"
 
+	"github.com/drajk/backlite/internal/circuit"
+	payloads "github.com/drajk/backlite/internal/payload"
 	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/workflow"
 	"github.com/labstack/echo/v4"
 )
 
@@ -15,17 +20,27 @@ type (
 	Handler struct {
 		db     *sql.DB
 		prefix string
+		keys   Keys
+	}
+
+	// Keys provides the keys needed to decrypt encrypted task payloads for display.
+	// backlite.KeyProvider and backlite.KeyRing satisfy this interface.
+	Keys interface {
+		Key(id string) ([]byte, error)
 	}
 
 	TemplateData struct {
 		Path    string
 		Prefix  string
+		Tags    map[string]string
+		Payload string
+		Result  string
 		Content any
 	}
 )
 
 // NewHandler accepts a prefix and an echo.Group
-func NewHandler(g *echo.Group, prefix string, db *sql.DB) {
+func NewHandler(g *echo.Group, prefix string, db *sql.DB) *Handler {
 	h := &Handler{db: db, prefix: prefix}
 
 	g.GET("/running", h.Running)
@@ -34,10 +49,28 @@ func NewHandler(g *echo.Group, prefix string, db *sql.DB) {
 	g.GET("/failed", h.Failed)
 	g.GET("/task/:task", h.Task)
 	g.GET("/completed/:task", h.TaskCompleted)
+	g.GET("/circuits", h.Circuits)
+	g.GET("/workflows", h.Workflows)
+	g.GET("/workflow/:workflow", h.Workflow)
+
+	return h
+}
+
+// Decrypt provides the keys needed to decrypt encrypted task payloads for display. Without this, encrypted task
+// payloads are only shown as encrypted.
+func (h *Handler) Decrypt(keys Keys) *Handler {
+	h.keys = keys
+	return h
 }
 
 func (h *Handler) Running(c echo.Context) error {
-	tasks, err := task.GetTasks(c.Request().Context(), h.db, selectRunningTasks, itemLimit)
+	conditions, args, err := tagConditions(h.tags(c))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	args = append(args, itemLimit)
+
+	tasks, err := task.GetTasks(c.Request().Context(), h.db, fmt.Sprintf(selectRunningTasks, conditions), args...)
 	if err != nil {
 		return h.error(c, err)
 	}
@@ -45,7 +78,13 @@ func (h *Handler) Running(c echo.Context) error {
 }
 
 func (h *Handler) Upcoming(c echo.Context) error {
-	tasks, err := task.GetScheduledTasks(c.Request().Context(), h.db, time.Now().Add(time.Hour), itemLimit)
+	conditions, args, err := tagConditions(h.tags(c))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	args = append(args, itemLimit)
+
+	tasks, err := task.GetTasks(c.Request().Context(), h.db, fmt.Sprintf(selectUpcomingTasks, conditions), args...)
 	if err != nil {
 		return h.error(c, err)
 	}
@@ -53,15 +92,27 @@ func (h *Handler) Upcoming(c echo.Context) error {
 }
 
 func (h *Handler) Succeeded(c echo.Context) error {
-	tasks, err := task.GetCompletedTasks(c.Request().Context(), h.db, selectCompletedTasks, 1, itemLimit)
-	if err != nil {
-		return h.error(c, err)
-	}
-	return h.render(c, tmplTasksCompleted, tasks)
+	return h.completed(c, true)
 }
 
 func (h *Handler) Failed(c echo.Context) error {
-	tasks, err := task.GetCompletedTasks(c.Request().Context(), h.db, selectCompletedTasks, 0, itemLimit)
+	return h.completed(c, false)
+}
+
+func (h *Handler) completed(c echo.Context, succeeded bool) error {
+	conditions, args, err := tagConditions(h.tags(c))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	args = append([]any{succeeded}, args...)
+	args = append(args, itemLimit)
+
+	tasks, err := task.GetCompletedTasks(
+		c.Request().Context(),
+		h.db,
+		fmt.Sprintf(selectCompletedTasks, conditions),
+		args...,
+	)
 	if err != nil {
 		return h.error(c, err)
 	}
@@ -98,6 +149,55 @@ func (h *Handler) TaskCompleted(c echo.Context) error {
 	return c.String(http.StatusNotFound, "Task not found")
 }
 
+func (h *Handler) Circuits(c echo.Context) error {
+	states, err := circuit.GetStates(c.Request().Context(), h.db, selectCircuits)
+	if err != nil {
+		return h.error(c, err)
+	}
+	return h.render(c, tmplCircuits, states)
+}
+
+func (h *Handler) Workflows(c echo.Context) error {
+	runs, err := workflow.GetRuns(c.Request().Context(), h.db, selectWorkflows, itemLimit)
+	if err != nil {
+		return h.error(c, err)
+	}
+	return h.render(c, tmplWorkflows, runs)
+}
+
+func (h *Handler) Workflow(c echo.Context) error {
+	id := c.Param("workflow")
+
+	runs, err := workflow.GetRuns(c.Request().Context(), h.db, selectWorkflow, id)
+	if err != nil {
+		return h.error(c, err)
+	}
+
+	if len(runs) == 0 {
+		return c.String(http.StatusNotFound, "Workflow not found")
+	}
+
+	runs[0].Steps, err = workflow.GetSteps(c.Request().Context(), h.db, selectWorkflowSteps, id)
+	if err != nil {
+		return h.error(c, err)
+	}
+
+	return h.render(c, tmplWorkflow, runs[0])
+}
+
+// tags parses the tags to filter by from the query parameters, which are provided as "tag=key:value".
+func (h *Handler) tags(c echo.Context) map[string]string {
+	tags := make(map[string]string)
+
+	for _, tag := range c.QueryParams()["tag"] {
+		if k, v, ok := strings.Cut(tag, ":"); ok && k != "" {
+			tags[k] = v
+		}
+	}
+
+	return tags
+}
+
 func (h *Handler) error(c echo.Context, err error) error {
 	log.Println(err)
 	return c.String(http.StatusInternalServerError, err.Error())
@@ -107,6 +207,86 @@ func (h *Handler) render(c echo.Context, tmpl *template.Template, data any) erro
 	return tmpl.ExecuteTemplate(c.Response().Writer, "layout.gohtml", TemplateData{
 		Path:    c.Request().URL.Path,
 		Prefix:  h.prefix,
+		Tags:    h.tags(c),
+		Payload: h.payload(data),
+		Result:  h.result(data),
 		Content: data,
 	})
 }
+
+// payload renders the data of a task or completed task for display. Offloaded data is shown as a reference to the
+// blob it is stored in. Encrypted data is shown as encrypted unless keys
+// were provided to decrypt it, and compressed data is decompressed before being rendered by its codec.
+func (h *Handler) payload(t any) string {
+	var b []byte
+	var id, queue, codec, compression, keyID string
+	var offloaded bool
+
+	switch v := t.(type) {
+	case *task.Task:
+		id, queue = v.ID, v.Queue
+		b, codec, compression, keyID, offloaded = v.Task, v.Codec, v.Compression, v.KeyID, v.Offloaded
+	case *task.Completed:
+		id, queue = v.ID, v.Queue
+		b, codec, compression, keyID, offloaded = v.Task, v.Codec, v.Compression, v.KeyID, v.Offloaded
+	default:
+		return ""
+	}
+
+	if offloaded {
+		return fmt.Sprintf("Stored externally in blob %s", b)
+	}
+
+	return h.decoded(payloads.AssociatedData(payloads.TaskData, id, queue), codec, compression, keyID, b)
+}
+
+// result renders the result returned by the processor of a completed task for display, if there is one.
+// Results are encoded, compressed and encrypted in the same way as the task data but are never offloaded.
+func (h *Handler) result(t any) string {
+	v, ok := t.(*task.Completed)
+	if !ok || v.Result == nil {
+		return ""
+	}
+
+	ad := payloads.AssociatedData(payloads.ResultData, v.ID, v.Queue)
+	return h.decoded(ad, v.Codec, v.Compression, v.KeyID, v.Result)
+}
+
+// decoded renders data for display after decrypting it with the given associated data, if keys were provided, and
+// decompressing it.
+func (h *Handler) decoded(ad []byte, codec, compression, keyID string, b []byte) string {
+	if keyID != "" {
+		if h.keys == nil {
+			return fmt.Sprintf("Encrypted with key %s", keyID)
+		}
+
+		key, err := h.keys.Key(keyID)
+		if err != nil {
+			return fmt.Sprintf("Unable to load key %s: %v", keyID, err)
+		}
+
+		if b, err = payloads.Decrypt(key, b, ad); err != nil {
+			return fmt.Sprintf("Unable to decrypt data: %v", err)
+		}
+	}
+
+	if compression != "" {
+		var err error
+		if b, err = payloads.Decompress(compression, b); err != nil {
+			return fmt.Sprintf("Unable to decompress %s data: %v", compression, err)
+		}
+	}
+
+	return encoded(codec, b)
+}
+
+// encoded renders encoded data for display. JSON data is rendered as is while data encoded with other codecs, which
+// is typically binary, is rendered as base64.
+func encoded(codec string, b []byte) string {
+	switch codec {
+	case "", "json":
+		return string(b)
+	default:
+		return fmt.Sprintf("%s (%d bytes): %s", codec, len(b), base64.StdEncoding.EncodeToString(b))
+	}
+}
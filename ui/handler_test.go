@@ -1,9 +1,248 @@
 package ui
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/drajk/backlite/internal/circuit"
+	payloads "github.com/drajk/backlite/internal/payload"
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+	"github.com/drajk/backlite/internal/workflow"
 )
 
 func TestNewHandler(t *testing.T) {
 
 }
+
+func TestHandler_Tags(t *testing.T) {
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	for id, customer := range map[string]string{"1": "42", "2": "43"} {
+		testutil.InsertCompleted(t, db, task.Completed{
+			ID:             id,
+			Queue:          "test-queue-" + id,
+			Attempts:       1,
+			CreatedAt:      time.Now(),
+			LastExecutedAt: time.Now(),
+			Tags:           map[string]string{"customer": customer, "source": "api"},
+		})
+	}
+
+	e := echo.New()
+	NewHandler(e.Group(""), "", db)
+
+	get := func(url string) string {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		testutil.Equal(t, "status", http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	// Tags are escaped when they are rendered.
+	body := get("/failed?tag=customer:" + url.QueryEscape(`"><script>alert(1)</script>`))
+	testutil.Equal(t, "escaped", false, strings.Contains(body, "<script>alert(1)</script>"))
+
+	// Invalid tag keys are rejected.
+	req := httptest.NewRequest(http.MethodGet, "/failed?tag="+url.QueryEscape(`a"b:1`), nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	testutil.Equal(t, "invalid key", http.StatusBadRequest, rec.Code)
+
+	body = get("/failed")
+	testutil.Equal(t, "task 1", true, strings.Contains(body, "test-queue-1"))
+	testutil.Equal(t, "task 2", true, strings.Contains(body, "test-queue-2"))
+
+	body = get("/failed?tag=customer:42&tag=source:api")
+	testutil.Equal(t, "task 1", true, strings.Contains(body, "test-queue-1"))
+	testutil.Equal(t, "task 2", false, strings.Contains(body, "test-queue-2"))
+
+	body = get("/failed?tag=customer:44")
+	testutil.Equal(t, "task 1", false, strings.Contains(body, "test-queue-1"))
+	testutil.Equal(t, "task 2", false, strings.Contains(body, "test-queue-2"))
+
+	body = get("/succeeded?tag=customer:42")
+	testutil.Equal(t, "task 1", false, strings.Contains(body, "test-queue-1"))
+}
+
+func TestHandler_Circuits(t *testing.T) {
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	b := circuit.New(1, 0, time.Minute)
+	b.Failure("1", time.Now())
+	if err := b.Save(context.Background(), db, "test-queue", "host-1:42", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	NewHandler(e.Group(""), "", db)
+
+	req := httptest.NewRequest(http.MethodGet, "/circuits", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	testutil.Equal(t, "status", http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	testutil.Equal(t, "queue", true, strings.Contains(body, "test-queue"))
+	testutil.Equal(t, "state", true, strings.Contains(body, "status-red"))
+	testutil.Equal(t, "process", true, strings.Contains(body, "host-1:42"))
+}
+
+func TestHandler_Workflows(t *testing.T) {
+	db := testutil.NewDB(t)
+	defer db.Close()
+
+	errStr := "card declined"
+	compensationID, compensationStatus, compensationErr := "2", workflow.StepFailed, "refunds unavailable"
+	run := workflow.Run{
+		Name:      "test-workflow",
+		Status:    workflow.Failed,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Steps: []workflow.Step{
+			{TaskID: "1", Name: "test-step", Stage: 1, Status: workflow.StepFailed, Error: &errStr, UpdatedAt: time.Now()},
+			{
+				TaskID:             "3",
+				Name:               "test-compensated-step",
+				Stage:              1,
+				Status:             workflow.StepSucceeded,
+				CompensationTaskID: &compensationID,
+				CompensationStatus: &compensationStatus,
+				CompensationError:  &compensationErr,
+				UpdatedAt:          time.Now(),
+			},
+		},
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = run.InsertTx(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	NewHandler(e.Group(""), "", db)
+
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := get("/workflows")
+	testutil.Equal(t, "status", http.StatusOK, code)
+	testutil.Equal(t, "name", true, strings.Contains(body, "test-workflow"))
+	testutil.Equal(t, "link", true, strings.Contains(body, "/workflow/"+run.ID))
+
+	code, body = get("/workflow/" + run.ID)
+	testutil.Equal(t, "status", http.StatusOK, code)
+	testutil.Equal(t, "step", true, strings.Contains(body, "test-step"))
+	testutil.Equal(t, "error", true, strings.Contains(body, errStr))
+	testutil.Equal(t, "compensation", true, strings.Contains(body, "/task/"+compensationID))
+	testutil.Equal(t, "compensation error", true, strings.Contains(body, compensationErr))
+
+	code, _ = get("/workflow/missing")
+	testutil.Equal(t, "not found", http.StatusNotFound, code)
+}
+
+func TestTagConditions(t *testing.T) {
+	conditions, args, err := tagConditions(map[string]string{"customer": "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "conditions", "AND json_extract(tags, ?) = ? ", conditions)
+	testutil.Length(t, args, 2)
+	testutil.Equal(t, "path", any(`$."customer"`), args[0])
+	testutil.Equal(t, "value", any("42"), args[1])
+
+	for _, key := range []string{`a"b`, "a b", "a$", "a[0]"} {
+		if _, _, err = tagConditions(map[string]string{key: "42"}); err == nil {
+			t.Errorf("expected error for tag key %q", key)
+		}
+	}
+}
+
+func TestHandler_Payload(t *testing.T) {
+	h := &Handler{}
+	testutil.Equal(t, "empty", `{"a":1}`, h.payload(&task.Task{Task: []byte(`{"a":1}`)}))
+	testutil.Equal(t, "json", `{"a":1}`, h.payload(&task.Completed{Task: []byte(`{"a":1}`), Codec: "json"}))
+	testutil.Equal(t, "gob", "gob (3 bytes): AQID", h.payload(&task.Task{Task: []byte{1, 2, 3}, Codec: "gob"}))
+	testutil.Equal(t, "invalid", "", h.payload(nil))
+	testutil.Equal(t, "offloaded", "Stored externally in blob abc", h.payload(&task.Task{Task: []byte("abc"), Offloaded: true}))
+
+	compressed, err := payloads.Compress(payloads.Gzip, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "compressed", `{"a":1}`, h.payload(&task.Task{Task: compressed, Compression: "gzip"}))
+
+	key := []byte("0123456789abcdef")
+	encrypted, err := payloads.Encrypt(key, compressed, payloads.AssociatedData(payloads.TaskData, "1", "q"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := &task.Task{ID: "1", Queue: "q", Task: encrypted, Compression: "gzip", KeyID: "k1"}
+	testutil.Equal(t, "encrypted", "Encrypted with key k1", h.payload(tk))
+
+	h.Decrypt(testKeys{"k1": key})
+	testutil.Equal(t, "decrypted", `{"a":1}`, h.payload(tk))
+
+	tk.ID = "2"
+	if got := h.payload(tk); !strings.HasPrefix(got, "Unable to decrypt data") {
+		t.Errorf("expected decryption to fail for another task, got %s", got)
+	}
+
+	tk.KeyID = "k2"
+	testutil.Equal(t, "missing key", "Unable to load key k2: not found", h.payload(tk))
+}
+
+func TestHandler_Result(t *testing.T) {
+	h := &Handler{}
+	testutil.Equal(t, "json", `"url"`, h.result(&task.Completed{Result: []byte(`"url"`), Codec: "json"}))
+	testutil.Equal(t, "gob", "gob (3 bytes): AQID", h.result(&task.Completed{Result: []byte{1, 2, 3}, Codec: "gob"}))
+	testutil.Equal(t, "none", "", h.result(&task.Completed{Task: []byte(`{"a":1}`)}))
+	testutil.Equal(t, "task", "", h.result(&task.Task{Task: []byte(`{"a":1}`)}))
+
+	compressed, err := payloads.Compress(payloads.Gzip, []byte(`"url"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("0123456789abcdef")
+	encrypted, err := payloads.Encrypt(key, compressed, payloads.AssociatedData(payloads.ResultData, "1", "q"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct := &task.Completed{ID: "1", Queue: "q", Result: encrypted, Codec: "json", Compression: "gzip", KeyID: "k1"}
+	testutil.Equal(t, "encrypted", "Encrypted with key k1", h.result(ct))
+
+	h.Decrypt(testKeys{"k1": key})
+	testutil.Equal(t, "decrypted", `"url"`, h.result(ct))
+}
+
+type testKeys map[string][]byte
+
+func (k testKeys) Key(id string) ([]byte, error) {
+	if key, ok := k[id]; ok {
+		return key, nil
+	}
+	return nil, errors.New("not found")
+}
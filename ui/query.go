@@ -1,5 +1,11 @@
 package ui
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
 const itemLimit = 25
 
 // TODO no need to select task field for lists, need claimed_at for running tasks
@@ -13,7 +19,22 @@ const selectTask = `
 	    wait_until,
 	    created_at,
 	    last_executed_at,
-	    claimed_at
+	    claimed_at,
+	    metadata,
+	    tags,
+	    codec,
+	    compression,
+	    key_id,
+	    offloaded,
+	    version,
+	    max_attempts,
+	    timeout_micro,
+	    backoff_micro,
+	    deadline,
+	    debounce_key,
+	    partition_key,
+	    throttle_key,
+	    group_id
 	FROM 
 	    backlite_tasks
 	WHERE
@@ -31,7 +52,15 @@ const selectCompletedTask = `
 		succeeded,
 		task,
 		expires_at,
-		error
+		error,
+		tags,
+		codec,
+		compression,
+		key_id,
+		offloaded,
+		version,
+		expired,
+		result
 	FROM
 	    backlite_tasks_completed 
 	WHERE
@@ -47,13 +76,66 @@ const selectRunningTasks = `
 	    wait_until,
 	    created_at,
 	    last_executed_at,
-	    claimed_at
+	    claimed_at,
+	    metadata,
+	    tags,
+	    codec,
+	    compression,
+	    key_id,
+	    offloaded,
+	    version,
+	    max_attempts,
+	    timeout_micro,
+	    backoff_micro,
+	    deadline,
+	    debounce_key,
+	    partition_key,
+	    throttle_key,
+	    group_id
 	FROM 
 	    backlite_tasks
 	WHERE
 	    claimed_at IS NOT NULL
+	    %s
 	LIMIT ?
 `
+
+const selectUpcomingTasks = `
+	SELECT 
+	    id,
+	    queue,
+	    null as placeholder,
+	    attempts,
+	    wait_until,
+	    created_at,
+	    last_executed_at,
+	    claimed_at,
+	    metadata,
+	    tags,
+	    codec,
+	    compression,
+	    key_id,
+	    offloaded,
+	    version,
+	    max_attempts,
+	    timeout_micro,
+	    backoff_micro,
+	    deadline,
+	    debounce_key,
+	    partition_key,
+	    throttle_key,
+	    group_id
+	FROM 
+	    backlite_tasks
+	WHERE
+	    claimed_at IS NULL
+	    %s
+	ORDER BY
+	    wait_until ASC,
+	    id ASC
+	LIMIT ?
+`
+
 const selectCompletedTasks = `
 	SELECT
 	    id,
@@ -65,12 +147,105 @@ const selectCompletedTasks = `
 		succeeded,
 		null as placeholder,
 		expires_at,
-		error
+		error,
+		tags,
+		codec,
+		compression,
+		key_id,
+		offloaded,
+		version,
+		expired,
+		null as result
 	FROM
 	    backlite_tasks_completed 
 	WHERE
 	    succeeded = ?
+	    %s
 	ORDER BY
 	    last_executed_at DESC
 	LIMIT ?
 `
+
+const selectCircuits = `
+	SELECT
+	    queue,
+	    state,
+	    failures,
+	    opened_at,
+	    updated_at,
+	    process
+	FROM
+	    backlite_circuits
+	ORDER BY
+	    queue ASC
+`
+
+const selectWorkflows = `
+	SELECT
+	    id,
+	    name,
+	    status,
+	    created_at,
+	    updated_at
+	FROM
+	    backlite_workflows
+	ORDER BY
+	    created_at DESC
+	LIMIT ?
+`
+
+const selectWorkflow = `
+	SELECT
+	    id,
+	    name,
+	    status,
+	    created_at,
+	    updated_at
+	FROM
+	    backlite_workflows
+	WHERE
+	    id = ?
+`
+
+const selectWorkflowSteps = `
+	SELECT
+	    task_id,
+	    workflow_id,
+	    name,
+	    stage,
+	    status,
+	    error,
+	    compensation_task_id,
+	    compensation_status,
+	    compensation_error,
+	    updated_at
+	FROM
+	    backlite_workflow_steps
+	WHERE
+	    workflow_id = ?
+	ORDER BY
+	    stage ASC,
+	    task_id ASC
+`
+
+// tagKey matches the tag keys which can be filtered by, since they are used within a JSON path.
+var tagKey = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// tagConditions returns query conditions, and the arguments for them, which filter tasks to only those that contain
+// all the provided tags. An error is returned if a tag key contains characters other than letters, digits, "_", "."
+// and "-".
+func tagConditions(tags map[string]string) (string, []any, error) {
+	var conditions strings.Builder
+	args := make([]any, 0, len(tags)*2)
+
+	for k, v := range tags {
+		if !tagKey.MatchString(k) {
+			return "", nil, fmt.Errorf("invalid tag key: %q", k)
+		}
+
+		conditions.WriteString("AND json_extract(tags, ?) = ? ")
+		args = append(args, `$."`+k+`"`, v)
+	}
+
+	return conditions.String(), args, nil
+}
@@ -3,7 +3,7 @@ package ui
 import (
 	"embed"
 	"fmt"
-	"text/template"
+	"html/template"
 )
 
 //go:embed templates/*.gohtml
@@ -15,18 +15,18 @@ var (
 	tmplTasksCompleted = mustParse("completed_tasks")
 	tmplTask           = mustParse("task")
 	tmplTaskCompleted  = mustParse("completed_task")
+	tmplCircuits       = mustParse("circuits")
+	tmplWorkflows      = mustParse("workflows")
+	tmplWorkflow       = mustParse("workflow")
 )
 
 func mustParse(page string) *template.Template {
 	t, err := template.
 		New("layout.gohtml").
-		Funcs(
-			template.FuncMap{
-				"bytestring": bytestring,
-			}).
 		ParseFS(
 			templates,
 			"templates/layout.gohtml",
+			"templates/filter.gohtml",
 			fmt.Sprintf("templates/%s.gohtml", page),
 		)
 
@@ -35,7 +35,3 @@ func mustParse(page string) *template.Template {
 	}
 	return t
 }
-
-func bytestring(b []byte) string {
-	return string(b)
-}
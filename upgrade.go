@@ -0,0 +1,82 @@
+package backlite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Upgrader upgrades an encoded task payload from one version to the following version.
+type Upgrader func(payload []byte) ([]byte, error)
+
+// version returns the current payload version of the queue.
+func (c *QueueConfig) version() int {
+	if c.Version < 1 {
+		return 1
+	}
+	return c.Version
+}
+
+// upgrade upgrades an encoded task payload from a given version to the current version of the queue by applying each
+// upgrader in order.
+func (c *QueueConfig) upgrade(version int, payload []byte) ([]byte, error) {
+	if version < 1 {
+		version = 1
+	}
+
+	if version > c.version() {
+		return nil, fmt.Errorf("task version %d is newer than queue version %d", version, c.version())
+	}
+
+	for v := version; v < c.version(); v++ {
+		up, ok := c.Upgraders[v]
+		if !ok {
+			return nil, fmt.Errorf("no upgrader registered for version %d", v)
+		}
+
+		var err error
+		if payload, err = up(payload); err != nil {
+			return nil, fmt.Errorf("unable to upgrade task from version %d: %w", v, err)
+		}
+	}
+
+	return payload, nil
+}
+
+// VerifyUpgrades verifies that the payload versions of a Task type upgrade cleanly, which is intended to be used in
+// tests. Samples contains an encoded payload, keyed by version, for each version with a registered upgrader. Each
+// sample is upgraded to the current version and decoded in to the Task type with the codec of the queue.
+func VerifyUpgrades[T Task](samples map[int][]byte) error {
+	var t T
+	cfg := t.Config()
+
+	codec := cfg.Codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	var errs []error
+
+	for v := range cfg.Upgraders {
+		if v < 1 || v >= cfg.version() {
+			errs = append(errs, fmt.Errorf("upgrader registered for invalid version %d", v))
+		} else if _, ok := samples[v]; !ok {
+			errs = append(errs, fmt.Errorf("missing sample for version %d", v))
+		}
+	}
+
+	for v, sample := range samples {
+		payload, err := cfg.upgrade(v, sample)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("version %d: %w", v, err))
+			continue
+		}
+
+		var obj T
+		if err = codec.Decode(bytes.NewReader(payload), &obj); err != nil {
+			errs = append(errs, fmt.Errorf("version %d: unable to decode upgraded payload: %w", v, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,160 @@
+package backlite
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+)
+
+// testTaskVersioned is at version 3, having renamed Val to Name in version 2 and then split Name in to First and Last
+// in version 3.
+type testTaskVersioned struct {
+	First string
+	Last  string
+}
+
+func (t testTaskVersioned) Config() QueueConfig {
+	return QueueConfig{
+		Name:        "test-versioned",
+		MaxAttempts: 1,
+		Version:     3,
+		Upgraders: map[int]Upgrader{
+			1: func(payload []byte) ([]byte, error) {
+				var v struct{ Val string }
+				if err := json.Unmarshal(payload, &v); err != nil {
+					return nil, err
+				}
+				return json.Marshal(map[string]string{"Name": v.Val})
+			},
+			2: func(payload []byte) ([]byte, error) {
+				var v struct{ Name string }
+				if err := json.Unmarshal(payload, &v); err != nil {
+					return nil, err
+				}
+				first, last, _ := strings.Cut(v.Name, " ")
+				return json.Marshal(testTaskVersioned{First: first, Last: last})
+			},
+		},
+	}
+}
+
+func TestQueueConfig_Upgrade(t *testing.T) {
+	cfg := testTaskVersioned{}.Config()
+	testutil.Equal(t, "version", 3, cfg.version())
+	testutil.Equal(t, "default version", 1, (&QueueConfig{}).version())
+
+	got, err := cfg.upgrade(1, []byte(`{"Val":"a b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "v1", `{"First":"a","Last":"b"}`, string(got))
+
+	// Tasks stored without a version are treated as version 1.
+	got, err = cfg.upgrade(0, []byte(`{"Val":"a b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "v0", `{"First":"a","Last":"b"}`, string(got))
+
+	got, err = cfg.upgrade(3, []byte(`{"First":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "current", `{"First":"a"}`, string(got))
+
+	if _, err = cfg.upgrade(4, nil); err == nil {
+		t.Error("expected error for newer version")
+	}
+
+	delete(cfg.Upgraders, 2)
+	if _, err = cfg.upgrade(1, []byte(`{"Val":"a b"}`)); err == nil {
+		t.Error("expected error for missing upgrader")
+	}
+}
+
+func TestVerifyUpgrades(t *testing.T) {
+	err := VerifyUpgrades[testTaskVersioned](map[int][]byte{
+		1: []byte(`{"Val":"a b"}`),
+		2: []byte(`{"Name":"a b"}`),
+		3: []byte(`{"First":"a","Last":"b"}`),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = VerifyUpgrades[testTaskVersioned](map[int][]byte{
+		2: []byte(`{"Name":1}`),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, msg := range []string{"missing sample for version 1", "unable to upgrade task from version 2"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected error to contain '%s', got: %v", msg, err)
+		}
+	}
+}
+
+func TestDispatcher_ProcessTask__Upgrade(t *testing.T) {
+	d := newDispatcher(t)
+	d.ready = make(chan struct{}, 1)
+	d.ctx = context.Background()
+
+	var processed []testTaskVersioned
+	d.client.Register(NewQueue[testTaskVersioned](func(ctx context.Context, tk testTaskVersioned) error {
+		processed = append(processed, tk)
+		return nil
+	}))
+
+	if err := d.client.Add(testTaskVersioned{First: "c", Last: "d"}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.InsertTask(t, d.client.db, &task.Task{
+		Queue:     "test-versioned",
+		Task:      []byte(`{"Val":"a b"}`),
+		Version:   1,
+		CreatedAt: now(),
+	})
+
+	tasks := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, tasks, 2)
+	testutil.Equal(t, "added version", 3, tasks[0].Version)
+	testutil.Equal(t, "inserted version", 1, tasks[1].Version)
+
+	for _, tk := range tasks {
+		tk.Attempts++
+		d.processTask(tk)
+	}
+
+	testutil.Length(t, processed, 2)
+	testutil.Equal(t, "current", testTaskVersioned{First: "c", Last: "d"}, processed[0])
+	testutil.Equal(t, "upgraded", testTaskVersioned{First: "a", Last: "b"}, processed[1])
+
+	// A task from a newer version cannot be processed.
+	var taskErr error
+	d.client.Subscribe(func(_ context.Context, e Event) {
+		if e.Type == EventExhausted {
+			taskErr = e.Error
+		}
+	})
+
+	tk := &task.Task{
+		Queue:     "test-versioned",
+		Task:      []byte(`{}`),
+		Version:   4,
+		Attempts:  1,
+		CreatedAt: now(),
+	}
+	testutil.InsertTask(t, d.client.db, tk)
+	d.processTask(tk)
+
+	if taskErr == nil || !strings.Contains(taskErr.Error(), "newer than queue version") {
+		t.Errorf("unexpected error: %v", taskErr)
+	}
+}
@@ -0,0 +1,376 @@
+package backlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/workflow"
+)
+
+type (
+	// Workflow is a declarative pipeline of steps, executed by tasks in the registered queues, which is started with
+	// an input of a given type. The steps are grouped in to stages, where the steps of a stage are executed in
+	// parallel once every step of the previous stage has succeeded.
+	Workflow[I any] struct {
+		name   string
+		stages [][]WorkflowStep[I]
+		names  map[string]struct{}
+	}
+
+	// WorkflowStep is a named step of a Workflow which creates the Task that executes it from the input of the
+	// workflow.
+	WorkflowStep[I any] struct {
+		// Name is the name of the step, which must be unique within the workflow.
+		Name string
+
+		// Task creates the Task which executes the step from the input of the workflow.
+		Task func(input I) Task
+
+		// Compensation optionally creates the Task which undoes the step from the input of the workflow, which is
+		// executed if the step succeeded but the run fails.
+		Compensation func(input I) Task
+	}
+)
+
+// NewWorkflow creates a new Workflow with a given name which is started with an input of a given type.
+func NewWorkflow[I any](name string) *Workflow[I] {
+	return &Workflow[I]{
+		name:  name,
+		names: make(map[string]struct{}),
+	}
+}
+
+// Step creates a WorkflowStep with a given name which is executed by the Task created from the input of the workflow.
+func Step[I any](name string, task func(input I) Task) WorkflowStep[I] {
+	return WorkflowStep[I]{
+		Name: name,
+		Task: task,
+	}
+}
+
+// Compensate sets the function which creates the Task that undoes the step if it succeeded but the run fails, such as
+// refunding a payment once a later step has failed.
+func (s WorkflowStep[I]) Compensate(task func(input I) Task) WorkflowStep[I] {
+	s.Compensation = task
+	return s
+}
+
+// Then adds a stage to the workflow which executes the given steps once every step of the previous stage has
+// succeeded. A single step continues the workflow sequentially, while multiple steps fan out and are executed in
+// parallel, and the stage that follows them joins them back together.
+// This will panic if no steps are provided, or if a step name is missing or has already been used.
+func (w *Workflow[I]) Then(steps ...WorkflowStep[I]) *Workflow[I] {
+	if len(steps) == 0 {
+		panic(fmt.Sprintf("workflow '%s' stage has no steps", w.name))
+	}
+
+	for _, s := range steps {
+		if len(s.Name) == 0 {
+			panic(fmt.Sprintf("workflow '%s' step name is missing", w.name))
+		}
+
+		if _, exists := w.names[s.Name]; exists {
+			panic(fmt.Sprintf("workflow '%s' step '%s' already exists", w.name, s.Name))
+		}
+		w.names[s.Name] = struct{}{}
+	}
+
+	w.stages = append(w.stages, steps)
+	return w
+}
+
+// Start starts a run of the workflow with a given input and returns the ID of the run. The tasks for every step are
+// added at once, in a single transaction, and each is held until the steps of the previous stage have succeeded. If a
+// step does not succeed, the steps which follow it are abandoned and the run fails. The compensation tasks are added
+// at the same time, and are held until the run fails, at which point those of the steps which succeeded are executed in
+// the reverse order of their steps.
+func (w *Workflow[I]) Start(ctx context.Context, c *Client, input I) (string, error) {
+	if len(w.stages) == 0 {
+		return "", fmt.Errorf("workflow '%s' has no steps", w.name)
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", fmt.Errorf("unable to generate workflow ID: %w", err)
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				c.log.Error("failed to rollback workflow transaction",
+					"workflow", w.name,
+					"error", err,
+				)
+			}
+		}
+	}()
+
+	run := workflow.Run{
+		ID:        id.String(),
+		Name:      w.name,
+		Status:    workflow.Running,
+		CreatedAt: now(),
+		UpdatedAt: now(),
+	}
+
+	var parents []string
+	for stage, steps := range w.stages {
+		ids := make([]string, 0, len(steps))
+
+		for _, s := range steps {
+			op := c.Add(s.Task(input)).Ctx(ctx).Tx(tx).After(parents...)
+			if err = op.Save(); err != nil {
+				err = fmt.Errorf("unable to add workflow step '%s': %w", s.Name, err)
+				return "", err
+			}
+
+			step := workflow.Step{
+				TaskID:    op.IDs()[0],
+				Name:      s.Name,
+				Stage:     stage + 1,
+				Status:    workflow.Pending,
+				UpdatedAt: run.CreatedAt,
+			}
+
+			if s.Compensation != nil {
+				if step.CompensationTaskID, err = w.addCompensation(ctx, c, tx, run.ID, s, input); err != nil {
+					return "", err
+				}
+				waiting := workflow.CompensationWaiting
+				step.CompensationStatus = &waiting
+			}
+
+			ids = append(ids, step.TaskID)
+			run.Steps = append(run.Steps, step)
+		}
+
+		parents = ids
+	}
+
+	if err = run.InsertTx(ctx, tx); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	// Tell the dispatcher that the tasks of the first stage have been added.
+	c.Notify()
+
+	return run.ID, nil
+}
+
+// addCompensation adds the compensation task of a step, which is held by the run until it fails, and returns its ID.
+// The compensation does not expire, since the run may fail after the TTL of its queue.
+func (w *Workflow[I]) addCompensation(
+	ctx context.Context,
+	c *Client,
+	tx *sql.Tx,
+	runID string,
+	s WorkflowStep[I],
+	input I,
+) (*string, error) {
+	op := c.Add(s.Compensation(input)).Ctx(ctx).Tx(tx)
+	op.held = true
+	if err := op.Save(); err != nil {
+		return nil, fmt.Errorf("unable to add workflow step '%s' compensation: %w", s.Name, err)
+	}
+
+	id := op.IDs()[0]
+	if err := task.HoldTx(ctx, tx, id, runID, false); err != nil {
+		return nil, err
+	}
+
+	return &id, nil
+}
+
+// RetryCompensation retries the compensations of a failed workflow run which did not succeed, in the reverse order of
+// their steps. Since the input of the run is not stored, each compensation task is added again from its completed
+// task, so the queues of the compensation tasks must retain their data, otherwise ErrTaskNotCompleted is returned.
+// ErrWorkflowNotFailed is returned if the run does not exist or has not failed.
+func (c *Client) RetryCompensation(ctx context.Context, runID string) error {
+	steps, err := workflow.GetFailedCompensations(ctx, c.db, runID)
+	if err != nil {
+		return err
+	}
+
+	tasks := make([]task.Task, 0, len(steps))
+	var blobs []string
+	for _, s := range steps {
+		ct, err := task.GetCompleted(ctx, c.db, *s.CompensationTaskID)
+		switch {
+		case err != nil:
+			return err
+		case ct == nil, ct.Task == nil:
+			return fmt.Errorf("unable to retry workflow step '%s' compensation: %w", s.Name, ErrTaskNotCompleted)
+		}
+
+		// The payload is packed again, rather than copied, so the retry does not share the blob of the completed task,
+		// which is deleted along with it.
+		data, err := c.unpack(ctx, &task.Task{
+			ID:          ct.ID,
+			Queue:       ct.Queue,
+			Task:        ct.Task,
+			Compression: ct.Compression,
+			KeyID:       ct.KeyID,
+			Offloaded:   ct.Offloaded,
+		})
+		if err != nil {
+			c.deleteBlobs(ctx, blobs...)
+			return err
+		}
+
+		m := task.Task{
+			Queue:     ct.Queue,
+			CreatedAt: now(),
+			Tags:      ct.Tags,
+			Codec:     ct.Codec,
+			Version:   ct.Version,
+		}
+
+		if err = c.pack(ctx, &m, data); err != nil {
+			c.deleteBlobs(ctx, blobs...)
+			return err
+		}
+
+		if m.Offloaded {
+			blobs = append(blobs, string(m.Task))
+		}
+
+		tasks = append(tasks, m)
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				c.log.Error("failed to rollback workflow transaction",
+					"workflow", runID,
+					"error", err,
+				)
+			}
+
+			// Remove any blobs that were stored for the tasks which will not exist.
+			c.deleteBlobs(ctx, blobs...)
+		}
+	}()
+
+	var ok bool
+	if ok, err = workflow.TransitionTx(ctx, tx, runID, workflow.Failed, workflow.Compensating, now()); err != nil {
+		return err
+	}
+
+	if !ok || len(tasks) == 0 {
+		c.deleteBlobs(ctx, blobs...)
+
+		if err = tx.Rollback(); err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrWorkflowNotFailed
+		}
+		return nil
+	}
+
+	// Each compensation is held until the one before it has completed, as when the run first failed.
+	var prev string
+	for i := range tasks {
+		if err = tasks[i].InsertTx(ctx, tx); err != nil {
+			return err
+		}
+
+		if prev != "" {
+			if err = task.HoldTx(ctx, tx, tasks[i].ID, prev, true); err != nil {
+				return err
+			}
+		}
+
+		if err = workflow.RetryCompensationTx(ctx, tx, steps[i].TaskID, tasks[i].ID, now()); err != nil {
+			return err
+		}
+
+		prev = tasks[i].ID
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	// Tell the dispatcher that the first compensation has been added.
+	c.Notify()
+
+	for _, m := range tasks {
+		c.hooks.emit(ctx, Event{
+			Type:   EventAdded,
+			TaskID: m.ID,
+			Queue:  m.Queue,
+		})
+	}
+
+	return nil
+}
+
+// stepCompleted records the outcome of a task in the workflow run it is a step or a compensation of, if any, as part of
+// the transaction which completes it. If the run failed, its compensations are released, and the number released is
+// returned, while the compensation tasks which are no longer required are deleted and returned.
+func (d *dispatcher) stepCompleted(tx *sql.Tx, t *task.Task, taskErr error) (task.Tasks, int64, error) {
+	status, errStr := workflow.StepSucceeded, (*string)(nil)
+	if taskErr != nil {
+		status = workflow.StepFailed
+		switch {
+		case errors.Is(taskErr, ErrExpired):
+			status = workflow.StepExpired
+		case errors.Is(taskErr, ErrParentFailed):
+			status = workflow.StepAbandoned
+		}
+
+		s := taskErr.Error()
+		errStr = &s
+	}
+
+	if err := workflow.CompleteCompensationTx(d.ctx, tx, t.ID, status, errStr, now()); err != nil {
+		return nil, 0, err
+	}
+
+	o, err := workflow.CompleteStepTx(d.ctx, tx, t.ID, status, errStr, now())
+	switch {
+	case err != nil, o == nil:
+		return nil, 0, err
+	case o.Changed && o.Status == workflow.Succeeded:
+		skipped, err := workflow.SkipCompensationsTx(d.ctx, tx, o.RunID, now())
+		return skipped, 0, err
+	case o.Changed:
+		return workflow.CompensateTx(d.ctx, tx, o.RunID, now())
+	case o.Status != workflow.Running:
+		// The step was still executing when the run failed.
+		return workflow.CompensateLateStepTx(d.ctx, tx, o.RunID, t.ID, taskErr == nil, now())
+	default:
+		return nil, 0, nil
+	}
+}
+
+// compensationsSkipped deletes the blobs of the compensation tasks which were skipped, once the transaction which
+// deleted them has been committed.
+func (d *dispatcher) compensationsSkipped(tasks task.Tasks) {
+	for _, t := range tasks {
+		if t.Offloaded {
+			d.client.deleteBlobs(d.ctx, string(t.Task))
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package backlite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/drajk/backlite/internal/task"
+	"github.com/drajk/backlite/internal/testutil"
+	"github.com/drajk/backlite/internal/workflow"
+)
+
+// getWorkflowSteps returns the steps of a workflow run keyed by name.
+func getWorkflowSteps(t *testing.T, c *Client, id string) map[string]workflow.Step {
+	steps, err := workflow.GetSteps(context.Background(), c.db, `
+		SELECT
+			task_id, workflow_id, name, stage, status, error, compensation_task_id, compensation_status,
+			compensation_error, updated_at
+		FROM backlite_workflow_steps
+		WHERE workflow_id = ?
+	`, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]workflow.Step, len(steps))
+	for _, s := range steps {
+		byName[s.Name] = s
+	}
+	return byName
+}
+
+// getWorkflowStatus returns the status of a workflow run.
+func getWorkflowStatus(t *testing.T, c *Client, id string) string {
+	var status string
+	err := c.db.QueryRow("SELECT status FROM backlite_workflows WHERE id = ?", id).Scan(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func newTestWorkflow() *Workflow[string] {
+	step := func(name string) WorkflowStep[string] {
+		return Step(name, func(input string) Task {
+			return testTask{Val: input + ":" + name}
+		})
+	}
+
+	return NewWorkflow[string]("onboarding").
+		Then(step("provision")).
+		Then(step("seed"), step("billing")).
+		Then(step("welcome"))
+}
+
+func TestWorkflow_Then(t *testing.T) {
+	for name, fn := range map[string]func(){
+		"no steps":     func() { NewWorkflow[string]("wf").Then() },
+		"missing name": func() { NewWorkflow[string]("wf").Then(WorkflowStep[string]{}) },
+		"duplicate":    func() { newTestWorkflow().Then(Step("seed", func(string) Task { return testTask{} })) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for %s", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestWorkflow_Start(t *testing.T) {
+	c := mustNewClient(t)
+
+	_, err := NewWorkflow[string]("empty").Start(context.Background(), c, "in")
+	if err == nil {
+		t.Error("expected error for workflow without steps")
+	}
+
+	id, err := newTestWorkflow().Start(context.Background(), c, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Equal(t, "status", workflow.Running, getWorkflowStatus(t, c, id))
+	testutil.Length(t, testutil.GetTasks(t, c.db), 4)
+
+	steps := getWorkflowSteps(t, c, id)
+	testutil.Equal(t, "steps", 4, len(steps))
+	testutil.Equal(t, "provision stage", 1, steps["provision"].Stage)
+	testutil.Equal(t, "seed stage", 2, steps["seed"].Stage)
+	testutil.Equal(t, "billing stage", 2, steps["billing"].Stage)
+	testutil.Equal(t, "welcome stage", 3, steps["welcome"].Stage)
+	testutil.Equal(t, "pending", workflow.Pending, steps["welcome"].Status)
+
+	// Each step depends on every step of the previous stage.
+	deps := getDependencies(t, c)
+	testutil.Equal(t, "provision parents", 0, len(deps[steps["provision"].TaskID]))
+	testutil.Equal(t, "seed parent", steps["provision"].TaskID, deps[steps["seed"].TaskID][0])
+	testutil.Equal(t, "billing parent", steps["provision"].TaskID, deps[steps["billing"].TaskID][0])
+	testutil.Equal(t, "welcome parents", 2, len(deps[steps["welcome"].TaskID]))
+}
+
+func TestWorkflow_Start__CompensationTTL(t *testing.T) {
+	c := mustNewClient(t)
+
+	// The compensation is held until the run fails, which may be after the TTL of its queue.
+	wf := NewWorkflow[string]("checkout").
+		Then(Step("charge", func(input string) Task {
+			return testTask{Val: input}
+		}).Compensate(func(input string) Task {
+			return testTaskExpiring{Val: input}
+		}))
+
+	id, err := wf.Start(context.Background(), c, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := getWorkflowSteps(t, c, id)
+	for _, tk := range testutil.GetTasks(t, c.db) {
+		if tk.ID == *steps["charge"].CompensationTaskID {
+			testutil.Equal(t, "queue", "test-expiring", tk.Queue)
+			testutil.Equal(t, "deadline", true, tk.Deadline == nil)
+			return
+		}
+	}
+	t.Error("compensation not found")
+}
+
+func TestDispatcher_ProcessTask__Workflow(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ready = make(chan struct{}, 10)
+
+	var processed []string
+	d.client.Register(NewQueue[testTask](func(_ context.Context, tk testTask) error {
+		processed = append(processed, tk.Val)
+		if tk.Val == "fail:billing" {
+			return errors.New("card declined")
+		}
+		return nil
+	}))
+
+	run := func(input string) string {
+		id, err := newTestWorkflow().Start(context.Background(), d.client, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Execute the steps which are ready until none remain.
+		for {
+			ready := testutil.GetTasks(t, d.client.db)
+			deps := getDependencies(t, d.client)
+
+			var executed bool
+			for _, tk := range ready {
+				if len(deps[tk.ID]) > 0 {
+					continue
+				}
+				tk.Attempts = 2
+				d.processTask(tk)
+				executed = true
+			}
+
+			if !executed {
+				return id
+			}
+		}
+	}
+
+	id := run("ok")
+	testutil.Equal(t, "processed", 4, len(processed))
+	testutil.Equal(t, "succeeded", workflow.Succeeded, getWorkflowStatus(t, d.client, id))
+	for name, s := range getWorkflowSteps(t, d.client, id) {
+		testutil.Equal(t, name, workflow.StepSucceeded, s.Status)
+	}
+
+	// A failed step fails the run and abandons the steps which follow it.
+	processed = nil
+	id = run("fail")
+	testutil.Equal(t, "processed", 3, len(processed))
+	testutil.Equal(t, "failed", workflow.Failed, getWorkflowStatus(t, d.client, id))
+
+	steps := getWorkflowSteps(t, d.client, id)
+	testutil.Equal(t, "seed", workflow.StepSucceeded, steps["seed"].Status)
+	testutil.Equal(t, "billing", workflow.StepFailed, steps["billing"].Status)
+	testutil.Equal(t, "billing error", "card declined", *steps["billing"].Error)
+	testutil.Equal(t, "welcome", workflow.StepAbandoned, steps["welcome"].Status)
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+}
+
+func TestDispatcher_ProcessTask__WorkflowCompensation(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ready = make(chan struct{}, 10)
+	d.client.offload = &Offload{Store: FileBlobStore{Dir: t.TempDir()}, Threshold: 1}
+
+	var processed []string
+	refunds := true
+	d.client.Register(NewQueue[testTask](func(_ context.Context, tk testTask) error {
+		processed = append(processed, tk.Val)
+		switch {
+		case tk.Val == "fail:ship":
+			return errors.New("out of stock")
+		case tk.Val == "fail:refund" && !refunds:
+			return errors.New("refunds unavailable")
+		}
+		return nil
+	}))
+
+	step := func(name, compensation string) WorkflowStep[string] {
+		return Step(name, func(input string) Task {
+			return testTask{Val: input + ":" + name}
+		}).Compensate(func(input string) Task {
+			return testTask{Val: input + ":" + compensation}
+		})
+	}
+
+	checkout := NewWorkflow[string]("checkout").
+		Then(step("reserve", "release")).
+		Then(step("charge", "refund")).
+		Then(Step("ship", func(input string) Task {
+			return testTask{Val: input + ":ship"}
+		}))
+
+	// Execute the tasks which are ready until none remain.
+	process := func() {
+		for {
+			deps := getDependencies(t, d.client)
+
+			var executed bool
+			for _, tk := range testutil.GetTasks(t, d.client.db) {
+				if len(deps[tk.ID]) > 0 {
+					continue
+				}
+				tk.Attempts = 2
+				d.processTask(tk)
+				executed = true
+			}
+
+			if !executed {
+				return
+			}
+		}
+	}
+
+	// The compensations are held until the run fails, and are skipped once it succeeds.
+	id, err := checkout.Start(context.Background(), d.client, "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 5)
+
+	process()
+	testutil.Equal(t, "processed", 3, len(processed))
+	testutil.Equal(t, "succeeded", workflow.Succeeded, getWorkflowStatus(t, d.client, id))
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+
+	steps := getWorkflowSteps(t, d.client, id)
+	testutil.Equal(t, "release", workflow.CompensationSkipped, *steps["reserve"].CompensationStatus)
+	testutil.Equal(t, "ship", true, steps["ship"].CompensationStatus == nil)
+
+	err = d.client.RetryCompensation(context.Background(), id)
+	if !errors.Is(err, ErrWorkflowNotFailed) {
+		t.Errorf("expected workflow not failed error, got %v", err)
+	}
+
+	// A failed step executes the compensations of the steps which succeeded in reverse order.
+	processed = nil
+	refunds = false
+	if id, err = checkout.Start(context.Background(), d.client, "fail"); err != nil {
+		t.Fatal(err)
+	}
+
+	process()
+	testutil.Equal(t, "processed", 5, len(processed))
+	testutil.Equal(t, "refund", "fail:refund", processed[3])
+	testutil.Equal(t, "release", "fail:release", processed[4])
+	testutil.Equal(t, "failed", workflow.Failed, getWorkflowStatus(t, d.client, id))
+
+	steps = getWorkflowSteps(t, d.client, id)
+	testutil.Equal(t, "refund", workflow.StepFailed, *steps["charge"].CompensationStatus)
+	testutil.Equal(t, "refund error", "refunds unavailable", *steps["charge"].CompensationError)
+	testutil.Equal(t, "release", workflow.StepSucceeded, *steps["reserve"].CompensationStatus)
+
+	// Compensations which did not succeed can be retried.
+	processed = nil
+	refunds = true
+	if err = d.client.RetryCompensation(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "compensating", workflow.Compensating, getWorkflowStatus(t, d.client, id))
+
+	// The retry should not share the blob of the completed compensation.
+	retried := testutil.GetTasks(t, d.client.db)
+	testutil.Length(t, retried, 1)
+	ct, err := task.GetCompleted(context.Background(), d.client.db, *steps["charge"].CompensationTaskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Equal(t, "offloaded", true, retried[0].Offloaded)
+	testutil.Equal(t, "shared blob", false, string(retried[0].Task) == string(ct.Task))
+
+	process()
+	testutil.Length(t, processed, 1)
+	testutil.Equal(t, "refund", "fail:refund", processed[0])
+	testutil.Equal(t, "compensated", workflow.Compensated, getWorkflowStatus(t, d.client, id))
+
+	steps = getWorkflowSteps(t, d.client, id)
+	testutil.Equal(t, "refund", workflow.StepSucceeded, *steps["charge"].CompensationStatus)
+	testutil.Equal(t, "refund error", true, steps["charge"].CompensationError == nil)
+}
+
+func TestDispatcher_ProcessTask__WorkflowCompensationParallel(t *testing.T) {
+	d := newDispatcher(t)
+	d.ctx = context.Background()
+	d.ready = make(chan struct{}, 10)
+
+	var processed []string
+	d.client.Register(NewQueue[testTask](func(_ context.Context, tk testTask) error {
+		processed = append(processed, tk.Val)
+		if tk.Val == "in:ship" || tk.Val == "in:pack" {
+			return errors.New("out of stock")
+		}
+		return nil
+	}))
+
+	step := func(name string) WorkflowStep[string] {
+		return Step(name, func(input string) Task {
+			return testTask{Val: input + ":" + name}
+		}).Compensate(func(input string) Task {
+			return testTask{Val: input + ":undo-" + name}
+		})
+	}
+
+	// Execute a given task, which must be ready.
+	execute := func(id string) {
+		for _, tk := range testutil.GetTasks(t, d.client.db) {
+			if tk.ID == id {
+				testutil.Equal(t, "ready", 0, len(getDependencies(t, d.client)[id]))
+				tk.Attempts = 2
+				d.processTask(tk)
+				return
+			}
+		}
+		t.Fatalf("task %s not found", id)
+	}
+
+	// Execute the tasks which are ready until none remain.
+	process := func() {
+		for {
+			deps := getDependencies(t, d.client)
+
+			var executed bool
+			for _, tk := range testutil.GetTasks(t, d.client.db) {
+				if len(deps[tk.ID]) > 0 {
+					continue
+				}
+				tk.Attempts = 2
+				d.processTask(tk)
+				executed = true
+			}
+
+			if !executed {
+				return
+			}
+		}
+	}
+
+	checkout := NewWorkflow[string]("checkout").
+		Then(step("reserve")).
+		Then(step("charge"), step("ship"), step("pack")).
+		Then(step("notify"))
+
+	id, err := checkout.Start(context.Background(), d.client, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := getWorkflowSteps(t, d.client, id)
+
+	// Fail a step of the fan-out stage while the others are still executing.
+	execute(steps["reserve"].TaskID)
+	execute(steps["ship"].TaskID)
+	testutil.Equal(t, "failed", workflow.Compensating, getWorkflowStatus(t, d.client, id))
+
+	steps = getWorkflowSteps(t, d.client, id)
+	testutil.Equal(t, "reserve", workflow.CompensationPending, *steps["reserve"].CompensationStatus)
+	testutil.Equal(t, "charge", workflow.CompensationWaiting, *steps["charge"].CompensationStatus)
+	testutil.Equal(t, "pack", workflow.CompensationWaiting, *steps["pack"].CompensationStatus)
+	testutil.Equal(t, "ship", workflow.CompensationSkipped, *steps["ship"].CompensationStatus)
+	testutil.Equal(t, "notify", workflow.CompensationSkipped, *steps["notify"].CompensationStatus)
+
+	// The sibling which succeeds later is compensated after the compensations already released, while the one which
+	// fails is not.
+	execute(steps["charge"].TaskID)
+	execute(steps["pack"].TaskID)
+
+	steps = getWorkflowSteps(t, d.client, id)
+	testutil.Equal(t, "charge", workflow.CompensationPending, *steps["charge"].CompensationStatus)
+	testutil.Equal(t, "pack", workflow.CompensationSkipped, *steps["pack"].CompensationStatus)
+	testutil.Equal(t, "charge parent", *steps["reserve"].CompensationTaskID,
+		getDependencies(t, d.client)[*steps["charge"].CompensationTaskID][0])
+
+	processed = nil
+	process()
+	testutil.Length(t, processed, 2)
+	testutil.Equal(t, "undo reserve", "in:undo-reserve", processed[0])
+	testutil.Equal(t, "undo charge", "in:undo-charge", processed[1])
+	testutil.Equal(t, "compensated", workflow.Compensated, getWorkflowStatus(t, d.client, id))
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+
+	// A sibling which succeeds once the other compensations have completed is compensated straight away.
+	id, err = checkout.Start(context.Background(), d.client, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps = getWorkflowSteps(t, d.client, id)
+
+	execute(steps["reserve"].TaskID)
+	execute(steps["ship"].TaskID)
+	execute(*steps["reserve"].CompensationTaskID)
+	testutil.Equal(t, "compensating", workflow.Compensating, getWorkflowStatus(t, d.client, id))
+
+	execute(steps["pack"].TaskID)
+	execute(steps["charge"].TaskID)
+	execute(*steps["charge"].CompensationTaskID)
+	testutil.Equal(t, "compensated", workflow.Compensated, getWorkflowStatus(t, d.client, id))
+	testutil.Length(t, testutil.GetTasks(t, d.client.db), 0)
+}